@@ -0,0 +1,227 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+const (
+	adaptiveQualityInterval = 2 * time.Second
+	// feedback older than this is ignored, e.g. browsers that stopped sending REMB
+	adaptiveQualityFeedbackTTL = 10 * time.Second
+	// changes smaller than this are not worth reconfiguring the encoder for
+	adaptiveQualityMinChange = 0.02
+
+	// loss thresholds from the loss based controller of Google Congestion Control
+	adaptiveQualityHighLoss = 0.10
+	adaptiveQualityLowLoss  = 0.02
+	adaptiveQualityIncrease = 1.08
+)
+
+type AdaptiveQualityConfig struct {
+	Enabled   bool    `json:"enabled"`
+	MinFactor float64 `json:"min_factor"`
+	MaxFactor float64 `json:"max_factor"`
+}
+
+type AdaptiveQualityState struct {
+	Factor float64 `json:"factor"`
+	// EstimatedBitrate is the lowest receiver estimate across sessions in bits per second, 0 if unknown
+	EstimatedBitrate float64 `json:"estimatedBitrate"`
+	SendBitrate      float64 `json:"sendBitrate"`
+	LossRate         float64 `json:"lossRate"`
+}
+
+// bandwidthEstimator collects the congestion feedback sent by one viewer:
+// REMB estimates, loss in receiver reports, and loss derived from
+// transport-wide congestion control feedback.
+type bandwidthEstimator struct {
+	mu sync.Mutex
+
+	remb   float64
+	rembAt time.Time
+
+	reportLoss   float64
+	reportLossAt time.Time
+
+	twccReceived int
+	twccTotal    int
+}
+
+func (e *bandwidthEstimator) onRTCP(packet rtcp.Packet) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch p := packet.(type) {
+	case *rtcp.ReceiverEstimatedMaximumBitrate:
+		e.remb = float64(p.Bitrate)
+		e.rembAt = time.Now()
+	case *rtcp.ReceiverReport:
+		for _, report := range p.Reports {
+			e.reportLoss = float64(report.FractionLost) / 256
+			e.reportLossAt = time.Now()
+		}
+	case *rtcp.TransportLayerCC:
+		received, total := twccPacketCounts(p)
+		e.twccReceived += received
+		e.twccTotal += total
+	}
+}
+
+// twccPacketCounts returns how many of the packets covered by the feedback
+// arrived, and how many it covers.
+func twccPacketCounts(p *rtcp.TransportLayerCC) (received int, total int) {
+	remaining := int(p.PacketStatusCount)
+	for _, chunk := range p.PacketChunks {
+		switch c := chunk.(type) {
+		case *rtcp.RunLengthChunk:
+			n := min(int(c.RunLength), remaining)
+			if c.PacketStatusSymbol != rtcp.TypeTCCPacketNotReceived {
+				received += n
+			}
+			total += n
+			remaining -= n
+		case *rtcp.StatusVectorChunk:
+			for _, symbol := range c.SymbolList {
+				if remaining == 0 {
+					break
+				}
+				if symbol != rtcp.TypeTCCPacketNotReceived {
+					received++
+				}
+				total++
+				remaining--
+			}
+		}
+	}
+	return received, total
+}
+
+// sample returns the current bandwidth estimate (0 if unknown) and loss
+// rate, and starts a new TWCC measurement period.
+func (e *bandwidthEstimator) sample() (estimate float64, loss float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if time.Since(e.rembAt) < adaptiveQualityFeedbackTTL {
+		estimate = e.remb
+	}
+	if e.twccTotal > 0 {
+		loss = 1 - float64(e.twccReceived)/float64(e.twccTotal)
+		e.twccReceived, e.twccTotal = 0, 0
+	} else if time.Since(e.reportLossAt) < adaptiveQualityFeedbackTTL {
+		loss = e.reportLoss
+	}
+	return estimate, loss
+}
+
+// videoBytesSent counts the bytes handed to the broadcaster, to compare the
+// encoder output with what the viewers can take
+var videoBytesSent atomic.Int64
+
+// nextQualityFactor adjusts the factor for one viewer: back off on loss or
+// when sending above its estimate, probe upwards slowly otherwise.
+func nextQualityFactor(current float64, estimate float64, loss float64, sendRate float64) float64 {
+	switch {
+	case loss > adaptiveQualityHighLoss:
+		return current * (1 - 0.5*loss)
+	case estimate > 0 && sendRate > estimate:
+		return current * max(0.5, 0.9*estimate/sendRate)
+	case loss < adaptiveQualityLowLoss:
+		return current * adaptiveQualityIncrease
+	default:
+		return current
+	}
+}
+
+var adaptiveQualityState = AdaptiveQualityState{Factor: 1.0}
+var adaptiveQualityLock = &sync.Mutex{}
+
+func runAdaptiveQualityLoop() {
+	ticker := time.NewTicker(adaptiveQualityInterval)
+	defer ticker.Stop()
+	lastTick := time.Now()
+	lastBytes := videoBytesSent.Load()
+	for {
+		select {
+		case <-appCtx.Done():
+			return
+		case now := <-ticker.C:
+			bytes := videoBytesSent.Load()
+			sendRate := float64(bytes-lastBytes) * 8 / now.Sub(lastTick).Seconds()
+			lastTick, lastBytes = now, bytes
+			adjustQualityFactor(sendRate)
+		}
+	}
+}
+
+func adjustQualityFactor(sendRate float64) {
+	settings := config.AdaptiveQuality
+	if !settings.Enabled || sendRate == 0 {
+		return
+	}
+
+	connected := sessions.list()
+	if len(connected) == 0 {
+		return
+	}
+
+	// the encoder is shared, the slowest viewer decides
+	current := streamFactor
+	target := math.Inf(1)
+	state := AdaptiveQualityState{SendBitrate: sendRate}
+	for _, session := range connected {
+		estimate, loss := session.bandwidth.sample()
+		target = min(target, nextQualityFactor(current, estimate, loss, sendRate))
+		if estimate > 0 && (state.EstimatedBitrate == 0 || estimate < state.EstimatedBitrate) {
+			state.EstimatedBitrate = estimate
+		}
+		state.LossRate = max(state.LossRate, loss)
+	}
+	target = min(max(target, settings.MinFactor), settings.MaxFactor)
+	state.Factor = target
+
+	adaptiveQualityLock.Lock()
+	adaptiveQualityState = state
+	adaptiveQualityLock.Unlock()
+
+	if math.Abs(target-current) < adaptiveQualityMinChange {
+		return
+	}
+	logger.Debugf("adaptive quality: factor %.2f -> %.2f (estimate %.0f bps, send %.0f bps, loss %.1f%%)",
+		current, target, state.EstimatedBitrate, sendRate, state.LossRate*100)
+	if err := rpcSetStreamQualityFactor(target); err != nil {
+		logger.Warnf("failed to set adaptive quality factor: %v", err)
+		return
+	}
+	for _, session := range connected {
+		if session.RPCChannel != nil {
+			writeJSONRPCEvent("streamQualityFactor", state, session)
+		}
+	}
+}
+
+func rpcGetAdaptiveQuality() (AdaptiveQualityConfig, error) {
+	return config.AdaptiveQuality, nil
+}
+
+func rpcSetAdaptiveQuality(params AdaptiveQualityConfig) error {
+	if params.MinFactor <= 0 || params.MaxFactor > 1 || params.MinFactor > params.MaxFactor {
+		return errors.New("factors must satisfy 0 < min <= max <= 1")
+	}
+	config.AdaptiveQuality = params
+	if err := SaveConfig(); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
+
+func rpcGetAdaptiveQualityState() (AdaptiveQualityState, error) {
+	adaptiveQualityLock.Lock()
+	defer adaptiveQualityLock.Unlock()
+	return adaptiveQualityState, nil
+}
@@ -3,6 +3,7 @@ package kvm
 import (
 	"context"
 	"errors"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -16,16 +17,30 @@ type remoteImageBackend struct {
 }
 
 func (r remoteImageBackend) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = r.readAt(p, off)
+	virtualMediaActivity.recordRead(off, n)
+	return n, err
+}
+
+func (r remoteImageBackend) readAt(p []byte, off int64) (n int, err error) {
 	virtualMediaStateMutex.RLock()
 	logger.Debugf("currentVirtualMediaState is %v", currentVirtualMediaState)
 	logger.Debugf("read size: %d, off: %d", len(p), off)
 	if currentVirtualMediaState == nil {
+		virtualMediaStateMutex.RUnlock()
 		return 0, errors.New("image not mounted")
 	}
 	source := currentVirtualMediaState.Source
 	mountedImageSize := currentVirtualMediaState.Size
+	// rpcUnmountImage closes the image under the lock, a read still going
+	// on then fails with the closed file
+	image := storageDiskImage
 	virtualMediaStateMutex.RUnlock()
 
+	if off >= mountedImageSize {
+		return 0, io.EOF
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -43,6 +58,8 @@ func (r remoteImageBackend) ReadAt(p []byte, off int64) (n int, err error) {
 		return n, nil
 	} else if source == HTTP {
 		return httpRangeReader.ReadAt(p, off)
+	} else if (source == Storage || source == Composite) && image != nil {
+		return image.ReadAt(p[:readLen], off)
 	} else {
 		return 0, errors.New("unknown image source")
 	}
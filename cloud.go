@@ -174,6 +174,12 @@ func runWebsocketClient() error {
 			// ignore non-text messages
 			continue
 		}
+		var signaling CloudSignalingMessage
+		if err := json.Unmarshal(msg, &signaling); err == nil && signaling.Type != "" {
+			handleCloudSignalingMessage(signaling)
+			continue
+		}
+
 		var req WebRTCSessionRequest
 		err = json.Unmarshal(msg, &req)
 		if err != nil {
@@ -220,37 +226,91 @@ func handleSessionRequest(ctx context.Context, c *websocket.Conn, req WebRTCSess
 		return fmt.Errorf("google identity mismatch")
 	}
 
+	if req.SessionID != "" {
+		return resumeCloudSession(c, req)
+	}
+
+	identity := googleIdentity
+	var claims struct {
+		Email string `json:"email"`
+	}
+	if err := idToken.Claims(&claims); err == nil && claims.Email != "" {
+		identity = claims.Email
+	}
+
 	session, err := newSession(SessionConfig{
 		ICEServers: req.ICEServers,
 		LocalIP:    req.IP,
 		IsCloud:    true,
+		Source:     "cloud",
+		Identity:   identity,
+		// the token was checked against the device owner above
+		Admin: true,
 	})
 	if err != nil {
 		_ = wsjson.Write(context.Background(), c, gin.H{"error": err})
 		return err
 	}
 
+	session.setSignalingPath(cloudSignalingPath(c, session))
+	if req.Trickle {
+		return answerCloudSessionTrickle(c, session, req.Sd)
+	}
+
 	sd, err := session.ExchangeOffer(req.Sd)
 	if err != nil {
+		_ = session.peerConnection.Close()
 		_ = wsjson.Write(context.Background(), c, gin.H{"error": err})
 		return err
 	}
-	if currentSession != nil {
-		writeJSONRPCEvent("otherSessionConnected", nil, currentSession)
-		peerConn := currentSession.peerConnection
-		go func() {
-			time.Sleep(1 * time.Second)
-			_ = peerConn.Close()
-		}()
-	}
-
 	cloudLogger.Info("new session accepted")
 	cloudLogger.Tracef("new session accepted: %v", session)
-	currentSession = session
+	// earlier sessions are kept or replaced once connected, see sessionRegistry
 	_ = wsjson.Write(context.Background(), c, gin.H{"sd": sd})
 	return nil
 }
 
+// answerCloudSessionTrickle answers with the session ID the cloud relays the
+// browser candidates with, the device candidates follow the answer
+func answerCloudSessionTrickle(c *websocket.Conn, session *Session, offer string) error {
+	signaler := newTrickleSignaler(cloudCandidateSender(c, session))
+	sd, err := session.ExchangeOfferTrickle(offer, signaler.onCandidate)
+	if err != nil {
+		_ = session.peerConnection.Close()
+		_ = wsjson.Write(context.Background(), c, gin.H{"error": err})
+		return err
+	}
+	err = signaler.answer(func() error {
+		return wsjson.Write(context.Background(), c, gin.H{"sd": sd, "sessionId": session.ID})
+	})
+	if err != nil {
+		_ = session.peerConnection.Close()
+		return err
+	}
+	cloudLogger.Infof("new session %s accepted with trickle ICE", session.ID)
+	return nil
+}
+
+// resumeCloudSession answers an ICE restart offer for a cloud session, the
+// request was authenticated like a new one
+func resumeCloudSession(c *websocket.Conn, req WebRTCSessionRequest) error {
+	session := lookupSignalingSession(req.SessionID)
+	if session == nil || session.source != "cloud" {
+		_ = wsjson.Write(context.Background(), c, gin.H{"error": "no such session", "sessionId": req.SessionID})
+		return fmt.Errorf("no such session %s", req.SessionID)
+	}
+	sd, err := rpcRenegotiate(session, req.Sd)
+	if err != nil {
+		_ = wsjson.Write(context.Background(), c, gin.H{"error": err.Error(), "sessionId": session.ID})
+		return err
+	}
+	// the websocket may have been reconnected since the session started
+	session.setSignalingPath(cloudSignalingPath(c, session))
+	cloudLogger.Infof("session %s resumed with an ICE restart", session.ID)
+	_ = wsjson.Write(context.Background(), c, gin.H{"sd": sd, "sessionId": session.ID})
+	return nil
+}
+
 func RunWebsocketClient() {
 	for {
 		err := runWebsocketClient()
@@ -0,0 +1,54 @@
+// native_sim replaces jetkvm_native for development on a Linux workstation.
+// Run the app with JETKVM_NATIVE_SIM=1 so it does not start the real binary,
+// then run:
+//
+//	native_sim -video testsrc.h264
+//
+// An Annex B file can be made with
+//
+//	ffmpeg -f lavfi -i testsrc=size=1920x1080:rate=30 -t 10 -c:v libx264 -profile:v baseline -g 60 -bsf:v h264_mp4toannexb testsrc.h264
+//
+// SIGUSR1 toggles the HDMI signal, to exercise the no signal paths.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"kvm/internal/nativesim"
+)
+
+func main() {
+	var config nativesim.Config
+	flag.StringVar(&config.CtrlSocket, "ctrl", nativesim.DefaultCtrlSocket, "ctrl socket path")
+	flag.StringVar(&config.VideoSocket, "video-socket", nativesim.DefaultVideoSocket, "video socket path")
+	flag.StringVar(&config.VideoFile, "video", "", "H.264 Annex B file streamed in a loop")
+	flag.Float64Var(&config.FPS, "fps", 30, "frame rate of the video file")
+	flag.IntVar(&config.Width, "width", 1920, "reported input width")
+	flag.IntVar(&config.Height, "height", 1080, "reported input height")
+	flag.Parse()
+
+	sim, err := nativesim.New(config)
+	if err != nil {
+		log.Fatalf("failed to start simulator: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	toggle := make(chan os.Signal, 1)
+	signal.Notify(toggle, syscall.SIGUSR1)
+	go func() {
+		for range toggle {
+			ready := !sim.SignalReady()
+			log.Printf("HDMI signal ready: %v", ready)
+			sim.SetSignal(ready, "no_signal")
+		}
+	}()
+
+	sim.Run(ctx)
+}
@@ -0,0 +1,182 @@
+package kvm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	gptTypeEFISystem = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	gptTypeLinuxData = "0FC63DAF-8483-4772-8E79-3D47C9E47DE4"
+)
+
+// gptPartitionTypes maps the partition types accepted by the composite disk
+// builder to GPT partition type GUIDs.
+var gptPartitionTypes = map[string]string{
+	"":           gptTypeBasicData,
+	"basic-data": gptTypeBasicData,
+	"efi":        gptTypeEFISystem,
+	"linux":      gptTypeLinuxData,
+}
+
+type CompositePartition struct {
+	Filename string `json:"filename"`
+	// Type is one of basic-data (default), efi or linux
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+type MountCompositeDiskParams struct {
+	Partitions []CompositePartition `json:"partitions"`
+}
+
+// compositeExtent is a region of the composite disk, backed by data or by
+// zeros when data is nil.
+type compositeExtent struct {
+	start int64
+	size  int64
+	data  io.ReaderAt
+}
+
+// compositeDiskImage presents several images as the partitions of a single
+// GPT disk. The partition table is synthesised in memory and reads are
+// forwarded to the underlying images, nothing is copied.
+type compositeDiskImage struct {
+	size    int64
+	extents []compositeExtent
+	images  []diskImage
+}
+
+func openCompositeDiskImage(partitions []CompositePartition) (*compositeDiskImage, error) {
+	if len(partitions) == 0 {
+		return nil, errors.New("at least one partition is required")
+	}
+	if len(partitions) > gptEntriesCount {
+		return nil, fmt.Errorf("at most %d partitions are supported", gptEntriesCount)
+	}
+
+	composite := &compositeDiskImage{}
+	var gptPartitions []diskPartition
+	alignment := int64(partitionAlignment)
+	nextSector := alignment
+	for _, partition := range partitions {
+		typeGUID, ok := gptPartitionTypes[partition.Type]
+		if !ok {
+			composite.Close()
+			return nil, fmt.Errorf("invalid partition type: %s", partition.Type)
+		}
+		filename, err := sanitizeFilename(partition.Filename)
+		if err != nil {
+			composite.Close()
+			return nil, err
+		}
+		image, _, err := openDiskImage(filepath.Join(imagesFolder, filename))
+		if err != nil {
+			composite.Close()
+			return nil, err
+		}
+		composite.images = append(composite.images, image)
+
+		name := partition.Name
+		if name == "" {
+			name = strings.TrimSuffix(filename, filepath.Ext(filename))
+		}
+		// partitions cover whole alignment units, the tail is zero filled
+		sectors := (image.Size() + sectorSize - 1) / sectorSize
+		sectors = (sectors + alignment - 1) / alignment * alignment
+		gptPartitions = append(gptPartitions, diskPartition{
+			Start:   nextSector,
+			Sectors: sectors,
+			GPTType: typeGUID,
+			Name:    name,
+		})
+		composite.extents = append(composite.extents, compositeExtent{
+			start: nextSector * sectorSize,
+			size:  image.Size(),
+			data:  image,
+		})
+		nextSector += sectors
+	}
+
+	// the backup GPT follows the last partition
+	diskSectors := nextSector + gptEntriesSectors + 1
+	primary, backup, err := buildGPT(diskSectors, gptPartitions)
+	if err != nil {
+		composite.Close()
+		return nil, err
+	}
+	composite.size = diskSectors * sectorSize
+	composite.extents = append(composite.extents,
+		compositeExtent{start: 0, size: int64(len(primary)), data: bytes.NewReader(primary)},
+		compositeExtent{start: nextSector * sectorSize, size: int64(len(backup)), data: bytes.NewReader(backup)},
+	)
+	return composite, nil
+}
+
+func (c *compositeDiskImage) Size() int64 {
+	return c.size
+}
+
+func (c *compositeDiskImage) Close() error {
+	for _, image := range c.images {
+		_ = image.Close()
+	}
+	return nil
+}
+
+func (c *compositeDiskImage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= c.size {
+		return 0, io.EOF
+	}
+	total := int(min(int64(len(p)), c.size-off))
+	// anything not covered by an extent is padding between partitions
+	clear(p[:total])
+	for _, extent := range c.extents {
+		start := max(off, extent.start)
+		end := min(off+int64(total), extent.start+extent.size)
+		if start >= end {
+			continue
+		}
+		_, err := readAtPadded(extent.data, p[start-off:end-off], start-extent.start, extent.size)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if total < len(p) {
+		return total, io.EOF
+	}
+	return total, nil
+}
+
+func rpcMountCompositeDisk(params MountCompositeDiskParams) error {
+	virtualMediaStateMutex.Lock()
+	if currentVirtualMediaState != nil {
+		virtualMediaStateMutex.Unlock()
+		return fmt.Errorf("another virtual media is already mounted")
+	}
+
+	composite, err := openCompositeDiskImage(params.Partitions)
+	if err != nil {
+		virtualMediaStateMutex.Unlock()
+		return err
+	}
+	filenames := make([]string, len(params.Partitions))
+	for i, partition := range params.Partitions {
+		filenames[i] = filepath.Base(partition.Filename)
+	}
+	logger.Infof("using composite disk of %v with size %d", filenames, composite.Size())
+	storageDiskImage = composite
+	currentVirtualMediaState = &VirtualMediaState{
+		Source:     Composite,
+		Mode:       Disk,
+		Partitions: filenames,
+		Size:       composite.Size(),
+	}
+	virtualMediaStateMutex.Unlock()
+
+	return mountNBDDevice()
+}
@@ -21,23 +21,37 @@ type UsbConfig struct {
 }
 
 type Config struct {
-	CloudURL             string            `json:"cloud_url"`
-	CloudAppURL          string            `json:"cloud_app_url"`
-	CloudToken           string            `json:"cloud_token"`
-	GoogleIdentity       string            `json:"google_identity"`
-	JigglerEnabled       bool              `json:"jiggler_enabled"`
-	AutoUpdateEnabled    bool              `json:"auto_update_enabled"`
-	IncludePreRelease    bool              `json:"include_pre_release"`
-	HashedPassword       string            `json:"hashed_password"`
-	LocalAuthToken       string            `json:"local_auth_token"`
-	LocalAuthMode        string            `json:"localAuthMode"` //TODO: fix it with migration
-	WakeOnLanDevices     []WakeOnLanDevice `json:"wake_on_lan_devices"`
-	EdidString           string            `json:"hdmi_edid_string"`
-	ActiveExtension      string            `json:"active_extension"`
-	DisplayMaxBrightness int               `json:"display_max_brightness"`
-	DisplayDimAfterSec   int               `json:"display_dim_after_sec"`
-	DisplayOffAfterSec   int               `json:"display_off_after_sec"`
-	UsbConfig            *UsbConfig        `json:"usb_config"`
+	CloudURL              string                `json:"cloud_url"`
+	CloudAppURL           string                `json:"cloud_app_url"`
+	CloudToken            string                `json:"cloud_token"`
+	GoogleIdentity        string                `json:"google_identity"`
+	JigglerEnabled        bool                  `json:"jiggler_enabled"`
+	AutoUpdateEnabled     bool                  `json:"auto_update_enabled"`
+	IncludePreRelease     bool                  `json:"include_pre_release"`
+	HashedPassword        string                `json:"hashed_password"`
+	LocalAuthToken        string                `json:"local_auth_token"`
+	LocalAuthMode         string                `json:"localAuthMode"` //TODO: fix it with migration
+	WakeOnLanDevices      []WakeOnLanDevice     `json:"wake_on_lan_devices"`
+	EdidString            string                `json:"hdmi_edid_string"`
+	SavedEDIDs            []SavedEDID           `json:"saved_edids"`
+	ActiveExtension       string                `json:"active_extension"`
+	DisplayMaxBrightness  int                   `json:"display_max_brightness"`
+	DisplayDimAfterSec    int                   `json:"display_dim_after_sec"`
+	DisplayOffAfterSec    int                   `json:"display_off_after_sec"`
+	UsbConfig             *UsbConfig            `json:"usb_config"`
+	VirtualMediaAutoEject VirtualMediaAutoEject `json:"virtual_media_auto_eject"`
+	RecordingSettings     RecordingSettings     `json:"recording_settings"`
+	AdaptiveQuality       AdaptiveQualityConfig `json:"adaptive_quality"`
+	WHEPToken             string                `json:"whep_token"`
+	RTSPServer            RTSPServerConfig      `json:"rtsp_server"`
+	StreamOutput          StreamOutputConfig    `json:"stream_output"`
+	SignalLossAlert       SignalLossAlertConfig `json:"signal_loss_alert"`
+	Takeover              TakeoverConfig        `json:"takeover"`
+	WebRTCNetwork         WebRTCNetworkConfig   `json:"webrtc_network"`
+	SessionPolicy         SessionPolicyConfig   `json:"session_policy"`
+	// MultiSession keeps earlier sessions connected when a new one opens,
+	// see sessionRegistry. Off, the new session replaces them.
+	MultiSession bool `json:"multi_session"`
 }
 
 const configPath = "/userdata/kvm_config.json"
@@ -57,6 +71,27 @@ var defaultConfig = &Config{
 		Manufacturer: "JetKVM",
 		Product:      "USB Emulation Device",
 	},
+	RecordingSettings: RecordingSettings{
+		MaxAgeDays: 30,
+		MaxSizeMB:  2048,
+	},
+	AdaptiveQuality: AdaptiveQualityConfig{
+		MinFactor: 0.1,
+		MaxFactor: 1.0,
+	},
+	RTSPServer: RTSPServerConfig{
+		Port: 554,
+	},
+	SignalLossAlert: SignalLossAlertConfig{
+		Enabled:      true,
+		ThresholdSec: 300, // 5 minutes
+	},
+	Takeover: TakeoverConfig{
+		TimeoutSec: 30,
+	},
+	SessionPolicy: SessionPolicyConfig{
+		WarningSec: 60,
+	},
 }
 
 var (
@@ -0,0 +1,210 @@
+package kvm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type DiskImageFormat string
+
+const (
+	RawImage   DiskImageFormat = "raw"
+	QCOW2Image DiskImageFormat = "qcow2"
+	VHDImage   DiskImageFormat = "vhd"
+	VHDXImage  DiskImageFormat = "vhdx"
+	VMDKImage  DiskImageFormat = "vmdk"
+)
+
+// maxBackingChainDepth limits how many backing/parent images we follow,
+// protecting against loops between images referencing each other.
+const maxBackingChainDepth = 8
+
+// diskImage is a read-only view of the virtual block device stored inside
+// an image file, regardless of its container format.
+type diskImage interface {
+	io.ReaderAt
+	// Size returns the virtual size of the disk in bytes
+	Size() int64
+	Close() error
+}
+
+// rawDiskImage is used for backing files that are plain raw images.
+type rawDiskImage struct {
+	file *os.File
+	size int64
+}
+
+func (r *rawDiskImage) ReadAt(p []byte, off int64) (int, error) {
+	return readAtPadded(r.file, p, off, r.size)
+}
+
+func (r *rawDiskImage) Size() int64 {
+	return r.size
+}
+
+func (r *rawDiskImage) Close() error {
+	return r.file.Close()
+}
+
+func detectDiskImageFormat(file *os.File) (DiskImageFormat, error) {
+	header := make([]byte, 512)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte("QFI\xfb")):
+		return QCOW2Image, nil
+	case bytes.HasPrefix(header, []byte("vhdxfile")):
+		return VHDXImage, nil
+	case bytes.HasPrefix(header, []byte("KDMV")):
+		return VMDKImage, nil
+	case bytes.HasPrefix(header, []byte("# Disk DescriptorFile")):
+		return VMDKImage, nil
+	case bytes.HasPrefix(header, []byte("conectix")):
+		// dynamic and differencing disks carry a copy of the footer at the start
+		return VHDImage, nil
+	}
+
+	// fixed VHDs only have the footer at the end of the file
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() >= 512 {
+		footer := make([]byte, 8)
+		if _, err := file.ReadAt(footer, info.Size()-512); err == nil && string(footer) == "conectix" {
+			return VHDImage, nil
+		}
+	}
+	return RawImage, nil
+}
+
+// openDiskImage opens the image at imagePath and returns a reader for the
+// virtual disk it contains, following backing files when needed.
+func openDiskImage(imagePath string) (diskImage, DiskImageFormat, error) {
+	return openDiskImageChain(imagePath, 0)
+}
+
+func openDiskImageChain(imagePath string, depth int) (diskImage, DiskImageFormat, error) {
+	if depth > maxBackingChainDepth {
+		return nil, "", errors.New("backing file chain is too deep")
+	}
+
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	format, err := detectDiskImageFormat(file)
+	if err != nil {
+		file.Close()
+		return nil, "", fmt.Errorf("failed to detect image format: %w", err)
+	}
+
+	var image diskImage
+	switch format {
+	case QCOW2Image:
+		image, err = openQCOW2Image(file, imagePath, depth)
+	case VHDImage:
+		image, err = openVHDImage(file, imagePath, depth)
+	case VHDXImage:
+		image, err = openVHDXImage(file, imagePath, depth)
+	case VMDKImage:
+		image, err = openVMDKImage(file, imagePath, depth)
+	default:
+		var info os.FileInfo
+		info, err = file.Stat()
+		if err == nil {
+			image = &rawDiskImage{file: file, size: info.Size()}
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, format, fmt.Errorf("failed to open %s image %s: %w", format, filepath.Base(imagePath), err)
+	}
+	return image, format, nil
+}
+
+// resolveBackingFile resolves a backing file reference found in an image
+// header. References are resolved relative to the referencing image, and
+// must not point outside of the directory holding it.
+func resolveBackingFile(imagePath string, backingFile string) (string, error) {
+	backingFile = strings.ReplaceAll(backingFile, "\\", "/")
+	dir := filepath.Dir(imagePath)
+	var resolved string
+	isWindowsAbs := len(backingFile) >= 2 && backingFile[1] == ':'
+	if filepath.IsAbs(backingFile) || isWindowsAbs {
+		// images are usually created on another machine, so fall back to the file name
+		resolved = filepath.Join(dir, filepath.Base(backingFile))
+	} else {
+		resolved = filepath.Join(dir, filepath.Clean(backingFile))
+	}
+	rel, err := filepath.Rel(dir, resolved)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("backing file %s is outside of the images folder", backingFile)
+	}
+	return resolved, nil
+}
+
+func openBackingImage(imagePath string, backingFile string, depth int) (diskImage, error) {
+	resolved, err := resolveBackingFile(imagePath, backingFile)
+	if err != nil {
+		return nil, err
+	}
+	backing, _, err := openDiskImageChain(resolved, depth+1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backing file: %w", err)
+	}
+	return backing, nil
+}
+
+// readBacking fills p from the backing image, or with zeros if there is
+// no backing image or p extends past its end.
+func readBacking(backing diskImage, p []byte, off int64) error {
+	if backing == nil {
+		clear(p)
+		return nil
+	}
+	_, err := readAtPadded(backing, p, off, backing.Size())
+	return err
+}
+
+// readAtPadded reads from r like ReadAt, but zero-fills anything past size
+// instead of returning io.EOF.
+func readAtPadded(r io.ReaderAt, p []byte, off int64, size int64) (int, error) {
+	if off >= size {
+		clear(p)
+		return len(p), nil
+	}
+	n := len(p)
+	if off+int64(n) > size {
+		n = int(size - off)
+	}
+	read, err := r.ReadAt(p[:n], off)
+	if err != nil && !(err == io.EOF && read == n) {
+		return read, err
+	}
+	clear(p[n:])
+	return len(p), nil
+}
+
+// readFull reads len(p) bytes from r at off, treating a short read as an
+// error since it indicates a truncated image.
+func readFull(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
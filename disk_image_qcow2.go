@@ -0,0 +1,255 @@
+package kvm
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// qcow2 specification: https://gitlab.com/qemu-project/qemu/-/blob/master/docs/interop/qcow2.txt
+
+const (
+	qcow2IncompatDirty        = 1 << 0
+	qcow2IncompatCorrupt      = 1 << 1
+	qcow2IncompatDataFile     = 1 << 2
+	qcow2IncompatCompression  = 1 << 3
+	qcow2IncompatExtendedL2   = 1 << 4
+	qcow2KnownIncompatFeature = qcow2IncompatDirty | qcow2IncompatCorrupt | qcow2IncompatDataFile | qcow2IncompatCompression | qcow2IncompatExtendedL2
+
+	qcow2OffsetMask     = 0x00fffffffffffe00
+	qcow2CompressedFlag = 1 << 62
+	qcow2ZeroFlag       = 1 << 0
+
+	// number of L2 tables kept in memory, each one is a single cluster
+	qcow2L2CacheSize = 32
+)
+
+type qcow2Image struct {
+	file        *os.File
+	backing     diskImage
+	size        int64
+	clusterBits uint32
+	clusterSize int64
+	l1Table     []uint64
+
+	l2CacheLock sync.Mutex
+	l2Cache     map[uint64][]uint64
+}
+
+func openQCOW2Image(file *os.File, imagePath string, depth int) (diskImage, error) {
+	header := make([]byte, 112)
+	if err := readFull(file, header[:72], 0); err != nil {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	version := binary.BigEndian.Uint32(header[4:])
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("unsupported qcow2 version %d", version)
+	}
+	backingFileOffset := binary.BigEndian.Uint64(header[8:])
+	backingFileSize := binary.BigEndian.Uint32(header[16:])
+	clusterBits := binary.BigEndian.Uint32(header[20:])
+	size := binary.BigEndian.Uint64(header[24:])
+	cryptMethod := binary.BigEndian.Uint32(header[32:])
+	l1Size := binary.BigEndian.Uint32(header[36:])
+	l1TableOffset := binary.BigEndian.Uint64(header[40:])
+
+	if clusterBits < 9 || clusterBits > 21 {
+		return nil, fmt.Errorf("invalid cluster bits %d", clusterBits)
+	}
+	if cryptMethod != 0 {
+		return nil, errors.New("encrypted images are not supported")
+	}
+
+	if version == 3 {
+		if err := readFull(file, header[72:104], 72); err != nil {
+			return nil, fmt.Errorf("failed to read header: %w", err)
+		}
+		incompatible := binary.BigEndian.Uint64(header[72:])
+		if incompatible&^qcow2KnownIncompatFeature != 0 {
+			return nil, fmt.Errorf("unsupported incompatible features %#x", incompatible)
+		}
+		if incompatible&qcow2IncompatCorrupt != 0 {
+			return nil, errors.New("image is marked as corrupt")
+		}
+		if incompatible&qcow2IncompatDataFile != 0 {
+			return nil, errors.New("images with an external data file are not supported")
+		}
+		if incompatible&qcow2IncompatExtendedL2 != 0 {
+			return nil, errors.New("images with extended L2 entries are not supported")
+		}
+		if incompatible&qcow2IncompatCompression != 0 {
+			headerLength := binary.BigEndian.Uint32(header[100:])
+			if headerLength > 104 {
+				if err := readFull(file, header[104:105], 104); err != nil {
+					return nil, fmt.Errorf("failed to read header: %w", err)
+				}
+				if header[104] != 0 {
+					return nil, errors.New("only zlib compressed images are supported")
+				}
+			}
+		}
+	}
+
+	clusterSize := int64(1) << clusterBits
+	l2Entries := uint64(clusterSize / 8)
+	if uint64(l1Size) < (size+uint64(clusterSize)*l2Entries-1)/(uint64(clusterSize)*l2Entries) {
+		return nil, errors.New("L1 table is too small for the virtual size")
+	}
+
+	l1Raw := make([]byte, int64(l1Size)*8)
+	if err := readFull(file, l1Raw, int64(l1TableOffset)); err != nil {
+		return nil, fmt.Errorf("failed to read L1 table: %w", err)
+	}
+	l1Table := make([]uint64, l1Size)
+	for i := range l1Table {
+		l1Table[i] = binary.BigEndian.Uint64(l1Raw[i*8:])
+	}
+
+	image := &qcow2Image{
+		file:        file,
+		size:        int64(size),
+		clusterBits: clusterBits,
+		clusterSize: clusterSize,
+		l1Table:     l1Table,
+		l2Cache:     make(map[uint64][]uint64),
+	}
+
+	if backingFileOffset != 0 && backingFileSize != 0 {
+		if backingFileSize > 1023 {
+			return nil, errors.New("backing file name is too long")
+		}
+		name := make([]byte, backingFileSize)
+		if err := readFull(file, name, int64(backingFileOffset)); err != nil {
+			return nil, fmt.Errorf("failed to read backing file name: %w", err)
+		}
+		var err error
+		image.backing, err = openBackingImage(imagePath, string(name), depth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return image, nil
+}
+
+func (q *qcow2Image) Size() int64 {
+	return q.size
+}
+
+func (q *qcow2Image) Close() error {
+	if q.backing != nil {
+		_ = q.backing.Close()
+	}
+	return q.file.Close()
+}
+
+func (q *qcow2Image) ReadAt(p []byte, off int64) (int, error) {
+	if off >= q.size {
+		return 0, io.EOF
+	}
+	total := len(p)
+	if off+int64(total) > q.size {
+		total = int(q.size - off)
+	}
+
+	read := 0
+	for read < total {
+		pos := off + int64(read)
+		inCluster := pos & (q.clusterSize - 1)
+		chunk := int(min(q.clusterSize-inCluster, int64(total-read)))
+		if err := q.readCluster(p[read:read+chunk], pos, inCluster); err != nil {
+			return read, err
+		}
+		read += chunk
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (q *qcow2Image) readCluster(p []byte, pos int64, inCluster int64) error {
+	entry, err := q.l2Entry(pos)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case entry&qcow2CompressedFlag != 0:
+		data, err := q.readCompressedCluster(entry)
+		if err != nil {
+			return err
+		}
+		copy(p, data[inCluster:])
+		return nil
+	case entry&qcow2ZeroFlag != 0:
+		clear(p)
+		return nil
+	case entry&qcow2OffsetMask == 0:
+		// unallocated, falls through to the backing file
+		return readBacking(q.backing, p, pos)
+	default:
+		return readFull(q.file, p, int64(entry&qcow2OffsetMask)+inCluster)
+	}
+}
+
+// l2Entry returns the L2 table entry describing the cluster at pos, or zero
+// if the cluster is not allocated.
+func (q *qcow2Image) l2Entry(pos int64) (uint64, error) {
+	l2Bits := q.clusterBits - 3
+	l1Index := uint64(pos) >> (q.clusterBits + l2Bits)
+	l2Index := (uint64(pos) >> q.clusterBits) & (1<<l2Bits - 1)
+	if l1Index >= uint64(len(q.l1Table)) {
+		return 0, nil
+	}
+	l2Offset := q.l1Table[l1Index] & qcow2OffsetMask
+	if l2Offset == 0 {
+		return 0, nil
+	}
+
+	q.l2CacheLock.Lock()
+	defer q.l2CacheLock.Unlock()
+	table, ok := q.l2Cache[l2Offset]
+	if !ok {
+		raw := make([]byte, q.clusterSize)
+		if err := readFull(q.file, raw, int64(l2Offset)); err != nil {
+			return 0, fmt.Errorf("failed to read L2 table: %w", err)
+		}
+		table = make([]uint64, q.clusterSize/8)
+		for i := range table {
+			table[i] = binary.BigEndian.Uint64(raw[i*8:])
+		}
+		if len(q.l2Cache) >= qcow2L2CacheSize {
+			clear(q.l2Cache)
+		}
+		q.l2Cache[l2Offset] = table
+	}
+	return table[l2Index], nil
+}
+
+func (q *qcow2Image) readCompressedCluster(entry uint64) ([]byte, error) {
+	offsetBits := 62 - (q.clusterBits - 8)
+	hostOffset := int64(entry & (1<<offsetBits - 1))
+	sectors := int64((entry>>offsetBits)&(1<<(q.clusterBits-8)-1)) + 1
+	compressedSize := sectors*512 - hostOffset&511
+
+	compressed := make([]byte, compressedSize)
+	n, err := q.file.ReadAt(compressed, hostOffset)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read compressed cluster: %w", err)
+	}
+
+	data := make([]byte, q.clusterSize)
+	reader := flate.NewReader(bytes.NewReader(compressed[:n]))
+	defer reader.Close()
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, fmt.Errorf("failed to decompress cluster: %w", err)
+	}
+	return data, nil
+}
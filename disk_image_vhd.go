@@ -0,0 +1,204 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// VHD specification: https://www.microsoft.com/en-us/download/details.aspx?id=23850
+
+const (
+	vhdDiskTypeFixed        = 2
+	vhdDiskTypeDynamic      = 3
+	vhdDiskTypeDifferencing = 4
+
+	vhdUnallocatedBlock = 0xffffffff
+)
+
+type vhdImage struct {
+	file *os.File
+	// parent is only set for differencing disks
+	parent diskImage
+	size   int64
+
+	// fixed disks store data directly, the fields below are for dynamic disks
+	fixed            bool
+	blockSize        int64
+	bitmapSize       int64
+	blockAllocations []uint32
+}
+
+func openVHDImage(file *os.File, imagePath string, depth int) (diskImage, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < 512 {
+		return nil, errors.New("file is too small")
+	}
+
+	footer := make([]byte, 512)
+	if err := readFull(file, footer, info.Size()-512); err != nil {
+		return nil, fmt.Errorf("failed to read footer: %w", err)
+	}
+	if string(footer[:8]) != "conectix" {
+		// the footer at the end can be damaged, dynamic disks keep a copy at the start
+		if err := readFull(file, footer, 0); err != nil || string(footer[:8]) != "conectix" {
+			return nil, errors.New("footer not found")
+		}
+	}
+
+	image := &vhdImage{
+		file: file,
+		size: int64(binary.BigEndian.Uint64(footer[48:])),
+	}
+
+	diskType := binary.BigEndian.Uint32(footer[60:])
+	switch diskType {
+	case vhdDiskTypeFixed:
+		image.fixed = true
+		if image.size > info.Size()-512 {
+			return nil, errors.New("fixed disk is truncated")
+		}
+		return image, nil
+	case vhdDiskTypeDynamic, vhdDiskTypeDifferencing:
+	default:
+		return nil, fmt.Errorf("unsupported disk type %d", diskType)
+	}
+
+	dynamicHeaderOffset := int64(binary.BigEndian.Uint64(footer[16:]))
+	header := make([]byte, 1024)
+	if err := readFull(file, header, dynamicHeaderOffset); err != nil {
+		return nil, fmt.Errorf("failed to read dynamic disk header: %w", err)
+	}
+	if string(header[:8]) != "cxsparse" {
+		return nil, errors.New("invalid dynamic disk header")
+	}
+
+	tableOffset := int64(binary.BigEndian.Uint64(header[16:]))
+	maxTableEntries := binary.BigEndian.Uint32(header[28:])
+	image.blockSize = int64(binary.BigEndian.Uint32(header[32:]))
+	if image.blockSize == 0 || image.blockSize%512 != 0 {
+		return nil, fmt.Errorf("invalid block size %d", image.blockSize)
+	}
+	if int64(maxTableEntries)*image.blockSize < image.size {
+		return nil, errors.New("block allocation table is too small for the virtual size")
+	}
+	// one bit per sector, padded to a sector boundary
+	image.bitmapSize = (image.blockSize/512/8 + 511) / 512 * 512
+
+	table := make([]byte, int64(maxTableEntries)*4)
+	if err := readFull(file, table, tableOffset); err != nil {
+		return nil, fmt.Errorf("failed to read block allocation table: %w", err)
+	}
+	image.blockAllocations = make([]uint32, maxTableEntries)
+	for i := range image.blockAllocations {
+		image.blockAllocations[i] = binary.BigEndian.Uint32(table[i*4:])
+	}
+
+	if diskType == vhdDiskTypeDifferencing {
+		parentName := decodeUTF16BE(header[64:576])
+		if parentName == "" {
+			return nil, errors.New("differencing disk has no parent name")
+		}
+		image.parent, err = openBackingImage(imagePath, parentName, depth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return image, nil
+}
+
+func decodeUTF16BE(b []byte) string {
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		unit := binary.BigEndian.Uint16(b[i:])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+	return strings.TrimSpace(string(utf16.Decode(units)))
+}
+
+func (v *vhdImage) Size() int64 {
+	return v.size
+}
+
+func (v *vhdImage) Close() error {
+	if v.parent != nil {
+		_ = v.parent.Close()
+	}
+	return v.file.Close()
+}
+
+func (v *vhdImage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	total := len(p)
+	if off+int64(total) > v.size {
+		total = int(v.size - off)
+	}
+
+	if v.fixed {
+		if err := readFull(v.file, p[:total], off); err != nil {
+			return 0, err
+		}
+	} else {
+		read := 0
+		for read < total {
+			pos := off + int64(read)
+			inBlock := pos % v.blockSize
+			chunk := int(min(v.blockSize-inBlock, int64(total-read)))
+			if err := v.readBlock(p[read:read+chunk], pos, inBlock); err != nil {
+				return read, err
+			}
+			read += chunk
+		}
+	}
+
+	if total < len(p) {
+		return total, io.EOF
+	}
+	return total, nil
+}
+
+func (v *vhdImage) readBlock(p []byte, pos int64, inBlock int64) error {
+	blockSector := v.blockAllocations[pos/v.blockSize]
+	if blockSector == vhdUnallocatedBlock {
+		return readBacking(v.parent, p, pos)
+	}
+	dataOffset := int64(blockSector)*512 + v.bitmapSize
+
+	if v.parent == nil {
+		return readFull(v.file, p, dataOffset+inBlock)
+	}
+
+	// differencing disks track per sector whether the data lives in this file or the parent
+	bitmap := make([]byte, v.bitmapSize)
+	if err := readFull(v.file, bitmap, int64(blockSector)*512); err != nil {
+		return fmt.Errorf("failed to read sector bitmap: %w", err)
+	}
+	for done := 0; done < len(p); {
+		sector := (inBlock + int64(done)) / 512
+		chunk := int(min(512-(inBlock+int64(done))%512, int64(len(p)-done)))
+		var err error
+		if bitmap[sector/8]&(0x80>>(sector%8)) != 0 {
+			err = readFull(v.file, p[done:done+chunk], dataOffset+inBlock+int64(done))
+		} else {
+			err = readBacking(v.parent, p[done:done+chunk], pos+int64(done))
+		}
+		if err != nil {
+			return err
+		}
+		done += chunk
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// VHDX specification: https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-vhdx
+
+const (
+	vhdxHeader1Offset      = 64 * 1024
+	vhdxHeader2Offset      = 128 * 1024
+	vhdxHeaderSize         = 4 * 1024
+	vhdxRegionTableOffset  = 192 * 1024
+	vhdxRegionTableSize    = 64 * 1024
+	vhdxBATRegionGUID      = "2DC27766-F623-4200-9D64-115E9BFD4A08"
+	vhdxMetadataRegionGUID = "8B7CA206-4790-4B9A-B8FE-575F050F886E"
+
+	vhdxFileParametersGUID    = "CAA16737-FA36-4D43-B3B6-33F0AA44E76B"
+	vhdxVirtualDiskSizeGUID   = "2FA54224-CD1B-4876-B211-5DBED83BF4B8"
+	vhdxLogicalSectorSizeGUID = "8141BF1D-A96F-4709-BA47-F233A8FAAB5F"
+	vhdxParentLocatorGUID     = "A8D35F2B-B30B-454D-ABF7-D3D84834AB0C"
+
+	vhdxHasParentFlag = 1 << 1
+
+	vhdxBlockNotPresent       = 0
+	vhdxBlockFullyPresent     = 6
+	vhdxBlockPartiallyPresent = 7
+	vhdxBitmapPresent         = 6
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+type vhdxImage struct {
+	file              *os.File
+	parent            diskImage
+	size              int64
+	blockSize         int64
+	logicalSectorSize int64
+	chunkRatio        int64
+	bat               []uint64
+}
+
+// formatGUID formats a GUID stored in the mixed-endian Windows layout.
+func formatGUID(b []byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(b[0:]),
+		binary.LittleEndian.Uint16(b[4:]),
+		binary.LittleEndian.Uint16(b[6:]),
+		b[8:10], b[10:16])
+}
+
+func vhdxChecksumValid(b []byte) bool {
+	expected := binary.LittleEndian.Uint32(b[4:])
+	copied := make([]byte, len(b))
+	copy(copied, b)
+	binary.LittleEndian.PutUint32(copied[4:], 0)
+	return crc32.Checksum(copied, crc32c) == expected
+}
+
+func openVHDXImage(file *os.File, imagePath string, depth int) (diskImage, error) {
+	// pick the valid header with the highest sequence number
+	var current []byte
+	var currentSeq uint64
+	for _, offset := range []int64{vhdxHeader1Offset, vhdxHeader2Offset} {
+		header := make([]byte, vhdxHeaderSize)
+		if err := readFull(file, header, offset); err != nil {
+			continue
+		}
+		if string(header[:4]) != "head" || !vhdxChecksumValid(header) {
+			continue
+		}
+		seq := binary.LittleEndian.Uint64(header[8:])
+		if current == nil || seq > currentSeq {
+			current, currentSeq = header, seq
+		}
+	}
+	if current == nil {
+		return nil, errors.New("no valid header found")
+	}
+	if formatGUID(current[48:64]) != "00000000-0000-0000-0000-000000000000" {
+		return nil, errors.New("image has a pending log, attach it in Hyper-V once to replay it")
+	}
+
+	regionTable := make([]byte, vhdxRegionTableSize)
+	if err := readFull(file, regionTable, vhdxRegionTableOffset); err != nil {
+		return nil, fmt.Errorf("failed to read region table: %w", err)
+	}
+	if string(regionTable[:4]) != "regi" || !vhdxChecksumValid(regionTable) {
+		return nil, errors.New("invalid region table")
+	}
+	var batOffset, metadataOffset int64
+	var batLength, metadataLength int64
+	entryCount := int(binary.LittleEndian.Uint32(regionTable[8:]))
+	for i := 0; i < entryCount && 16+i*32+32 <= len(regionTable); i++ {
+		entry := regionTable[16+i*32:]
+		offset := int64(binary.LittleEndian.Uint64(entry[16:]))
+		length := int64(binary.LittleEndian.Uint32(entry[24:]))
+		required := binary.LittleEndian.Uint32(entry[28:])
+		switch formatGUID(entry[:16]) {
+		case vhdxBATRegionGUID:
+			batOffset, batLength = offset, length
+		case vhdxMetadataRegionGUID:
+			metadataOffset, metadataLength = offset, length
+		default:
+			if required != 0 {
+				return nil, fmt.Errorf("unknown required region %s", formatGUID(entry[:16]))
+			}
+		}
+	}
+	if batLength == 0 || metadataLength == 0 {
+		return nil, errors.New("BAT or metadata region missing")
+	}
+
+	metadata := make([]byte, metadataLength)
+	if err := readFull(file, metadata, metadataOffset); err != nil {
+		return nil, fmt.Errorf("failed to read metadata region: %w", err)
+	}
+	if string(metadata[:8]) != "metadata" {
+		return nil, errors.New("invalid metadata region")
+	}
+	items := make(map[string][]byte)
+	metadataCount := int(binary.LittleEndian.Uint16(metadata[10:]))
+	for i := 0; i < metadataCount && 32+i*32+32 <= len(metadata); i++ {
+		entry := metadata[32+i*32:]
+		offset := int64(binary.LittleEndian.Uint32(entry[16:]))
+		length := int64(binary.LittleEndian.Uint32(entry[20:]))
+		if offset+length > metadataLength {
+			return nil, errors.New("metadata item out of bounds")
+		}
+		items[formatGUID(entry[:16])] = metadata[offset : offset+length]
+	}
+
+	fileParameters := items[vhdxFileParametersGUID]
+	virtualDiskSize := items[vhdxVirtualDiskSizeGUID]
+	logicalSectorSize := items[vhdxLogicalSectorSizeGUID]
+	if len(fileParameters) < 8 || len(virtualDiskSize) < 8 || len(logicalSectorSize) < 4 {
+		return nil, errors.New("required metadata items missing")
+	}
+
+	image := &vhdxImage{
+		file:              file,
+		size:              int64(binary.LittleEndian.Uint64(virtualDiskSize)),
+		blockSize:         int64(binary.LittleEndian.Uint32(fileParameters)),
+		logicalSectorSize: int64(binary.LittleEndian.Uint32(logicalSectorSize)),
+	}
+	if image.blockSize == 0 || image.logicalSectorSize == 0 {
+		return nil, errors.New("invalid block or sector size")
+	}
+	image.chunkRatio = (1 << 23) * image.logicalSectorSize / image.blockSize
+
+	batRaw := make([]byte, batLength)
+	if err := readFull(file, batRaw, batOffset); err != nil {
+		return nil, fmt.Errorf("failed to read BAT: %w", err)
+	}
+	image.bat = make([]uint64, batLength/8)
+	for i := range image.bat {
+		image.bat[i] = binary.LittleEndian.Uint64(batRaw[i*8:])
+	}
+
+	if binary.LittleEndian.Uint32(fileParameters[4:])&vhdxHasParentFlag != 0 {
+		parentPath, err := vhdxParentPath(items[vhdxParentLocatorGUID])
+		if err != nil {
+			return nil, err
+		}
+		image.parent, err = openBackingImage(imagePath, parentPath, depth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return image, nil
+}
+
+// vhdxParentPath extracts the parent path from the parent locator metadata item
+func vhdxParentPath(locator []byte) (string, error) {
+	if len(locator) < 20 {
+		return "", errors.New("differencing disk has no parent locator")
+	}
+	decode := func(offset, length uint32) string {
+		if int(offset)+int(length) > len(locator) {
+			return ""
+		}
+		raw := locator[offset : offset+length]
+		units := make([]uint16, len(raw)/2)
+		for i := range units {
+			units[i] = binary.LittleEndian.Uint16(raw[i*2:])
+		}
+		return string(utf16.Decode(units))
+	}
+
+	entries := make(map[string]string)
+	count := int(binary.LittleEndian.Uint16(locator[18:]))
+	for i := 0; i < count && 20+i*12+12 <= len(locator); i++ {
+		entry := locator[20+i*12:]
+		key := decode(binary.LittleEndian.Uint32(entry[0:]), uint32(binary.LittleEndian.Uint16(entry[8:])))
+		value := decode(binary.LittleEndian.Uint32(entry[4:]), uint32(binary.LittleEndian.Uint16(entry[10:])))
+		entries[key] = value
+	}
+
+	for _, key := range []string{"relative_path", "absolute_win32_path", "volume_path"} {
+		if path := entries[key]; path != "" {
+			return strings.TrimPrefix(path, ".\\"), nil
+		}
+	}
+	return "", errors.New("parent locator has no usable path")
+}
+
+func (v *vhdxImage) Size() int64 {
+	return v.size
+}
+
+func (v *vhdxImage) Close() error {
+	if v.parent != nil {
+		_ = v.parent.Close()
+	}
+	return v.file.Close()
+}
+
+func (v *vhdxImage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	total := len(p)
+	if off+int64(total) > v.size {
+		total = int(v.size - off)
+	}
+
+	read := 0
+	for read < total {
+		pos := off + int64(read)
+		inBlock := pos % v.blockSize
+		chunk := int(min(v.blockSize-inBlock, int64(total-read)))
+		if err := v.readBlock(p[read:read+chunk], pos, inBlock); err != nil {
+			return read, err
+		}
+		read += chunk
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (v *vhdxImage) batEntry(index int64) uint64 {
+	if index >= int64(len(v.bat)) {
+		return 0
+	}
+	return v.bat[index]
+}
+
+func (v *vhdxImage) readBlock(p []byte, pos int64, inBlock int64) error {
+	block := pos / v.blockSize
+	entry := v.batEntry(block + block/v.chunkRatio)
+	state := entry & 0x7
+	fileOffset := int64(entry>>20) * 1024 * 1024
+
+	switch state {
+	case vhdxBlockFullyPresent:
+		return readFull(v.file, p, fileOffset+inBlock)
+	case vhdxBlockPartiallyPresent:
+		if v.parent == nil {
+			return errors.New("partially present block in a disk without parent")
+		}
+	case vhdxBlockNotPresent:
+		if v.parent != nil {
+			return readBacking(v.parent, p, pos)
+		}
+		clear(p)
+		return nil
+	default:
+		// zero, unmapped and undefined blocks read as zeros
+		clear(p)
+		return nil
+	}
+
+	// partially present blocks have a sector bitmap describing which sectors are in this file
+	chunk := block / v.chunkRatio
+	bitmapEntry := v.batEntry(chunk*(v.chunkRatio+1) + v.chunkRatio)
+	if bitmapEntry&0x7 != vhdxBitmapPresent {
+		return errors.New("sector bitmap missing for partially present block")
+	}
+	bitmapOffset := int64(bitmapEntry>>20) * 1024 * 1024
+	// sector index relative to the start of the chunk
+	firstSector := (pos - chunk*v.chunkRatio*v.blockSize) / v.logicalSectorSize
+	lastSector := (pos + int64(len(p)) - 1 - chunk*v.chunkRatio*v.blockSize) / v.logicalSectorSize
+	bitmap := make([]byte, lastSector/8-firstSector/8+1)
+	if err := readFull(v.file, bitmap, bitmapOffset+firstSector/8); err != nil {
+		return fmt.Errorf("failed to read sector bitmap: %w", err)
+	}
+
+	for done := 0; done < len(p); {
+		current := pos + int64(done)
+		sector := (current-chunk*v.chunkRatio*v.blockSize)/v.logicalSectorSize - firstSector/8*8
+		n := int(min(v.logicalSectorSize-current%v.logicalSectorSize, int64(len(p)-done)))
+		var err error
+		if bitmap[sector/8]&(1<<(sector%8)) != 0 {
+			err = readFull(v.file, p[done:done+n], fileOffset+inBlock+int64(done))
+		} else {
+			err = readBacking(v.parent, p[done:done+n], current)
+		}
+		if err != nil {
+			return err
+		}
+		done += n
+	}
+	return nil
+}
@@ -0,0 +1,417 @@
+package kvm
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// VMDK specification: https://www.vmware.com/app/vmdk/?src=vmdk
+
+const (
+	vmdkFlagZeroGrainGTE     = 1 << 2
+	vmdkFlagCompressedGrains = 1 << 16
+	vmdkGDAtEnd              = 0xffffffffffffffff
+	vmdkMaxDescriptorSize    = 64 * 1024
+	vmdkNoParentCID          = "ffffffff"
+
+	// number of grain tables kept in memory
+	vmdkGTCacheSize = 64
+)
+
+type vmdkExtentType string
+
+const (
+	vmdkExtentFlat   vmdkExtentType = "FLAT"
+	vmdkExtentSparse vmdkExtentType = "SPARSE"
+	vmdkExtentZero   vmdkExtentType = "ZERO"
+)
+
+type vmdkExtent struct {
+	kind vmdkExtentType
+	// start is the offset of the extent within the virtual disk
+	start int64
+	size  int64
+	// flat extents map to file at fileOffset, sparse ones are read through sparse
+	file       *os.File
+	fileOffset int64
+	sparse     *vmdkSparseExtent
+}
+
+type vmdkImage struct {
+	extents []*vmdkExtent
+	parent  diskImage
+	size    int64
+}
+
+type vmdkSparseExtent struct {
+	file        *os.File
+	flags       uint32
+	capacity    int64
+	grainSize   int64
+	gtEntries   int64
+	gdOffset    int64
+	descriptor  string
+	gtCacheLock sync.Mutex
+	gtCache     map[uint32][]uint32
+}
+
+func openVMDKImage(file *os.File, imagePath string, depth int) (diskImage, error) {
+	image := &vmdkImage{}
+	var descriptor string
+
+	magic := make([]byte, 4)
+	if err := readFull(file, magic, 0); err != nil {
+		return nil, err
+	}
+	if string(magic) == "KDMV" {
+		// monolithic sparse disks hold their descriptor and a single extent
+		sparse, err := openVMDKSparseExtent(file)
+		if err != nil {
+			return nil, err
+		}
+		descriptor = sparse.descriptor
+		image.extents = []*vmdkExtent{{
+			kind:   vmdkExtentSparse,
+			size:   sparse.capacity * 512,
+			file:   file,
+			sparse: sparse,
+		}}
+	} else {
+		raw := make([]byte, vmdkMaxDescriptorSize)
+		n, err := file.ReadAt(raw, 0)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read descriptor: %w", err)
+		}
+		descriptor = string(raw[:n])
+		image.extents, err = openVMDKExtents(descriptor, imagePath)
+		if err != nil {
+			image.Close()
+			return nil, err
+		}
+		// the descriptor itself isn't used once the extents are open
+		file.Close()
+	}
+
+	for _, extent := range image.extents {
+		extent.start = image.size
+		image.size += extent.size
+	}
+
+	parentCID, parentHint := vmdkDescriptorParent(descriptor)
+	if parentCID != "" && parentCID != vmdkNoParentCID {
+		if parentHint == "" {
+			image.Close()
+			return nil, errors.New("delta disk has no parentFileNameHint")
+		}
+		var err error
+		image.parent, err = openBackingImage(imagePath, parentHint, depth)
+		if err != nil {
+			image.Close()
+			return nil, err
+		}
+	}
+
+	return image, nil
+}
+
+func vmdkDescriptorParent(descriptor string) (parentCID string, parentHint string) {
+	scanner := bufio.NewScanner(strings.NewReader(descriptor))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), "\"")
+		switch strings.TrimSpace(key) {
+		case "parentCID":
+			parentCID = strings.ToLower(value)
+		case "parentFileNameHint":
+			parentHint = value
+		}
+	}
+	return parentCID, parentHint
+}
+
+// openVMDKExtents opens the extents listed in a text descriptor, e.g.
+// RW 4192256 SPARSE "disk-s001.vmdk"
+// RW 8388608 FLAT "disk-flat.vmdk" 0
+func openVMDKExtents(descriptor string, imagePath string) ([]*vmdkExtent, error) {
+	var extents []*vmdkExtent
+	scanner := bufio.NewScanner(strings.NewReader(descriptor))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "RW ") && !strings.HasPrefix(line, "RDONLY ") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return extents, fmt.Errorf("invalid extent line: %s", line)
+		}
+		sectors, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return extents, fmt.Errorf("invalid extent size: %s", line)
+		}
+		extent := &vmdkExtent{size: sectors * 512}
+
+		var filename string
+		if len(fields) > 3 {
+			// the file name is quoted and may contain spaces
+			start := strings.Index(line, "\"")
+			end := strings.LastIndex(line, "\"")
+			if start < 0 || end <= start {
+				return extents, fmt.Errorf("invalid extent file name: %s", line)
+			}
+			filename = line[start+1 : end]
+			if rest := strings.Fields(line[end+1:]); len(rest) > 0 {
+				offset, err := strconv.ParseInt(rest[0], 10, 64)
+				if err != nil {
+					return extents, fmt.Errorf("invalid extent offset: %s", line)
+				}
+				extent.fileOffset = offset * 512
+			}
+		}
+
+		switch fields[2] {
+		case "ZERO":
+			extent.kind = vmdkExtentZero
+			extents = append(extents, extent)
+			continue
+		case "FLAT", "VMFS":
+			extent.kind = vmdkExtentFlat
+		case "SPARSE":
+			extent.kind = vmdkExtentSparse
+		default:
+			return extents, fmt.Errorf("unsupported extent type %s", fields[2])
+		}
+
+		extentPath, err := resolveBackingFile(imagePath, filename)
+		if err != nil {
+			return extents, err
+		}
+		extent.file, err = os.Open(extentPath)
+		if err != nil {
+			return extents, fmt.Errorf("failed to open extent: %w", err)
+		}
+		extents = append(extents, extent)
+		if extent.kind == vmdkExtentSparse {
+			extent.sparse, err = openVMDKSparseExtent(extent.file)
+			if err != nil {
+				return extents, err
+			}
+		}
+	}
+	if len(extents) == 0 {
+		return nil, errors.New("descriptor has no extents")
+	}
+	return extents, nil
+}
+
+func openVMDKSparseExtent(file *os.File) (*vmdkSparseExtent, error) {
+	header := make([]byte, 512)
+	if err := readFull(file, header, 0); err != nil {
+		return nil, fmt.Errorf("failed to read sparse header: %w", err)
+	}
+
+	gdOffset := binary.LittleEndian.Uint64(header[56:])
+	if gdOffset == vmdkGDAtEnd {
+		// stream optimized disks write the final header as a footer
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if err := readFull(file, header, info.Size()-1024); err != nil {
+			return nil, fmt.Errorf("failed to read footer: %w", err)
+		}
+		if string(header[:4]) != "KDMV" {
+			return nil, errors.New("invalid footer")
+		}
+		gdOffset = binary.LittleEndian.Uint64(header[56:])
+	}
+
+	extent := &vmdkSparseExtent{
+		file:      file,
+		flags:     binary.LittleEndian.Uint32(header[8:]),
+		capacity:  int64(binary.LittleEndian.Uint64(header[12:])),
+		grainSize: int64(binary.LittleEndian.Uint64(header[20:])),
+		gtEntries: int64(binary.LittleEndian.Uint32(header[44:])),
+		gdOffset:  int64(gdOffset) * 512,
+		gtCache:   make(map[uint32][]uint32),
+	}
+	if extent.grainSize == 0 || extent.gtEntries == 0 {
+		return nil, errors.New("invalid sparse header")
+	}
+	if extent.flags&vmdkFlagCompressedGrains != 0 && binary.LittleEndian.Uint16(header[77:]) != 1 {
+		return nil, errors.New("unsupported grain compression")
+	}
+
+	descriptorOffset := int64(binary.LittleEndian.Uint64(header[28:])) * 512
+	descriptorSize := int64(binary.LittleEndian.Uint64(header[36:])) * 512
+	if descriptorOffset != 0 && descriptorSize > 0 && descriptorSize <= vmdkMaxDescriptorSize {
+		raw := make([]byte, descriptorSize)
+		if err := readFull(file, raw, descriptorOffset); err == nil {
+			extent.descriptor = string(bytes.TrimRight(raw, "\x00"))
+		}
+	}
+	return extent, nil
+}
+
+func (v *vmdkImage) Size() int64 {
+	return v.size
+}
+
+func (v *vmdkImage) Close() error {
+	if v.parent != nil {
+		_ = v.parent.Close()
+	}
+	var err error
+	for _, extent := range v.extents {
+		if extent.file != nil {
+			if closeErr := extent.file.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+func (v *vmdkImage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	total := len(p)
+	if off+int64(total) > v.size {
+		total = int(v.size - off)
+	}
+
+	read := 0
+	for _, extent := range v.extents {
+		if read == total {
+			break
+		}
+		pos := off + int64(read)
+		if pos >= extent.start+extent.size {
+			continue
+		}
+		chunk := int(min(extent.start+extent.size-pos, int64(total-read)))
+		if err := v.readExtent(extent, p[read:read+chunk], pos); err != nil {
+			return read, err
+		}
+		read += chunk
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (v *vmdkImage) readExtent(extent *vmdkExtent, p []byte, pos int64) error {
+	inExtent := pos - extent.start
+	switch extent.kind {
+	case vmdkExtentFlat:
+		return readFull(extent.file, p, extent.fileOffset+inExtent)
+	case vmdkExtentZero:
+		clear(p)
+		return nil
+	}
+
+	grainBytes := extent.sparse.grainSize * 512
+	for done := 0; done < len(p); {
+		current := inExtent + int64(done)
+		inGrain := current % grainBytes
+		chunk := int(min(grainBytes-inGrain, int64(len(p)-done)))
+		if err := v.readGrain(extent.sparse, p[done:done+chunk], current, inGrain, pos+int64(done)); err != nil {
+			return err
+		}
+		done += chunk
+	}
+	return nil
+}
+
+func (v *vmdkImage) readGrain(sparse *vmdkSparseExtent, p []byte, inExtent int64, inGrain int64, pos int64) error {
+	grainSector, err := sparse.grainEntry(inExtent / (sparse.grainSize * 512))
+	if err != nil {
+		return err
+	}
+	switch {
+	case grainSector == 0:
+		return readBacking(v.parent, p, pos)
+	case grainSector == 1 && sparse.flags&vmdkFlagZeroGrainGTE != 0:
+		clear(p)
+		return nil
+	case sparse.flags&vmdkFlagCompressedGrains != 0:
+		data, err := sparse.readCompressedGrain(grainSector)
+		if err != nil {
+			return err
+		}
+		copy(p, data[inGrain:])
+		return nil
+	default:
+		return readFull(sparse.file, p, int64(grainSector)*512+inGrain)
+	}
+}
+
+func (s *vmdkSparseExtent) grainEntry(grain int64) (uint32, error) {
+	gdIndex := grain / s.gtEntries
+	gtIndex := grain % s.gtEntries
+
+	entry := make([]byte, 4)
+	if err := readFull(s.file, entry, s.gdOffset+gdIndex*4); err != nil {
+		return 0, fmt.Errorf("failed to read grain directory: %w", err)
+	}
+	gtSector := binary.LittleEndian.Uint32(entry)
+	if gtSector == 0 {
+		return 0, nil
+	}
+
+	s.gtCacheLock.Lock()
+	defer s.gtCacheLock.Unlock()
+	table, ok := s.gtCache[gtSector]
+	if !ok {
+		raw := make([]byte, s.gtEntries*4)
+		if err := readFull(s.file, raw, int64(gtSector)*512); err != nil {
+			return 0, fmt.Errorf("failed to read grain table: %w", err)
+		}
+		table = make([]uint32, s.gtEntries)
+		for i := range table {
+			table[i] = binary.LittleEndian.Uint32(raw[i*4:])
+		}
+		if len(s.gtCache) >= vmdkGTCacheSize {
+			clear(s.gtCache)
+		}
+		s.gtCache[gtSector] = table
+	}
+	return table[gtIndex], nil
+}
+
+func (s *vmdkSparseExtent) readCompressedGrain(grainSector uint32) ([]byte, error) {
+	// compressed grains start with the grain LBA and the compressed size
+	marker := make([]byte, 12)
+	if err := readFull(s.file, marker, int64(grainSector)*512); err != nil {
+		return nil, fmt.Errorf("failed to read grain marker: %w", err)
+	}
+	compressedSize := binary.LittleEndian.Uint32(marker[8:])
+	compressed := make([]byte, compressedSize)
+	if err := readFull(s.file, compressed, int64(grainSector)*512+12); err != nil {
+		return nil, fmt.Errorf("failed to read compressed grain: %w", err)
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress grain: %w", err)
+	}
+	defer reader.Close()
+	data := make([]byte, s.grainSize*512)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, fmt.Errorf("failed to decompress grain: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,226 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The display is normally drawn by jetkvm_native. When it is not running the
+// framebuffer is written directly, with a built-in 5x7 font, so the device
+// can still say what is wrong.
+
+const (
+	framebufferDevice = "/dev/fb0"
+	framebufferSysfs  = "/sys/class/graphics/fb0"
+	fontWidth         = 5
+	fontHeight        = 7
+	fontScale         = 2
+)
+
+var font5x7 = map[rune][fontHeight]uint8{
+	'A': {0x0e, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'B': {0x1e, 0x11, 0x11, 0x1e, 0x11, 0x11, 0x1e},
+	'C': {0x0e, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0e},
+	'D': {0x1e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x1e},
+	'E': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x1f},
+	'F': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x10},
+	'G': {0x0e, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0f},
+	'H': {0x11, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'I': {0x0e, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'J': {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0c},
+	'K': {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	'L': {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1f},
+	'M': {0x11, 0x1b, 0x15, 0x15, 0x11, 0x11, 0x11},
+	'N': {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11},
+	'O': {0x0e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'P': {0x1e, 0x11, 0x11, 0x1e, 0x10, 0x10, 0x10},
+	'Q': {0x0e, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0d},
+	'R': {0x1e, 0x11, 0x11, 0x1e, 0x14, 0x12, 0x11},
+	'S': {0x0f, 0x10, 0x10, 0x0e, 0x01, 0x01, 0x1e},
+	'T': {0x1f, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04},
+	'U': {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'V': {0x11, 0x11, 0x11, 0x11, 0x11, 0x0a, 0x04},
+	'W': {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0a},
+	'X': {0x11, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x11},
+	'Y': {0x11, 0x11, 0x11, 0x0a, 0x04, 0x04, 0x04},
+	'Z': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1f},
+	'0': {0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e},
+	'1': {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'2': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f},
+	'3': {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e},
+	'4': {0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02},
+	'5': {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e},
+	'6': {0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e},
+	'7': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e},
+	'9': {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x0c},
+	',': {0x00, 0x00, 0x00, 0x00, 0x0c, 0x04, 0x08},
+	':': {0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x0c, 0x00},
+	'-': {0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00},
+	'/': {0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00},
+	'!': {0x04, 0x04, 0x04, 0x04, 0x04, 0x00, 0x04},
+	'(': {0x02, 0x04, 0x08, 0x08, 0x08, 0x04, 0x02},
+	')': {0x08, 0x04, 0x02, 0x02, 0x02, 0x04, 0x08},
+}
+
+type rgb struct{ r, g, b uint8 }
+
+type framebuffer struct {
+	width, height int
+	stride        int
+	bpp           int
+	pixels        []byte
+}
+
+func readSysfsInts(name string) ([]int, error) {
+	data, err := os.ReadFile(framebufferSysfs + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	var values []int
+	for _, field := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		value, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func openFramebuffer() (*framebuffer, error) {
+	size, err := readSysfsInts("virtual_size")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read framebuffer size: %w", err)
+	}
+	if len(size) != 2 {
+		return nil, fmt.Errorf("invalid framebuffer size: %v", size)
+	}
+	bpp, err := readSysfsInts("bits_per_pixel")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read framebuffer depth: %w", err)
+	}
+	if bpp[0] != 16 && bpp[0] != 32 {
+		return nil, fmt.Errorf("unsupported framebuffer depth: %d", bpp[0])
+	}
+	fb := &framebuffer{width: size[0], height: size[1], bpp: bpp[0], stride: size[0] * bpp[0] / 8}
+	if stride, err := readSysfsInts("stride"); err == nil && stride[0] > 0 {
+		fb.stride = stride[0]
+	}
+	fb.pixels = make([]byte, fb.stride*fb.height)
+	return fb, nil
+}
+
+func (fb *framebuffer) set(x, y int, c rgb) {
+	if x < 0 || y < 0 || x >= fb.width || y >= fb.height {
+		return
+	}
+	if fb.bpp == 16 {
+		// RGB565
+		v := uint16(c.r>>3)<<11 | uint16(c.g>>2)<<5 | uint16(c.b>>3)
+		binary.LittleEndian.PutUint16(fb.pixels[y*fb.stride+x*2:], v)
+		return
+	}
+	offset := y*fb.stride + x*4
+	fb.pixels[offset], fb.pixels[offset+1], fb.pixels[offset+2], fb.pixels[offset+3] = c.b, c.g, c.r, 0xff
+}
+
+func (fb *framebuffer) fill(c rgb) {
+	for y := 0; y < fb.height; y++ {
+		for x := 0; x < fb.width; x++ {
+			fb.set(x, y, c)
+		}
+	}
+}
+
+// drawText draws one line, characters without a glyph are left blank
+func (fb *framebuffer) drawText(x, y int, text string, c rgb) {
+	for _, ch := range strings.ToUpper(text) {
+		glyph := font5x7[ch]
+		for row := 0; row < fontHeight; row++ {
+			for col := 0; col < fontWidth; col++ {
+				if glyph[row]&(0x10>>col) == 0 {
+					continue
+				}
+				for dy := 0; dy < fontScale; dy++ {
+					for dx := 0; dx < fontScale; dx++ {
+						fb.set(x+col*fontScale+dx, y+row*fontScale+dy, c)
+					}
+				}
+			}
+		}
+		x += (fontWidth + 1) * fontScale
+	}
+}
+
+// wrapText splits text into lines of at most width characters
+func wrapText(text string, width int) []string {
+	width = max(width, 1)
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		for len(word) > width {
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			lines = append(lines, word[:width])
+			word = word[width:]
+		}
+		if line == "" {
+			line = word
+		} else if len(line)+1+len(word) <= width {
+			line += " " + word
+		} else {
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// showFailureScreen draws a title and a message straight to the framebuffer
+func showFailureScreen(title string, message string) error {
+	fb, err := openFramebuffer()
+	if err != nil {
+		return err
+	}
+	const margin = 10
+	charWidth := (fontWidth + 1) * fontScale
+	lineHeight := (fontHeight + 3) * fontScale
+	columns := (fb.width - 2*margin) / charWidth
+
+	fb.fill(rgb{0x20, 0x00, 0x00})
+	y := margin
+	for _, line := range wrapText(title, columns) {
+		fb.drawText(margin, y, line, rgb{0xff, 0x50, 0x50})
+		y += lineHeight
+	}
+	y += lineHeight / 2
+	for _, line := range wrapText(message, columns) {
+		if y+lineHeight > fb.height {
+			break
+		}
+		fb.drawText(margin, y, line, rgb{0xff, 0xff, 0xff})
+		y += lineHeight
+	}
+
+	device, err := os.OpenFile(framebufferDevice, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open framebuffer: %w", err)
+	}
+	defer device.Close()
+	if _, err := device.WriteAt(fb.pixels, 0); err != nil {
+		return fmt.Errorf("failed to write framebuffer: %w", err)
+	}
+	// the backlight may have been dimmed or turned off by the dim timers
+	_ = setDisplayBrightness(config.DisplayMaxBrightness)
+	return nil
+}
@@ -0,0 +1,720 @@
+package kvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// EDID 1.3/1.4 (VESA E-EDID) decoding and encoding. The EDID is what the
+// HDMI input presents to the host, some BIOSes and GPUs refuse to output or
+// pick odd modes unless it looks like a particular kind of monitor.
+
+const (
+	edidBlockSize = 128
+	// defaultEDID is presented when no EDID has been set
+	defaultEDID = "00ffffffffffff0052620188008888881c150103800000780a0dc9a05747982712484c00000001010101010101010101010101010101023a801871382d40582c4500c48e2100001e011d007251d01e206e285500c48e2100001e000000fc00543734392d6648443732300a20000000fd00147801ff1d000a202020202020017b"
+)
+
+var edidHeader = []byte{0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00}
+
+// EDIDTiming is a video mode, with the blanking intervals when it comes
+// from a detailed timing descriptor
+type EDIDTiming struct {
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+	RefreshRate   float64 `json:"refreshRate"`
+	Interlaced    bool    `json:"interlaced,omitempty"`
+	PixelClockKHz int     `json:"pixelClockKHz,omitempty"`
+	HFrontPorch   int     `json:"hFrontPorch,omitempty"`
+	HSyncWidth    int     `json:"hSyncWidth,omitempty"`
+	HBackPorch    int     `json:"hBackPorch,omitempty"`
+	VFrontPorch   int     `json:"vFrontPorch,omitempty"`
+	VSyncWidth    int     `json:"vSyncWidth,omitempty"`
+	VBackPorch    int     `json:"vBackPorch,omitempty"`
+	HSyncPositive bool    `json:"hSyncPositive,omitempty"`
+	VSyncPositive bool    `json:"vSyncPositive,omitempty"`
+	// Source is established, standard, detailed or cea
+	Source string `json:"source"`
+}
+
+func (t EDIDTiming) String() string {
+	scan := "p"
+	if t.Interlaced {
+		scan = "i"
+	}
+	return fmt.Sprintf("%dx%d%s@%.2f", t.Width, t.Height, scan, t.RefreshRate)
+}
+
+type EDIDRangeLimits struct {
+	MinVRateHz       int `json:"minVRateHz"`
+	MaxVRateHz       int `json:"maxVRateHz"`
+	MinHRateKHz      int `json:"minHRateKHz"`
+	MaxHRateKHz      int `json:"maxHRateKHz"`
+	MaxPixelClockMHz int `json:"maxPixelClockMHz"`
+}
+
+type EDIDInfo struct {
+	Manufacturer  string           `json:"manufacturer"`
+	ProductCode   uint16           `json:"productCode"`
+	SerialNumber  uint32           `json:"serialNumber"`
+	Week          int              `json:"week"`
+	Year          int              `json:"year"`
+	Version       string           `json:"version"`
+	Digital       bool             `json:"digital"`
+	WidthCM       int              `json:"widthCm"`
+	HeightCM      int              `json:"heightCm"`
+	MonitorName   string           `json:"monitorName,omitempty"`
+	MonitorSerial string           `json:"monitorSerial,omitempty"`
+	PreferredMode *EDIDTiming      `json:"preferredMode,omitempty"`
+	Timings       []EDIDTiming     `json:"timings"`
+	RangeLimits   *EDIDRangeLimits `json:"rangeLimits,omitempty"`
+	Extensions    int              `json:"extensions"`
+	ChecksumValid bool             `json:"checksumValid"`
+	// Problems lists what a strict sink or source may reject
+	Problems []string `json:"problems,omitempty"`
+}
+
+// established timings, byte 35 bit 7 first
+var edidEstablishedTimings = []EDIDTiming{
+	{Width: 720, Height: 400, RefreshRate: 70},
+	{Width: 720, Height: 400, RefreshRate: 88},
+	{Width: 640, Height: 480, RefreshRate: 60},
+	{Width: 640, Height: 480, RefreshRate: 67},
+	{Width: 640, Height: 480, RefreshRate: 72},
+	{Width: 640, Height: 480, RefreshRate: 75},
+	{Width: 800, Height: 600, RefreshRate: 56},
+	{Width: 800, Height: 600, RefreshRate: 60},
+	{Width: 800, Height: 600, RefreshRate: 72},
+	{Width: 800, Height: 600, RefreshRate: 75},
+	{Width: 832, Height: 624, RefreshRate: 75},
+	{Width: 1024, Height: 768, RefreshRate: 87, Interlaced: true},
+	{Width: 1024, Height: 768, RefreshRate: 60},
+	{Width: 1024, Height: 768, RefreshRate: 70},
+	{Width: 1024, Height: 768, RefreshRate: 75},
+	{Width: 1280, Height: 1024, RefreshRate: 75},
+	{Width: 1152, Height: 870, RefreshRate: 75},
+}
+
+// cea861VICs holds the common CEA-861 video identification codes
+var cea861VICs = map[byte]EDIDTiming{
+	1:  {Width: 640, Height: 480, RefreshRate: 60},
+	2:  {Width: 720, Height: 480, RefreshRate: 60},
+	3:  {Width: 720, Height: 480, RefreshRate: 60},
+	4:  {Width: 1280, Height: 720, RefreshRate: 60},
+	5:  {Width: 1920, Height: 1080, RefreshRate: 60, Interlaced: true},
+	16: {Width: 1920, Height: 1080, RefreshRate: 60},
+	17: {Width: 720, Height: 576, RefreshRate: 50},
+	18: {Width: 720, Height: 576, RefreshRate: 50},
+	19: {Width: 1280, Height: 720, RefreshRate: 50},
+	20: {Width: 1920, Height: 1080, RefreshRate: 50, Interlaced: true},
+	31: {Width: 1920, Height: 1080, RefreshRate: 50},
+	32: {Width: 1920, Height: 1080, RefreshRate: 24},
+	33: {Width: 1920, Height: 1080, RefreshRate: 25},
+	34: {Width: 1920, Height: 1080, RefreshRate: 30},
+	93: {Width: 3840, Height: 2160, RefreshRate: 24},
+	94: {Width: 3840, Height: 2160, RefreshRate: 25},
+	95: {Width: 3840, Height: 2160, RefreshRate: 30},
+	96: {Width: 3840, Height: 2160, RefreshRate: 50},
+	97: {Width: 3840, Height: 2160, RefreshRate: 60},
+}
+
+// parseEDIDHex accepts hex with optional whitespace, as pasted from tools
+func parseEDIDHex(edid string) ([]byte, error) {
+	edid = strings.Join(strings.Fields(edid), "")
+	data, err := hex.DecodeString(edid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EDID hex: %w", err)
+	}
+	if len(data) == 0 || len(data)%edidBlockSize != 0 {
+		return nil, fmt.Errorf("EDID length must be a multiple of %d bytes, got %d", edidBlockSize, len(data))
+	}
+	if !bytes.Equal(data[:8], edidHeader) {
+		return nil, errors.New("EDID header is missing")
+	}
+	return data, nil
+}
+
+func edidBlockChecksumValid(block []byte) bool {
+	sum := byte(0)
+	for _, b := range block {
+		sum += b
+	}
+	return sum == 0
+}
+
+// repairEDIDChecksums fixes the last byte of each block, returning the
+// indexes of the blocks that were wrong
+func repairEDIDChecksums(data []byte) []int {
+	var repaired []int
+	for i := 0; i+edidBlockSize <= len(data); i += edidBlockSize {
+		block := data[i : i+edidBlockSize]
+		if edidBlockChecksumValid(block) {
+			continue
+		}
+		sum := byte(0)
+		for _, b := range block[:edidBlockSize-1] {
+			sum += b
+		}
+		block[edidBlockSize-1] = -sum
+		repaired = append(repaired, i/edidBlockSize)
+	}
+	return repaired
+}
+
+func decodeEDIDManufacturer(id uint16) string {
+	letters := []byte{byte(id>>10&0x1f) + '@', byte(id>>5&0x1f) + '@', byte(id&0x1f) + '@'}
+	return string(letters)
+}
+
+func encodeEDIDManufacturer(id string) (uint16, error) {
+	id = strings.ToUpper(id)
+	if len(id) != 3 {
+		return 0, errors.New("manufacturer ID must be three letters")
+	}
+	var value uint16
+	for i := 0; i < 3; i++ {
+		if id[i] < 'A' || id[i] > 'Z' {
+			return 0, errors.New("manufacturer ID must be three letters")
+		}
+		value = value<<5 | uint16(id[i]-'@')
+	}
+	return value, nil
+}
+
+// decodeDetailedTiming decodes an 18 byte detailed timing descriptor
+func decodeDetailedTiming(d []byte) EDIDTiming {
+	t := EDIDTiming{
+		PixelClockKHz: int(binary.LittleEndian.Uint16(d[0:2])) * 10,
+		Width:         int(d[2]) | int(d[4]&0xf0)<<4,
+		Height:        int(d[5]) | int(d[7]&0xf0)<<4,
+		HFrontPorch:   int(d[8]) | int(d[11]&0xc0)<<2,
+		HSyncWidth:    int(d[9]) | int(d[11]&0x30)<<4,
+		VFrontPorch:   int(d[10]>>4) | int(d[11]&0x0c)<<2,
+		VSyncWidth:    int(d[10]&0x0f) | int(d[11]&0x03)<<4,
+		Interlaced:    d[17]&0x80 != 0,
+		Source:        "detailed",
+	}
+	hBlank := int(d[3]) | int(d[4]&0x0f)<<8
+	vBlank := int(d[6]) | int(d[7]&0x0f)<<8
+	t.HBackPorch = hBlank - t.HFrontPorch - t.HSyncWidth
+	t.VBackPorch = vBlank - t.VFrontPorch - t.VSyncWidth
+	// digital separate sync carries the polarities in bits 2 and 1
+	if d[17]&0x18 == 0x18 {
+		t.VSyncPositive = d[17]&0x04 != 0
+		t.HSyncPositive = d[17]&0x02 != 0
+	}
+	hTotal, vTotal := t.Width+hBlank, t.Height+vBlank
+	if t.Interlaced {
+		// the descriptor holds field lines
+		t.Height *= 2
+		vTotal = vTotal*2 + 1
+	}
+	if hTotal > 0 && vTotal > 0 {
+		refresh := float64(t.PixelClockKHz) * 1000 / float64(hTotal*vTotal)
+		if t.Interlaced {
+			refresh *= 2
+		}
+		t.RefreshRate = float64(int(refresh*100+0.5)) / 100
+	}
+	return t
+}
+
+func encodeDetailedTiming(t EDIDTiming, widthMM int, heightMM int) []byte {
+	d := make([]byte, 18)
+	hBlank := t.HFrontPorch + t.HSyncWidth + t.HBackPorch
+	vBlank := t.VFrontPorch + t.VSyncWidth + t.VBackPorch
+	binary.LittleEndian.PutUint16(d[0:2], uint16(t.PixelClockKHz/10))
+	d[2] = byte(t.Width)
+	d[3] = byte(hBlank)
+	d[4] = byte(t.Width>>8)<<4 | byte(hBlank>>8)&0x0f
+	d[5] = byte(t.Height)
+	d[6] = byte(vBlank)
+	d[7] = byte(t.Height>>8)<<4 | byte(vBlank>>8)&0x0f
+	d[8] = byte(t.HFrontPorch)
+	d[9] = byte(t.HSyncWidth)
+	d[10] = byte(t.VFrontPorch&0x0f)<<4 | byte(t.VSyncWidth&0x0f)
+	d[11] = byte(t.HFrontPorch>>8)<<6 | byte(t.HSyncWidth>>8&0x03)<<4 |
+		byte(t.VFrontPorch>>4&0x03)<<2 | byte(t.VSyncWidth>>4&0x03)
+	d[12] = byte(widthMM)
+	d[13] = byte(heightMM)
+	d[14] = byte(widthMM>>8)<<4 | byte(heightMM>>8)&0x0f
+	d[17] = 0x18
+	if t.VSyncPositive {
+		d[17] |= 0x04
+	}
+	if t.HSyncPositive {
+		d[17] |= 0x02
+	}
+	return d
+}
+
+// decodeStandardTiming decodes a 2 byte standard timing, ok is false for
+// unused slots
+func decodeStandardTiming(b0 byte, b1 byte, version byte, revision byte) (EDIDTiming, bool) {
+	if b0 == 0x01 && b1 == 0x01 || b0 == 0 {
+		return EDIDTiming{}, false
+	}
+	width := (int(b0) + 31) * 8
+	var height int
+	switch b1 >> 6 {
+	case 0:
+		// 1:1 before EDID 1.3
+		height = width
+		if version > 1 || revision >= 3 {
+			height = width * 10 / 16
+		}
+	case 1:
+		height = width * 3 / 4
+	case 2:
+		height = width * 4 / 5
+	case 3:
+		height = width * 9 / 16
+	}
+	return EDIDTiming{Width: width, Height: height, RefreshRate: float64(b1&0x3f + 60), Source: "standard"}, true
+}
+
+func edidDescriptorText(d []byte) string {
+	text := d[5:18]
+	if i := bytes.IndexByte(text, 0x0a); i >= 0 {
+		text = text[:i]
+	}
+	return strings.TrimSpace(string(text))
+}
+
+func encodeEDIDDescriptorText(tag byte, text string) []byte {
+	d := []byte{0, 0, 0, tag, 0}
+	if len(text) > 13 {
+		text = text[:13]
+	}
+	d = append(d, text...)
+	if len(d) < 18 {
+		d = append(d, 0x0a)
+	}
+	for len(d) < 18 {
+		d = append(d, 0x20)
+	}
+	return d
+}
+
+// decodeCEAExtension adds the timings of a CEA-861 extension block
+func decodeCEAExtension(block []byte, info *EDIDInfo) {
+	dtdOffset := int(block[2])
+	if dtdOffset < 4 || dtdOffset > edidBlockSize-1 {
+		return
+	}
+	// the data block collection sits between byte 4 and the descriptors
+	for i := 4; i < dtdOffset; {
+		tag, length := block[i]>>5, int(block[i]&0x1f)
+		if i+1+length > dtdOffset {
+			info.Problems = append(info.Problems, "CEA data block runs past its collection")
+			break
+		}
+		if tag == 2 { // video data block
+			for _, svd := range block[i+1 : i+1+length] {
+				vic := svd
+				// 129 to 192 are VICs 1 to 64 flagged as native
+				if svd > 128 && svd <= 192 {
+					vic = svd & 0x7f
+				}
+				if timing, ok := cea861VICs[vic]; ok {
+					timing.Source = "cea"
+					info.Timings = append(info.Timings, timing)
+				}
+			}
+		}
+		i += 1 + length
+	}
+	for i := dtdOffset; i+18 <= edidBlockSize-1; i += 18 {
+		if block[i] == 0 && block[i+1] == 0 {
+			break
+		}
+		info.Timings = append(info.Timings, decodeDetailedTiming(block[i:i+18]))
+	}
+}
+
+// decodeEDID describes an EDID, problems that do not prevent decoding are
+// reported in Problems
+func decodeEDID(data []byte) (*EDIDInfo, error) {
+	if len(data) < edidBlockSize || !bytes.Equal(data[:8], edidHeader) {
+		return nil, errors.New("not an EDID")
+	}
+	base := data[:edidBlockSize]
+	info := &EDIDInfo{
+		Manufacturer:  decodeEDIDManufacturer(binary.BigEndian.Uint16(base[8:10])),
+		ProductCode:   binary.LittleEndian.Uint16(base[10:12]),
+		SerialNumber:  binary.LittleEndian.Uint32(base[12:16]),
+		Week:          int(base[16]),
+		Year:          int(base[17]) + 1990,
+		Version:       fmt.Sprintf("%d.%d", base[18], base[19]),
+		Digital:       base[20]&0x80 != 0,
+		WidthCM:       int(base[21]),
+		HeightCM:      int(base[22]),
+		Extensions:    int(base[126]),
+		ChecksumValid: true,
+		Timings:       []EDIDTiming{},
+	}
+	if base[18] != 1 || base[19] < 3 {
+		info.Problems = append(info.Problems, fmt.Sprintf("EDID version %s is older than 1.3", info.Version))
+	}
+
+	established := uint32(base[35])<<16 | uint32(base[36])<<8 | uint32(base[37])
+	for i, timing := range edidEstablishedTimings {
+		if established&(1<<(23-i)) != 0 {
+			timing.Source = "established"
+			info.Timings = append(info.Timings, timing)
+		}
+	}
+	for i := 38; i < 54; i += 2 {
+		if timing, ok := decodeStandardTiming(base[i], base[i+1], base[18], base[19]); ok {
+			info.Timings = append(info.Timings, timing)
+		}
+	}
+
+	for i := 54; i < 126; i += 18 {
+		d := base[i : i+18]
+		if d[0] != 0 || d[1] != 0 {
+			timing := decodeDetailedTiming(d)
+			info.Timings = append(info.Timings, timing)
+			// the first detailed timing is the preferred mode
+			if i == 54 {
+				preferred := timing
+				info.PreferredMode = &preferred
+			}
+			continue
+		}
+		switch d[3] {
+		case 0xfc:
+			info.MonitorName = edidDescriptorText(d)
+		case 0xff:
+			info.MonitorSerial = edidDescriptorText(d)
+		case 0xfd:
+			info.RangeLimits = &EDIDRangeLimits{
+				MinVRateHz:       int(d[5]),
+				MaxVRateHz:       int(d[6]),
+				MinHRateKHz:      int(d[7]),
+				MaxHRateKHz:      int(d[8]),
+				MaxPixelClockMHz: int(d[9]) * 10,
+			}
+		}
+	}
+	if info.PreferredMode == nil {
+		info.Problems = append(info.Problems, "no preferred detailed timing")
+	}
+
+	if len(data)%edidBlockSize != 0 {
+		info.Problems = append(info.Problems, fmt.Sprintf("length %d is not a multiple of %d bytes", len(data), edidBlockSize))
+	}
+	blocks := len(data) / edidBlockSize
+	if info.Extensions != blocks-1 {
+		info.Problems = append(info.Problems, fmt.Sprintf("extension count is %d but %d extension blocks follow", info.Extensions, blocks-1))
+	}
+	for i := 0; i < blocks; i++ {
+		block := data[i*edidBlockSize : (i+1)*edidBlockSize]
+		if !edidBlockChecksumValid(block) {
+			info.ChecksumValid = false
+			info.Problems = append(info.Problems, fmt.Sprintf("block %d has a bad checksum", i))
+		}
+		if i > 0 && block[0] == 0x02 {
+			decodeCEAExtension(block, info)
+		}
+	}
+	return info, nil
+}
+
+// EDIDSpec describes the monitor an EDID is built for. The first timing is
+// the preferred mode, at most four timings and descriptors fit the base block.
+type EDIDSpec struct {
+	Manufacturer string       `json:"manufacturer"`
+	ProductCode  uint16       `json:"productCode"`
+	SerialNumber uint32       `json:"serialNumber"`
+	Year         int          `json:"year"`
+	MonitorName  string       `json:"monitorName"`
+	WidthCM      int          `json:"widthCm"`
+	HeightCM     int          `json:"heightCm"`
+	Timings      []EDIDTiming `json:"timings"`
+	// EstablishedTimings are listed as WIDTHxHEIGHT@RATE, e.g. 1024x768@60
+	EstablishedTimings []string         `json:"establishedTimings"`
+	RangeLimits        *EDIDRangeLimits `json:"rangeLimits"`
+}
+
+// encodeEDID builds a digital EDID 1.3 base block
+func encodeEDID(spec EDIDSpec) ([]byte, error) {
+	descriptors := len(spec.Timings)
+	if spec.MonitorName != "" {
+		descriptors++
+	}
+	if spec.RangeLimits != nil {
+		descriptors++
+	}
+	if len(spec.Timings) == 0 {
+		return nil, errors.New("at least one detailed timing is required")
+	}
+	if descriptors > 4 {
+		return nil, errors.New("too many timings and descriptors for the base block")
+	}
+	manufacturer, err := encodeEDIDManufacturer(spec.Manufacturer)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Year < 1990 || spec.Year > 1990+255 {
+		return nil, fmt.Errorf("year %d is out of range", spec.Year)
+	}
+
+	data := make([]byte, edidBlockSize)
+	copy(data, edidHeader)
+	binary.BigEndian.PutUint16(data[8:10], manufacturer)
+	binary.LittleEndian.PutUint16(data[10:12], spec.ProductCode)
+	binary.LittleEndian.PutUint32(data[12:16], spec.SerialNumber)
+	data[16] = 0xff // the year is the model year
+	data[17] = byte(spec.Year - 1990)
+	data[18], data[19] = 1, 3
+	data[20] = 0x80 // digital input
+	data[21] = byte(spec.WidthCM)
+	data[22] = byte(spec.HeightCM)
+	data[23] = 0x78 // gamma 2.2
+	data[24] = 0x0a // RGB colour, preferred timing in the first descriptor
+	// sRGB chromaticity, as in the default EDID
+	copy(data[25:35], []byte{0x0d, 0xc9, 0xa0, 0x57, 0x47, 0x98, 0x27, 0x12, 0x48, 0x4c})
+
+	for _, name := range spec.EstablishedTimings {
+		found := false
+		for i, timing := range edidEstablishedTimings {
+			if strings.EqualFold(name, fmt.Sprintf("%dx%d@%.0f", timing.Width, timing.Height, timing.RefreshRate)) {
+				data[35+i/8] |= 0x80 >> (i % 8)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown established timing: %s", name)
+		}
+	}
+	for i := 38; i < 54; i++ {
+		data[i] = 0x01
+	}
+
+	offset := 54
+	for _, timing := range spec.Timings {
+		if timing.PixelClockKHz <= 0 || timing.PixelClockKHz/10 > 0xffff {
+			return nil, fmt.Errorf("pixel clock of %s is out of range", timing)
+		}
+		copy(data[offset:], encodeDetailedTiming(timing, spec.WidthCM*10, spec.HeightCM*10))
+		offset += 18
+	}
+	if spec.RangeLimits != nil {
+		r := spec.RangeLimits
+		d := []byte{0, 0, 0, 0xfd, 0,
+			byte(r.MinVRateHz), byte(r.MaxVRateHz), byte(r.MinHRateKHz), byte(r.MaxHRateKHz),
+			byte((r.MaxPixelClockMHz + 9) / 10), 0x00, 0x0a, 0x20, 0x20, 0x20, 0x20, 0x20, 0x20}
+		copy(data[offset:], d)
+		offset += 18
+	}
+	if spec.MonitorName != "" {
+		copy(data[offset:], encodeEDIDDescriptorText(0xfc, spec.MonitorName))
+		offset += 18
+	}
+	for ; offset < 126; offset += 18 {
+		// dummy descriptor
+		copy(data[offset:], []byte{0, 0, 0, 0x10})
+	}
+	repairEDIDChecksums(data)
+	return data, nil
+}
+
+type EDIDPreset struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	EDID        string `json:"edid"`
+}
+
+// Timings of the presets, from CEA-861 and VESA DMT/CVT
+var (
+	edidTiming1080p60 = EDIDTiming{Width: 1920, Height: 1080, RefreshRate: 60, PixelClockKHz: 148500,
+		HFrontPorch: 88, HSyncWidth: 44, HBackPorch: 148, VFrontPorch: 4, VSyncWidth: 5, VBackPorch: 36,
+		HSyncPositive: true, VSyncPositive: true}
+	edidTiming720p60 = EDIDTiming{Width: 1280, Height: 720, RefreshRate: 60, PixelClockKHz: 74250,
+		HFrontPorch: 110, HSyncWidth: 40, HBackPorch: 220, VFrontPorch: 5, VSyncWidth: 5, VBackPorch: 20,
+		HSyncPositive: true, VSyncPositive: true}
+	edidTiming1440p60 = EDIDTiming{Width: 2560, Height: 1440, RefreshRate: 60, PixelClockKHz: 241500,
+		HFrontPorch: 48, HSyncWidth: 32, HBackPorch: 80, VFrontPorch: 3, VSyncWidth: 5, VBackPorch: 33,
+		HSyncPositive: true}
+	edidTiming2160p30 = EDIDTiming{Width: 3840, Height: 2160, RefreshRate: 30, PixelClockKHz: 297000,
+		HFrontPorch: 176, HSyncWidth: 88, HBackPorch: 296, VFrontPorch: 8, VSyncWidth: 10, VBackPorch: 72,
+		HSyncPositive: true, VSyncPositive: true}
+	edidTiming1024x768 = EDIDTiming{Width: 1024, Height: 768, RefreshRate: 60, PixelClockKHz: 65000,
+		HFrontPorch: 24, HSyncWidth: 136, HBackPorch: 160, VFrontPorch: 3, VSyncWidth: 6, VBackPorch: 29}
+)
+
+var edidPresetSpecs = []struct {
+	id          string
+	name        string
+	description string
+	spec        EDIDSpec
+}{
+	{
+		id:          "1080p60",
+		name:        "1920x1080 60Hz",
+		description: "Full HD monitor, the best match for the capture resolution",
+		spec: EDIDSpec{Manufacturer: "JKV", ProductCode: 0x1080, Year: 2024, MonitorName: "JetKVM 1080p",
+			WidthCM: 53, HeightCM: 30, Timings: []EDIDTiming{edidTiming1080p60, edidTiming720p60},
+			EstablishedTimings: []string{"640x480@60", "800x600@60", "1024x768@60"},
+			RangeLimits:        &EDIDRangeLimits{MinVRateHz: 24, MaxVRateHz: 75, MinHRateKHz: 15, MaxHRateKHz: 85, MaxPixelClockMHz: 150}},
+	},
+	{
+		id:          "1440p",
+		name:        "2560x1440 60Hz",
+		description: "QHD monitor, the 241.5 MHz pixel clock of 1440p60 is above what the capture chip accepts, so hosts using that mode most likely show no signal. 1080p60 is listed as a fallback.",
+		spec: EDIDSpec{Manufacturer: "JKV", ProductCode: 0x1440, Year: 2024, MonitorName: "JetKVM 1440p",
+			WidthCM: 60, HeightCM: 34, Timings: []EDIDTiming{edidTiming1440p60, edidTiming1080p60},
+			EstablishedTimings: []string{"640x480@60", "800x600@60", "1024x768@60"},
+			RangeLimits:        &EDIDRangeLimits{MinVRateHz: 24, MaxVRateHz: 75, MinHRateKHz: 15, MaxHRateKHz: 95, MaxPixelClockMHz: 250}},
+	},
+	{
+		id:          "4k-downscale",
+		name:        "4K monitor, 1080p preferred",
+		description: "Looks like a 4K monitor to hosts that refuse to output otherwise, but prefers 1080p so the host scales down",
+		spec: EDIDSpec{Manufacturer: "JKV", ProductCode: 0x2160, Year: 2024, MonitorName: "JetKVM 4K",
+			WidthCM: 60, HeightCM: 34, Timings: []EDIDTiming{edidTiming1080p60, edidTiming2160p30},
+			RangeLimits: &EDIDRangeLimits{MinVRateHz: 24, MaxVRateHz: 60, MinHRateKHz: 15, MaxHRateKHz: 135, MaxPixelClockMHz: 300}},
+	},
+	{
+		id:          "legacy-1024x768",
+		name:        "1024x768 60Hz",
+		description: "Legacy 4:3 monitor for old BIOSes and operating systems",
+		spec: EDIDSpec{Manufacturer: "JKV", ProductCode: 0x0768, Year: 2024, MonitorName: "JetKVM XGA",
+			WidthCM: 32, HeightCM: 24, Timings: []EDIDTiming{edidTiming1024x768},
+			EstablishedTimings: []string{"640x480@60", "800x600@60", "1024x768@60"},
+			RangeLimits:        &EDIDRangeLimits{MinVRateHz: 50, MaxVRateHz: 75, MinHRateKHz: 30, MaxHRateKHz: 60, MaxPixelClockMHz: 80}},
+	},
+}
+
+func edidPresets() ([]EDIDPreset, error) {
+	presets := []EDIDPreset{{
+		ID:          "default",
+		Name:        "JetKVM Default",
+		Description: "The EDID used when none is set",
+		EDID:        defaultEDID,
+	}}
+	for _, preset := range edidPresetSpecs {
+		data, err := encodeEDID(preset.spec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build EDID preset %s: %w", preset.id, err)
+		}
+		presets = append(presets, EDIDPreset{
+			ID:          preset.id,
+			Name:        preset.name,
+			Description: preset.description,
+			EDID:        hex.EncodeToString(data),
+		})
+	}
+	return presets, nil
+}
+
+type SavedEDID struct {
+	Name string `json:"name"`
+	EDID string `json:"edid"`
+}
+
+// rpcGetEDIDInfo decodes edid, or the EDID currently presented when empty
+func rpcGetEDIDInfo(edid string) (*EDIDInfo, error) {
+	if edid == "" {
+		current, err := rpcGetEDID()
+		if err != nil {
+			return nil, err
+		}
+		edid = current
+	}
+	data, err := parseEDIDHex(edid)
+	if err != nil {
+		return nil, err
+	}
+	return decodeEDID(data)
+}
+
+func rpcGetEDIDPresets() ([]EDIDPreset, error) {
+	return edidPresets()
+}
+
+func rpcSetEDIDPreset(id string) error {
+	presets, err := edidPresets()
+	if err != nil {
+		return err
+	}
+	for _, preset := range presets {
+		if preset.ID == id {
+			return rpcSetEDID(preset.EDID)
+		}
+	}
+	return fmt.Errorf("unknown EDID preset: %s", id)
+}
+
+// rpcRepairEDID returns edid with its block checksums fixed
+func rpcRepairEDID(edid string) (string, error) {
+	data, err := parseEDIDHex(edid)
+	if err != nil {
+		return "", err
+	}
+	repairEDIDChecksums(data)
+	return hex.EncodeToString(data), nil
+}
+
+func rpcBuildEDID(spec EDIDSpec) (string, error) {
+	data, err := encodeEDID(spec)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
+
+func rpcGetSavedEDIDs() ([]SavedEDID, error) {
+	if config.SavedEDIDs == nil {
+		return []SavedEDID{}, nil
+	}
+	return config.SavedEDIDs, nil
+}
+
+// rpcSaveEDID stores edid under name, replacing an EDID of the same name
+func rpcSaveEDID(name string, edid string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return errors.New("name is required")
+	}
+	data, err := parseEDIDHex(edid)
+	if err != nil {
+		return err
+	}
+	repairEDIDChecksums(data)
+	saved := SavedEDID{Name: name, EDID: hex.EncodeToString(data)}
+
+	replaced := false
+	for i := range config.SavedEDIDs {
+		if config.SavedEDIDs[i].Name == name {
+			config.SavedEDIDs[i] = saved
+			replaced = true
+		}
+	}
+	if !replaced {
+		config.SavedEDIDs = append(config.SavedEDIDs, saved)
+	}
+	if err := SaveConfig(); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
+
+func rpcDeleteSavedEDID(name string) error {
+	for i, saved := range config.SavedEDIDs {
+		if saved.Name == name {
+			config.SavedEDIDs = append(config.SavedEDIDs[:i], config.SavedEDIDs[i+1:]...)
+			if err := SaveConfig(); err != nil {
+				return fmt.Errorf("failed to save config: %w", err)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no saved EDID named %s", name)
+}
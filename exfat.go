@@ -0,0 +1,215 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"unicode"
+	"unicode/utf16"
+)
+
+// exFAT layout follows the Microsoft exFAT file system specification:
+// https://learn.microsoft.com/en-us/windows/win32/fileio/exfat-specification
+
+const (
+	exfatBootRegionSectors = 12
+	// the FAT starts after the main and backup boot regions, aligned like mkfs.exfat does
+	exfatFATOffset = 2048
+
+	exfatEntryAllocationBitmap = 0x81
+	exfatEntryUpcaseTable      = 0x82
+	exfatEntryVolumeLabel      = 0x83
+	exfatMaxLabelLength        = 11
+)
+
+// exfatClusterSize returns the default cluster size (in sectors) used by
+// Windows for a volume of the given size (in sectors).
+func exfatClusterSize(sectors int64) int64 {
+	switch {
+	case sectors <= 256*1024*1024/sectorSize:
+		return 8 // 4KiB
+	case sectors <= 32*1024*1024*1024/sectorSize:
+		return 64 // 32KiB
+	default:
+		return 256 // 128KiB
+	}
+}
+
+func exfatChecksum(checksum uint32, b []byte) uint32 {
+	for _, c := range b {
+		checksum = (checksum<<31 | checksum>>1) + uint32(c)
+	}
+	return checksum
+}
+
+// exfatUpcaseTable builds a compressed up-case table, where runs of
+// characters mapping to themselves are stored as 0xffff followed by the run
+// length.
+func exfatUpcaseTable() []byte {
+	var table []uint16
+	identityRun := 0
+	flush := func() {
+		if identityRun > 0 {
+			table = append(table, 0xffff, uint16(identityRun))
+			identityRun = 0
+		}
+	}
+	for c := 0; c <= 0xffff; c++ {
+		upper := unicode.ToUpper(rune(c))
+		if upper == rune(c) || upper > 0xffff {
+			identityRun++
+			continue
+		}
+		flush()
+		table = append(table, uint16(upper))
+	}
+	flush()
+
+	raw := make([]byte, len(table)*2)
+	for i, v := range table {
+		binary.LittleEndian.PutUint16(raw[i*2:], v)
+	}
+	return raw
+}
+
+// formatExFAT writes an empty exFAT filesystem spanning sectors sectors to w,
+// which must be zero filled. partitionOffset is the partition start on disk.
+func formatExFAT(w io.WriterAt, partitionOffset int64, sectors int64, label string) error {
+	sectorsPerCluster := exfatClusterSize(sectors)
+	clusterSize := sectorsPerCluster * sectorSize
+
+	// the FAT needs 4 bytes per cluster plus the two reserved entries
+	estimatedClusters := (sectors - exfatFATOffset) / sectorsPerCluster
+	fatSectors := ((estimatedClusters+2)*4 + sectorSize - 1) / sectorSize
+	clusterHeapOffset := exfatFATOffset + fatSectors
+	clusterHeapOffset = (clusterHeapOffset + sectorsPerCluster - 1) / sectorsPerCluster * sectorsPerCluster
+	clusterCount := (sectors - clusterHeapOffset) / sectorsPerCluster
+	if clusterCount < 16 {
+		return errors.New("volume is too small for exFAT")
+	}
+	if clusterCount > 0xfffffff5 {
+		return errors.New("volume is too large for exFAT")
+	}
+
+	// the cluster heap starts with the allocation bitmap, then the up-case table and the root directory
+	bitmapSize := (clusterCount + 7) / 8
+	bitmapClusters := (bitmapSize + clusterSize - 1) / clusterSize
+	upcase := exfatUpcaseTable()
+	upcaseClusters := (int64(len(upcase)) + clusterSize - 1) / clusterSize
+	bitmapCluster := int64(2)
+	upcaseCluster := bitmapCluster + bitmapClusters
+	rootCluster := upcaseCluster + upcaseClusters
+	usedClusters := bitmapClusters + upcaseClusters + 1
+
+	shift := func(v int64) byte {
+		var s byte
+		for ; v > 1; v >>= 1 {
+			s++
+		}
+		return s
+	}
+
+	boot := make([]byte, exfatBootRegionSectors*sectorSize)
+	bootSector := boot[:sectorSize]
+	copy(bootSector[0:], []byte{0xeb, 0x76, 0x90})
+	copy(bootSector[3:], "EXFAT   ")
+	binary.LittleEndian.PutUint64(bootSector[64:], uint64(partitionOffset))
+	binary.LittleEndian.PutUint64(bootSector[72:], uint64(sectors))
+	binary.LittleEndian.PutUint32(bootSector[80:], exfatFATOffset)
+	binary.LittleEndian.PutUint32(bootSector[84:], uint32(fatSectors))
+	binary.LittleEndian.PutUint32(bootSector[88:], uint32(clusterHeapOffset))
+	binary.LittleEndian.PutUint32(bootSector[92:], uint32(clusterCount))
+	binary.LittleEndian.PutUint32(bootSector[96:], uint32(rootCluster))
+	binary.LittleEndian.PutUint32(bootSector[100:], fatVolumeSerial())
+	binary.LittleEndian.PutUint16(bootSector[104:], 0x0100)
+	bootSector[108] = shift(sectorSize)
+	bootSector[109] = shift(sectorsPerCluster)
+	bootSector[110] = 1 // number of FATs
+	bootSector[111] = 0x80
+	bootSector[112] = byte(usedClusters * 100 / clusterCount)
+	bootSector[510] = 0x55
+	bootSector[511] = 0xaa
+	// extended boot sectors only carry a signature
+	for i := 1; i <= 8; i++ {
+		binary.LittleEndian.PutUint32(boot[i*sectorSize+sectorSize-4:], 0xaa550000)
+	}
+
+	// VolumeFlags and PercentInUse are excluded from the boot region checksum
+	var checksum uint32
+	for i, c := range boot[:11*sectorSize] {
+		if i == 106 || i == 107 || i == 112 {
+			continue
+		}
+		checksum = exfatChecksum(checksum, []byte{c})
+	}
+	for i := 11 * sectorSize; i < len(boot); i += 4 {
+		binary.LittleEndian.PutUint32(boot[i:], checksum)
+	}
+
+	if _, err := w.WriteAt(boot, 0); err != nil {
+		return err
+	}
+	if _, err := w.WriteAt(boot, exfatBootRegionSectors*sectorSize); err != nil {
+		return err
+	}
+
+	fat := make([]byte, (2+usedClusters)*4)
+	binary.LittleEndian.PutUint32(fat[0:], 0xfffffff8)
+	binary.LittleEndian.PutUint32(fat[4:], 0xffffffff)
+	chain := func(first, count int64) {
+		for c := first; c < first+count; c++ {
+			next := uint32(c + 1)
+			if c == first+count-1 {
+				next = 0xffffffff
+			}
+			binary.LittleEndian.PutUint32(fat[c*4:], next)
+		}
+	}
+	chain(bitmapCluster, bitmapClusters)
+	chain(upcaseCluster, upcaseClusters)
+	chain(rootCluster, 1)
+	if _, err := w.WriteAt(fat, exfatFATOffset*sectorSize); err != nil {
+		return err
+	}
+
+	clusterOffset := func(cluster int64) int64 {
+		return (clusterHeapOffset + (cluster-2)*sectorsPerCluster) * sectorSize
+	}
+
+	bitmap := make([]byte, (usedClusters+7)/8)
+	for c := int64(0); c < usedClusters; c++ {
+		bitmap[c/8] |= 1 << (c % 8)
+	}
+	if _, err := w.WriteAt(bitmap, clusterOffset(bitmapCluster)); err != nil {
+		return err
+	}
+	if _, err := w.WriteAt(upcase, clusterOffset(upcaseCluster)); err != nil {
+		return err
+	}
+
+	root := make([]byte, 3*32)
+	labelEntry := root[0:32]
+	labelEntry[0] = exfatEntryVolumeLabel
+	labelUnits := utf16.Encode([]rune(label))
+	if len(labelUnits) > exfatMaxLabelLength {
+		labelUnits = labelUnits[:exfatMaxLabelLength]
+	}
+	labelEntry[1] = byte(len(labelUnits))
+	for i, u := range labelUnits {
+		binary.LittleEndian.PutUint16(labelEntry[2+i*2:], u)
+	}
+
+	bitmapEntry := root[32:64]
+	bitmapEntry[0] = exfatEntryAllocationBitmap
+	binary.LittleEndian.PutUint32(bitmapEntry[20:], uint32(bitmapCluster))
+	binary.LittleEndian.PutUint64(bitmapEntry[24:], uint64(bitmapSize))
+
+	upcaseEntry := root[64:96]
+	upcaseEntry[0] = exfatEntryUpcaseTable
+	binary.LittleEndian.PutUint32(upcaseEntry[4:], exfatChecksum(0, upcase))
+	binary.LittleEndian.PutUint32(upcaseEntry[20:], uint32(upcaseCluster))
+	binary.LittleEndian.PutUint64(upcaseEntry[24:], uint64(len(upcase)))
+
+	_, err := w.WriteAt(root, clusterOffset(rootCluster))
+	return err
+}
@@ -0,0 +1,276 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// FAT32 layout follows the Microsoft FAT specification (fatgen103).
+
+const (
+	fat32ReservedSectors = 32
+	fat32NumFATs         = 2
+	fat32MinClusters     = 65525
+	fat32RootCluster     = 2
+	fat32EndOfChain      = 0x0fffffff
+	fat32MediaFixed      = 0xf8
+
+	fatAttrReadOnly = 0x01
+	fatAttrVolumeID = 0x08
+	fatAttrArchive  = 0x20
+	fatAttrLongName = 0x0f
+)
+
+// fat32ClusterSizes lists the cluster sizes (in sectors) recommended by
+// Microsoft, with the volume size (in sectors) up to which each one is used.
+var fat32ClusterSizes = []struct {
+	maxSectors        int64
+	sectorsPerCluster int64
+}{
+	{16777216, 8},  // up to 8GiB: 4KiB clusters
+	{33554432, 16}, // up to 16GiB: 8KiB clusters
+	{67108864, 32}, // up to 32GiB: 16KiB clusters
+	{1<<62 - 1, 64},
+}
+
+type fat32Layout struct {
+	sectors           int64
+	sectorsPerCluster int64
+	fatSectors        int64
+	clusters          int64
+}
+
+func newFAT32Layout(sectors int64) (*fat32Layout, error) {
+	var sectorsPerCluster int64
+	for _, size := range fat32ClusterSizes {
+		if sectors <= size.maxSectors {
+			sectorsPerCluster = size.sectorsPerCluster
+			break
+		}
+	}
+
+	// small volumes need smaller clusters to stay above the FAT32 minimum cluster count
+	for ; sectorsPerCluster >= 1; sectorsPerCluster /= 2 {
+		layout := &fat32Layout{sectors: sectors, sectorsPerCluster: sectorsPerCluster}
+		// FAT size calculation from fatgen103
+		tmp1 := sectors - fat32ReservedSectors
+		tmp2 := (256*sectorsPerCluster + fat32NumFATs) / 2
+		layout.fatSectors = (tmp1 + tmp2 - 1) / tmp2
+		layout.clusters = (sectors - fat32ReservedSectors - fat32NumFATs*layout.fatSectors) / sectorsPerCluster
+		if layout.clusters >= fat32MinClusters {
+			if layout.clusters > 0x0ffffff5 {
+				return nil, errors.New("volume is too large for FAT32")
+			}
+			return layout, nil
+		}
+	}
+	return nil, errors.New("volume is too small for FAT32")
+}
+
+func (l *fat32Layout) clusterOffset(cluster int64) int64 {
+	dataStart := fat32ReservedSectors + fat32NumFATs*l.fatSectors
+	return (dataStart + (cluster-2)*l.sectorsPerCluster) * sectorSize
+}
+
+// fatVolumeLabel pads the label to the 11 characters stored on disk
+func fatVolumeLabel(label string) []byte {
+	padded := []byte(strings.ToUpper(label) + strings.Repeat(" ", 11))
+	return padded[:11]
+}
+
+func fatVolumeSerial() uint32 {
+	return uint32(time.Now().UnixNano())
+}
+
+// fatShortName returns the 8.3 name stored in the directory entry, and
+// whether a long file name entry is needed to preserve the original name.
+func fatShortName(name string, index int) ([]byte, bool) {
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	clean := func(s string) string {
+		var b strings.Builder
+		for _, r := range strings.ToUpper(s) {
+			switch {
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("!#$%&'()-@^_`{}~", r):
+				b.WriteRune(r)
+			case r == ' ' || r == '.':
+			default:
+				b.WriteRune('_')
+			}
+		}
+		return b.String()
+	}
+	shortBase, shortExt := clean(base), clean(ext)
+	needsLong := len(shortBase) > 8 || len(shortExt) > 3 || shortBase != base || shortExt != ext || shortBase == ""
+	if needsLong {
+		tail := fmt.Sprintf("~%d", index+1)
+		shortBase = shortBase[:min(len(shortBase), 8-len(tail))] + tail
+		shortExt = shortExt[:min(len(shortExt), 3)]
+	}
+	short := []byte(fmt.Sprintf("%-8s%-3s", shortBase, shortExt))
+	return short, needsLong
+}
+
+// fatLongNameEntries returns the long file name entries that precede the
+// 8.3 entry, in the order they are stored on disk.
+func fatLongNameEntries(name string, short []byte) [][]byte {
+	var checksum byte
+	for _, c := range short {
+		checksum = (checksum&1)<<7 + checksum>>1 + c
+	}
+
+	units := utf16.Encode([]rune(name))
+	units = append(units, 0)
+	for len(units)%13 != 0 {
+		units = append(units, 0xffff)
+	}
+	count := len(units) / 13
+	entries := make([][]byte, count)
+	offsets := []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+	for i := 0; i < count; i++ {
+		entry := make([]byte, 32)
+		entry[0] = byte(i + 1)
+		if i == count-1 {
+			entry[0] |= 0x40
+		}
+		entry[11] = fatAttrLongName
+		entry[13] = checksum
+		for j, offset := range offsets {
+			binary.LittleEndian.PutUint16(entry[offset:], units[i*13+j])
+		}
+		entries[count-1-i] = entry
+	}
+	return entries
+}
+
+// formatFAT32 writes a FAT32 filesystem spanning sectors sectors to w, which
+// must be zero filled, with files in its root directory. hiddenSectors is the
+// partition start on disk.
+func formatFAT32(w io.WriterAt, hiddenSectors int64, sectors int64, label string, files []imageFile) error {
+	layout, err := newFAT32Layout(sectors)
+	if err != nil {
+		return err
+	}
+	clusterSize := layout.sectorsPerCluster * sectorSize
+
+	// the root directory takes the first cluster, files are stored contiguously after it
+	fat := []uint32{0x0fffff00 | fat32MediaFixed, fat32EndOfChain, fat32EndOfChain}
+	root := make([]byte, 32, clusterSize)
+	copy(root[0:], fatVolumeLabel(label))
+	root[11] = fatAttrVolumeID
+
+	now := time.Now()
+	fatDate := uint16((now.Year()-1980)<<9 | int(now.Month())<<5 | now.Day())
+	fatTime := uint16(now.Hour()<<11 | now.Minute()<<5 | now.Second()/2)
+
+	for i, file := range files {
+		firstCluster := int64(0)
+		if len(file.Data) > 0 {
+			firstCluster = int64(len(fat))
+			clusters := (int64(len(file.Data)) + clusterSize - 1) / clusterSize
+			if firstCluster+clusters > layout.clusters+2 {
+				return errors.New("files do not fit on the volume")
+			}
+			for c := firstCluster; c < firstCluster+clusters-1; c++ {
+				fat = append(fat, uint32(c+1))
+			}
+			fat = append(fat, fat32EndOfChain)
+			if _, err := w.WriteAt(file.Data, layout.clusterOffset(firstCluster)); err != nil {
+				return err
+			}
+		}
+
+		short, needsLong := fatShortName(file.Name, i)
+		var entries [][]byte
+		if needsLong {
+			entries = fatLongNameEntries(file.Name, short)
+		}
+		entry := make([]byte, 32)
+		copy(entry[0:], short)
+		entry[11] = fatAttrArchive | fatAttrReadOnly
+		binary.LittleEndian.PutUint16(entry[14:], fatTime)
+		binary.LittleEndian.PutUint16(entry[16:], fatDate)
+		binary.LittleEndian.PutUint16(entry[18:], fatDate)
+		binary.LittleEndian.PutUint16(entry[20:], uint16(firstCluster>>16))
+		binary.LittleEndian.PutUint16(entry[22:], fatTime)
+		binary.LittleEndian.PutUint16(entry[24:], fatDate)
+		binary.LittleEndian.PutUint16(entry[26:], uint16(firstCluster))
+		binary.LittleEndian.PutUint32(entry[28:], uint32(len(file.Data)))
+		entries = append(entries, entry)
+
+		for _, e := range entries {
+			if int64(len(root)+32) > clusterSize {
+				return errors.New("too many files for the root directory")
+			}
+			root = append(root, e...)
+		}
+	}
+	usedClusters := int64(len(fat) - 2)
+
+	boot := make([]byte, sectorSize)
+	copy(boot[0:], []byte{0xeb, 0x58, 0x90})
+	copy(boot[3:], "MSWIN4.1")
+	binary.LittleEndian.PutUint16(boot[11:], sectorSize)
+	boot[13] = byte(layout.sectorsPerCluster)
+	binary.LittleEndian.PutUint16(boot[14:], fat32ReservedSectors)
+	boot[16] = fat32NumFATs
+	boot[21] = fat32MediaFixed
+	binary.LittleEndian.PutUint16(boot[24:], 63)
+	binary.LittleEndian.PutUint16(boot[26:], 255)
+	binary.LittleEndian.PutUint32(boot[28:], uint32(hiddenSectors))
+	binary.LittleEndian.PutUint32(boot[32:], uint32(sectors))
+	binary.LittleEndian.PutUint32(boot[36:], uint32(layout.fatSectors))
+	binary.LittleEndian.PutUint32(boot[44:], fat32RootCluster)
+	binary.LittleEndian.PutUint16(boot[48:], 1) // FSInfo sector
+	binary.LittleEndian.PutUint16(boot[50:], 6) // backup boot sector
+	boot[64] = 0x80
+	boot[66] = 0x29
+	binary.LittleEndian.PutUint32(boot[67:], fatVolumeSerial())
+	copy(boot[71:], fatVolumeLabel(label))
+	copy(boot[82:], "FAT32   ")
+	boot[510] = 0x55
+	boot[511] = 0xaa
+
+	fsInfo := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(fsInfo[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(fsInfo[484:], 0x61417272)
+	binary.LittleEndian.PutUint32(fsInfo[488:], uint32(layout.clusters-usedClusters))
+	binary.LittleEndian.PutUint32(fsInfo[492:], uint32(len(fat)))
+	binary.LittleEndian.PutUint32(fsInfo[508:], 0xaa550000)
+
+	for _, base := range []int64{0, 6} {
+		if _, err := w.WriteAt(boot, base*sectorSize); err != nil {
+			return err
+		}
+		if _, err := w.WriteAt(fsInfo, (base+1)*sectorSize); err != nil {
+			return err
+		}
+		// the third boot sector only carries the signature
+		signature := make([]byte, sectorSize)
+		signature[510] = 0x55
+		signature[511] = 0xaa
+		if _, err := w.WriteAt(signature, (base+2)*sectorSize); err != nil {
+			return err
+		}
+	}
+
+	fatBytes := make([]byte, len(fat)*4)
+	for i, v := range fat {
+		binary.LittleEndian.PutUint32(fatBytes[i*4:], v)
+	}
+	for i := int64(0); i < fat32NumFATs; i++ {
+		if _, err := w.WriteAt(fatBytes, (fat32ReservedSectors+i*layout.fatSectors)*sectorSize); err != nil {
+			return err
+		}
+	}
+
+	_, err = w.WriteAt(root, layout.clusterOffset(fat32RootCluster))
+	return err
+}
@@ -0,0 +1,211 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// Fragmented MP4 layout follows ISO/IEC 14496-12 and the AVC file format
+// (ISO/IEC 14496-15): an init segment (ftyp+moov) followed by moof+mdat
+// fragments, so a recording stays playable if it is cut off.
+
+const (
+	fmp4Timescale = 90000
+	fmp4TrackID   = 1
+	// fragments are flushed at every keyframe, or after this much media
+	fmp4MaxFragmentDuration = 1 * time.Second
+
+	fmp4SampleFlagsKeyframe = 0x02000000 // sample_depends_on=2
+	fmp4SampleFlagsDelta    = 0x01010000 // sample_depends_on=1, sample_is_non_sync_sample
+)
+
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	box := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(box[0:], uint32(size))
+	copy(box[4:], boxType)
+	for _, p := range payload {
+		box = append(box, p...)
+	}
+	return box
+}
+
+func mp4FullBox(boxType string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(boxType, append([][]byte{header}, payload...)...)
+}
+
+func mp4Uint16(v uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, v)
+}
+
+func mp4Uint32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func mp4Uint64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+// mp4Matrix is the identity transformation matrix
+var mp4Matrix = []byte{
+	0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0x00, 0x01, 0x00, 0x00, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0x00, 0x00, 0x00,
+}
+
+type fmp4Sample struct {
+	data     []byte
+	duration uint32
+	keyframe bool
+}
+
+type fmp4Writer struct {
+	w          io.Writer
+	sequence   uint32
+	decodeTime uint64
+	pending    []fmp4Sample
+	pendingDur uint64
+}
+
+// newFMP4Writer writes the init segment for an H.264 track described by the
+// given SPS and PPS NAL units.
+func newFMP4Writer(w io.Writer, sps []byte, pps []byte) (*fmp4Writer, error) {
+	info, err := parseH264SPS(sps)
+	if err != nil {
+		return nil, err
+	}
+	if len(pps) == 0 {
+		return nil, errors.New("missing picture parameter set")
+	}
+
+	ftyp := mp4Box("ftyp", []byte("isom"), mp4Uint32(0x200), []byte("isomiso5iso6avc1mp41"))
+
+	avcC := mp4Box("avcC", avcDecoderConfigurationRecord(sps, pps))
+	compressorName := make([]byte, 32)
+	avc1 := mp4Box("avc1",
+		make([]byte, 6), mp4Uint16(1), // reserved, data_reference_index
+		make([]byte, 16), // pre_defined and reserved
+		mp4Uint16(uint16(info.Width)), mp4Uint16(uint16(info.Height)),
+		mp4Uint32(0x00480000), mp4Uint32(0x00480000), // 72 dpi
+		make([]byte, 4), mp4Uint16(1), // reserved, frame_count
+		compressorName,
+		mp4Uint16(0x0018), mp4Uint16(0xffff), // depth, pre_defined
+		avcC,
+	)
+
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, mp4Uint32(1), avc1),
+		mp4FullBox("stts", 0, 0, mp4Uint32(0)),
+		mp4FullBox("stsc", 0, 0, mp4Uint32(0)),
+		mp4FullBox("stsz", 0, 0, mp4Uint32(0), mp4Uint32(0)),
+		mp4FullBox("stco", 0, 0, mp4Uint32(0)),
+	)
+	minf := mp4Box("minf",
+		mp4FullBox("vmhd", 0, 1, make([]byte, 8)),
+		mp4Box("dinf", mp4FullBox("dref", 0, 0, mp4Uint32(1), mp4FullBox("url ", 0, 1))),
+		stbl,
+	)
+	mdia := mp4Box("mdia",
+		mp4FullBox("mdhd", 0, 0, make([]byte, 8), mp4Uint32(fmp4Timescale), mp4Uint32(0), mp4Uint16(0x55c4), mp4Uint16(0)),
+		mp4FullBox("hdlr", 0, 0, make([]byte, 4), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00")),
+		minf,
+	)
+	tkhd := mp4FullBox("tkhd", 0, 3,
+		make([]byte, 8), mp4Uint32(fmp4TrackID), make([]byte, 4), mp4Uint32(0), // times, track, reserved, duration
+		make([]byte, 8), make([]byte, 4), mp4Uint16(0), make([]byte, 2), // reserved, layer+group, volume, reserved
+		mp4Matrix,
+		mp4Uint32(uint32(info.Width)<<16), mp4Uint32(uint32(info.Height)<<16),
+	)
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		make([]byte, 8), mp4Uint32(1000), mp4Uint32(0), // times, timescale, duration
+		mp4Uint32(0x00010000), mp4Uint16(0x0100), make([]byte, 10), // rate, volume, reserved
+		mp4Matrix, make([]byte, 24), mp4Uint32(fmp4TrackID+1),
+	)
+	mvex := mp4Box("mvex", mp4FullBox("trex", 0, 0, mp4Uint32(fmp4TrackID), mp4Uint32(1), mp4Uint32(0), mp4Uint32(0), mp4Uint32(0)))
+	moov := mp4Box("moov", mvhd, mp4Box("trak", tkhd, mdia), mvex)
+
+	if _, err := w.Write(append(ftyp, moov...)); err != nil {
+		return nil, err
+	}
+	return &fmp4Writer{w: w}, nil
+}
+
+// WriteSample queues an access unit given as its NAL units. Parameter sets
+// and delimiters are dropped, the decoder gets them from the init segment.
+func (f *fmp4Writer) WriteSample(nals [][]byte, duration time.Duration, keyframe bool) error {
+	if keyframe && len(f.pending) > 0 {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+
+	data := avccPayload(nals)
+	if len(data) == 0 {
+		return nil
+	}
+	ticks := uint32(duration * fmp4Timescale / time.Second)
+	f.pending = append(f.pending, fmp4Sample{data: data, duration: ticks, keyframe: keyframe})
+	f.pendingDur += uint64(ticks)
+
+	if f.pendingDur >= uint64(fmp4MaxFragmentDuration*fmp4Timescale/time.Second) {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Flush writes the queued samples as a fragment
+func (f *fmp4Writer) Flush() error {
+	if len(f.pending) == 0 {
+		return nil
+	}
+	f.sequence++
+
+	const trunFlags = 0x000001 | 0x000100 | 0x000200 | 0x000400 // data offset, duration, size, flags
+	trunEntries := make([]byte, 0, len(f.pending)*12)
+	mdatSize := 8
+	for _, sample := range f.pending {
+		flags := uint32(fmp4SampleFlagsDelta)
+		if sample.keyframe {
+			flags = fmp4SampleFlagsKeyframe
+		}
+		trunEntries = binary.BigEndian.AppendUint32(trunEntries, sample.duration)
+		trunEntries = binary.BigEndian.AppendUint32(trunEntries, uint32(len(sample.data)))
+		trunEntries = binary.BigEndian.AppendUint32(trunEntries, flags)
+		mdatSize += len(sample.data)
+	}
+
+	buildMoof := func(dataOffset uint32) []byte {
+		return mp4Box("moof",
+			mp4FullBox("mfhd", 0, 0, mp4Uint32(f.sequence)),
+			mp4Box("traf",
+				mp4FullBox("tfhd", 0, 0x020000, mp4Uint32(fmp4TrackID)), // default-base-is-moof
+				mp4FullBox("tfdt", 1, 0, mp4Uint64(f.decodeTime)),
+				mp4FullBox("trun", 0, trunFlags, mp4Uint32(uint32(len(f.pending))), mp4Uint32(dataOffset), trunEntries),
+			),
+		)
+	}
+	// the data offset points past the moof and the mdat header
+	moof := buildMoof(0)
+	moof = buildMoof(uint32(len(moof) + 8))
+
+	mdatHeader := mp4Uint32(uint32(mdatSize))
+	mdatHeader = append(mdatHeader, "mdat"...)
+	buf := make([]byte, 0, len(moof)+mdatSize)
+	buf = append(buf, moof...)
+	buf = append(buf, mdatHeader...)
+	for _, sample := range f.pending {
+		buf = append(buf, sample.data...)
+		f.decodeTime += uint64(sample.duration)
+	}
+	f.pending = f.pending[:0]
+	f.pendingDur = 0
+
+	_, err := f.w.Write(buf)
+	return err
+}
@@ -16,8 +16,11 @@ require (
 	github.com/hanwen/go-fuse/v2 v2.5.1
 	github.com/hashicorp/go-envparse v0.1.0
 	github.com/openstadia/go-usb-gadget v0.0.0-20231115171102-aebd56bbb965
+	github.com/pion/interceptor v0.1.37
 	github.com/pion/logging v0.2.2
 	github.com/pion/mdns/v2 v2.0.7
+	github.com/pion/rtcp v1.2.14
+	github.com/pion/rtp v1.8.9
 	github.com/pion/webrtc/v4 v4.0.0
 	github.com/pojntfx/go-nbd v0.3.2
 	github.com/prometheus/client_golang v1.21.0
@@ -59,10 +62,7 @@ require (
 	github.com/pion/datachannel v1.5.9 // indirect
 	github.com/pion/dtls/v3 v3.0.3 // indirect
 	github.com/pion/ice/v4 v4.0.2 // indirect
-	github.com/pion/interceptor v0.1.37 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtcp v1.2.14 // indirect
-	github.com/pion/rtp v1.8.9 // indirect
 	github.com/pion/sctp v1.8.33 // indirect
 	github.com/pion/sdp/v3 v3.0.9 // indirect
 	github.com/pion/srtp/v3 v3.0.4 // indirect
@@ -0,0 +1,305 @@
+package kvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// H.264 NAL unit types, ITU-T H.264 table 7-1
+const (
+	h264NALSlice = 1
+	h264NALIDR   = 5
+	h264NALSEI   = 6
+	h264NALSPS   = 7
+	h264NALPPS   = 8
+	h264NALAUD   = 9
+)
+
+// splitAnnexB splits an Annex B byte stream into NAL units, without their
+// start codes.
+func splitAnnexB(data []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				// a 4 byte start code leaves a trailing zero on the previous unit
+				end := i
+				if end > start && data[end-1] == 0 {
+					end--
+				}
+				nals = append(nals, data[start:end])
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 && start < len(data) {
+		nals = append(nals, data[start:])
+	} else if start < 0 && len(data) > 0 {
+		// not Annex B, treat it as a single NAL unit
+		nals = append(nals, data)
+	}
+	return nals
+}
+
+func h264NALType(nal []byte) byte {
+	if len(nal) == 0 {
+		return 0
+	}
+	return nal[0] & 0x1f
+}
+
+// h264IsKeyframe reports whether the access unit contains an IDR slice
+func h264IsKeyframe(nals [][]byte) bool {
+	for _, nal := range nals {
+		if h264NALType(nal) == h264NALIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// avcDecoderConfigurationRecord builds the avcC record (ISO/IEC 14496-15
+// section 5.2.4.1) used by MP4 and FLV to carry the parameter sets.
+func avcDecoderConfigurationRecord(sps []byte, pps []byte) []byte {
+	record := []byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1}
+	record = binary.BigEndian.AppendUint16(record, uint16(len(sps)))
+	record = append(record, sps...)
+	record = append(record, 1)
+	record = binary.BigEndian.AppendUint16(record, uint16(len(pps)))
+	return append(record, pps...)
+}
+
+// avccPayload converts an access unit to length prefixed NAL units, as
+// stored in MP4 and FLV. Parameter sets and delimiters are dropped, they
+// travel in the decoder configuration record.
+func avccPayload(nals [][]byte) []byte {
+	var data []byte
+	for _, nal := range nals {
+		switch h264NALType(nal) {
+		case h264NALSPS, h264NALPPS, h264NALAUD:
+			continue
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(len(nal)))
+		data = append(data, nal...)
+	}
+	return data
+}
+
+type h264SPSInfo struct {
+	Profile       byte
+	Compatibility byte
+	Level         byte
+	Width         int
+	Height        int
+}
+
+// h264RBSP removes the emulation prevention bytes from a NAL unit
+func h264RBSP(nal []byte) []byte {
+	if !bytes.Contains(nal, []byte{0, 0, 3}) {
+		return nal
+	}
+	rbsp := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+var errBitReaderEOF = errors.New("unexpected end of data")
+
+func (r *bitReader) bit() (uint32, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, errBitReaderEOF
+	}
+	b := (r.data[r.pos/8] >> (7 - r.pos%8)) & 1
+	r.pos++
+	return uint32(b), nil
+}
+
+func (r *bitReader) bits(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+// ue reads an unsigned Exp-Golomb code
+func (r *bitReader) ue() (uint32, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errors.New("invalid exp-golomb code")
+		}
+	}
+	v, err := r.bits(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return (1<<zeros - 1) + v, nil
+}
+
+// se reads a signed Exp-Golomb code
+func (r *bitReader) se() (int32, error) {
+	v, err := r.ue()
+	if err != nil {
+		return 0, err
+	}
+	if v%2 == 1 {
+		return int32((v + 1) / 2), nil
+	}
+	return -int32(v / 2), nil
+}
+
+// parseH264SPS extracts the profile and the cropped picture size from a
+// sequence parameter set, ITU-T H.264 section 7.3.2.1.1.
+func parseH264SPS(sps []byte) (*h264SPSInfo, error) {
+	if h264NALType(sps) != h264NALSPS || len(sps) < 4 {
+		return nil, errors.New("not a sequence parameter set")
+	}
+	info := &h264SPSInfo{Profile: sps[1], Compatibility: sps[2], Level: sps[3]}
+	r := &bitReader{data: h264RBSP(sps[4:])}
+
+	var err error
+	next := func() uint32 {
+		if err != nil {
+			return 0
+		}
+		var v uint32
+		v, err = r.ue()
+		return v
+	}
+	flag := func() bool {
+		if err != nil {
+			return false
+		}
+		var v uint32
+		v, err = r.bit()
+		return v == 1
+	}
+
+	next() // seq_parameter_set_id
+	chromaFormat := uint32(1)
+	separateColourPlane := false
+	switch info.Profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = next()
+		if chromaFormat == 3 {
+			separateColourPlane = flag()
+		}
+		next() // bit_depth_luma_minus8
+		next() // bit_depth_chroma_minus8
+		flag() // qpprime_y_zero_transform_bypass_flag
+		if flag() {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists && err == nil; i++ {
+				if !flag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, nextScale := int32(8), int32(8)
+				for j := 0; j < size && err == nil; j++ {
+					if nextScale != 0 {
+						var delta int32
+						delta, err = r.se()
+						nextScale = (last + delta + 256) % 256
+					}
+					if nextScale != 0 {
+						last = nextScale
+					}
+				}
+			}
+		}
+	}
+	next() // log2_max_frame_num_minus4
+	switch next() {
+	case 0:
+		next() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		flag() // delta_pic_order_always_zero_flag
+		if err == nil {
+			_, err = r.se()
+		}
+		if err == nil {
+			_, err = r.se()
+		}
+		cycle := next()
+		for i := uint32(0); i < cycle && err == nil; i++ {
+			_, err = r.se()
+		}
+	}
+	next() // max_num_ref_frames
+	flag() // gaps_in_frame_num_value_allowed_flag
+	widthInMbs := next() + 1
+	heightInMapUnits := next() + 1
+	frameMbsOnly := flag()
+	if !frameMbsOnly {
+		flag() // mb_adaptive_frame_field_flag
+	}
+	flag() // direct_8x8_inference_flag
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if flag() {
+		cropLeft, cropRight, cropTop, cropBottom = next(), next(), next(), next()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	frameHeightFactor := uint32(2)
+	if frameMbsOnly {
+		frameHeightFactor = 1
+	}
+	cropUnitX, cropUnitY := uint32(1), frameHeightFactor
+	if chromaFormat != 0 && !separateColourPlane {
+		subWidth, subHeight := uint32(2), uint32(2)
+		switch chromaFormat {
+		case 2:
+			subHeight = 1
+		case 3:
+			subWidth, subHeight = 1, 1
+		}
+		cropUnitX = subWidth
+		cropUnitY = subHeight * frameHeightFactor
+	}
+	info.Width = int(widthInMbs*16 - cropUnitX*(cropLeft+cropRight))
+	info.Height = int(frameHeightFactor*heightInMapUnits*16 - cropUnitY*(cropTop+cropBottom))
+	return info, nil
+}
@@ -0,0 +1,194 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ICE restarts keep a session, its data channels and WebRTC mounted media
+// alive when either side changes address, e.g. a laptop moving from Wi-Fi to
+// tethering. The browser restarts by sending a new offer, the device by
+// sending one when its own address changes or ICE fails. The offers and
+// answers go over the RPC channel while it still works and over the
+// signaling websocket or the cloud when the session has one.
+
+// iceFailedGracePeriod is how long a session with failed ICE is kept for a
+// restart before it is closed
+const iceFailedGracePeriod = 30 * time.Second
+
+// signalingPath is the out of band signaling a session can be reached over,
+// the local signaling websocket or the cloud websocket
+type signalingPath struct {
+	sendOffer func(sd string) error
+}
+
+func (s *Session) setSignalingPath(path *signalingPath) {
+	s.signalingLock.Lock()
+	defer s.signalingLock.Unlock()
+	s.signaling = path
+}
+
+// clearSignalingPath forgets path unless another one replaced it meanwhile
+func (s *Session) clearSignalingPath(path *signalingPath) {
+	s.signalingLock.Lock()
+	defer s.signalingLock.Unlock()
+	if s.signaling == path {
+		s.signaling = nil
+	}
+}
+
+// renegotiate answers an offer from the browser for a session already set
+// up, an ICE restart when its credentials changed
+func (s *Session) renegotiate(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	s.negotiationLock.Lock()
+	defer s.negotiationLock.Unlock()
+	if s.peerConnection.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		// both sides restarted at once, the device gives way
+		logger.Infof("session %s: rolling back the device offer for the browser one", s.ID)
+		rollback := webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}
+		if err := s.peerConnection.SetLocalDescription(rollback); err != nil {
+			return nil, fmt.Errorf("failed to roll back local offer: %w", err)
+		}
+	}
+	return s.answerOffer(offer)
+}
+
+// restartICE sends the browser an offer with new ICE credentials, the answer
+// comes back through setRemoteAnswer
+func (s *Session) restartICE() error {
+	s.negotiationLock.Lock()
+	defer s.negotiationLock.Unlock()
+	if s.peerConnection.SignalingState() != webrtc.SignalingStateStable {
+		return errors.New("a negotiation is already in progress")
+	}
+
+	offer, err := s.peerConnection.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(s.peerConnection)
+	if err := s.peerConnection.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to set local offer: %w", err)
+	}
+	<-gatherComplete
+
+	sd, err := encodeSessionDescription(s.peerConnection.LocalDescription())
+	if err != nil {
+		return err
+	}
+
+	sent := false
+	if s.RPCChannel != nil && s.RPCChannel.ReadyState() == webrtc.DataChannelStateOpen {
+		writeJSONRPCEvent("iceRestartOffer", map[string]string{"sd": sd}, s)
+		sent = true
+	}
+	s.signalingLock.Lock()
+	path := s.signaling
+	s.signalingLock.Unlock()
+	if path != nil {
+		if err := path.sendOffer(sd); err != nil {
+			logger.Warnf("session %s: failed to send ICE restart offer: %v", s.ID, err)
+		} else {
+			sent = true
+		}
+	}
+	if !sent {
+		rollback := webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}
+		_ = s.peerConnection.SetLocalDescription(rollback)
+		return errors.New("no way to reach the browser")
+	}
+	logger.Infof("session %s: sent ICE restart offer", s.ID)
+	return nil
+}
+
+// setRemoteAnswer completes a restart started by restartICE
+func (s *Session) setRemoteAnswer(answer webrtc.SessionDescription) error {
+	s.negotiationLock.Lock()
+	defer s.negotiationLock.Unlock()
+	if s.peerConnection.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		return errors.New("no ICE restart offer is pending")
+	}
+	if err := s.peerConnection.SetRemoteDescription(answer); err != nil {
+		return fmt.Errorf("failed to set remote answer: %w", err)
+	}
+	return nil
+}
+
+// onICEFailed keeps the session for iceFailedGracePeriod instead of closing
+// it, so either side can restart ICE
+func (s *Session) onICEFailed() {
+	s.signalingLock.Lock()
+	if s.iceFailedTimer != nil {
+		s.signalingLock.Unlock()
+		return
+	}
+	s.iceFailedTimer = time.AfterFunc(iceFailedGracePeriod, func() {
+		logger.Infof("session %s: ICE not restarted after %v, closing", s.ID, iceFailedGracePeriod)
+		_ = s.peerConnection.Close()
+	})
+	s.signalingLock.Unlock()
+
+	// the browser may not have noticed yet, the offer reaches it if the
+	// session has a signaling path
+	go func() {
+		if err := s.restartICE(); err != nil {
+			logger.Debugf("session %s: device ICE restart not sent: %v", s.ID, err)
+		}
+	}()
+}
+
+// stopICEFailedTimer cancels the close pending since ICE failed, it reports
+// whether there was one
+func (s *Session) stopICEFailedTimer() bool {
+	s.signalingLock.Lock()
+	defer s.signalingLock.Unlock()
+	if s.iceFailedTimer == nil {
+		return false
+	}
+	s.iceFailedTimer.Stop()
+	s.iceFailedTimer = nil
+	return true
+}
+
+// onLocalAddressChanged restarts ICE on every session, their candidates
+// carry the old address
+func onLocalAddressChanged() {
+	for _, session := range sessions.list() {
+		go func(session *Session) {
+			if err := session.restartICE(); err != nil {
+				logger.Infof("session %s: ICE not restarted: %v", session.ID, err)
+			}
+		}(session)
+	}
+}
+
+// rpcRenegotiate answers an offer the browser sends over the RPC channel to
+// restart ICE
+func rpcRenegotiate(session *Session, sd string) (string, error) {
+	offer, err := decodeSessionDescription(sd)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode offer: %w", err)
+	}
+	answer, err := session.renegotiate(*offer)
+	if err != nil {
+		return "", err
+	}
+	return encodeSessionDescription(answer)
+}
+
+// rpcSetICERestartAnswer is the browser's answer to an iceRestartOffer event
+func rpcSetICERestartAnswer(session *Session, sd string) error {
+	answer, err := decodeSessionDescription(sd)
+	if err != nil {
+		return fmt.Errorf("failed to decode answer: %w", err)
+	}
+	return session.setRemoteAnswer(*answer)
+}
+
+// rpcRestartICE asks the device to send an iceRestartOffer
+func rpcRestartICE(session *Session) error {
+	return session.restartICE()
+}
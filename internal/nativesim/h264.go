@@ -0,0 +1,122 @@
+package nativesim
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	nalSlice = 1
+	nalIDR   = 5
+	nalSEI   = 6
+	nalSPS   = 7
+	nalPPS   = 8
+	nalAUD   = 9
+)
+
+// accessUnit is one encoded picture in Annex B form, the unit jetkvm_native
+// writes to the video socket
+type accessUnit struct {
+	data     []byte
+	keyframe bool
+}
+
+// nalUnits returns the NAL units of an Annex B stream, start codes included
+func nalUnits(data []byte) [][]byte {
+	var starts []int
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			start := i
+			if start > 0 && data[start-1] == 0 {
+				start--
+			}
+			starts = append(starts, start)
+			i += 2
+		}
+	}
+	nals := make([][]byte, 0, len(starts))
+	for i, start := range starts {
+		end := len(data)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		nals = append(nals, data[start:end])
+	}
+	return nals
+}
+
+// nalHeader returns the first byte after the start code
+func nalHeader(nal []byte) byte {
+	for i := 0; i+2 < len(nal); i++ {
+		if nal[i] == 0 && nal[i+1] == 0 && nal[i+2] == 1 {
+			if i+3 < len(nal) {
+				return nal[i+3]
+			}
+			break
+		}
+	}
+	return 0
+}
+
+// firstSliceOfPicture reports whether a slice starts a new picture, i.e.
+// first_mb_in_slice is 0. It is the first ue(v) of the slice header, a
+// value of 0 is coded as a single 1 bit.
+func firstSliceOfPicture(nal []byte) bool {
+	for i := 0; i+4 < len(nal); i++ {
+		if nal[i] == 0 && nal[i+1] == 0 && nal[i+2] == 1 {
+			return nal[i+4]&0x80 != 0
+		}
+	}
+	return false
+}
+
+// splitAccessUnits groups the NAL units of a stream into pictures, following
+// ITU-T H.264 section 7.4.1.2.3
+func splitAccessUnits(data []byte) []accessUnit {
+	var units []accessUnit
+	var current accessUnit
+	hasSlice := false
+	flush := func() {
+		if len(current.data) > 0 && hasSlice {
+			units = append(units, current)
+		}
+		current = accessUnit{}
+		hasSlice = false
+	}
+	for _, nal := range nalUnits(data) {
+		nalType := nalHeader(nal) & 0x1f
+		switch nalType {
+		case nalAUD, nalSPS, nalPPS, nalSEI:
+			if hasSlice {
+				flush()
+			}
+		case nalSlice, nalIDR:
+			if hasSlice && firstSliceOfPicture(nal) {
+				flush()
+			}
+			hasSlice = true
+			if nalType == nalIDR {
+				current.keyframe = true
+			}
+		}
+		current.data = append(current.data, nal...)
+	}
+	flush()
+	return units
+}
+
+func loadH264File(path string) ([]accessUnit, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read video file: %w", err)
+	}
+	units := splitAccessUnits(data)
+	if len(units) == 0 {
+		return nil, errors.New("no H.264 pictures found, expected an Annex B elementary stream")
+	}
+	if !units[0].keyframe {
+		return nil, errors.New("video file does not start with a keyframe")
+	}
+	return units, nil
+}
@@ -0,0 +1,379 @@
+// Package nativesim stands in for the closed jetkvm_native binary. It speaks
+// the ctrl and video socket protocols of the app so it can run on a Linux
+// workstation without the capture hardware or the display.
+package nativesim
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultCtrlSocket  = "/var/run/jetkvm_ctrl.sock"
+	DefaultVideoSocket = "/var/run/jetkvm_video.sock"
+
+	// DefaultEDID is the EDID jetkvm_native reports before one is set
+	DefaultEDID = "00ffffffffffff0052620188008888881c150103800000780a0dc9a05747982712484c00000001010101010101010101010101010101023a801871382d40582c4500c48e2100001e011d007251d01e206e285500c48e2100001e000000fc00543734392d6648443732300a20000000fd00147801ff1d000a202020202020017b"
+
+	reconnectInterval = time.Second
+	readBufferSize    = 64 * 1024
+	// the app reads pictures into a buffer of this size, see maxFrameSize
+	maxPictureSize = 1920 * 1080 / 2
+)
+
+type Config struct {
+	CtrlSocket  string
+	VideoSocket string
+	// VideoFile is an H.264 Annex B elementary stream, played in a loop
+	VideoFile string
+	FPS       float64
+	Width     int
+	Height    int
+}
+
+// The message shapes of the ctrl socket, see CtrlAction and CtrlResponse in
+// the kvm package
+type ctrlAction struct {
+	Action string                 `json:"action"`
+	Seq    int32                  `json:"seq,omitempty"`
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+type ctrlResponse struct {
+	Seq    int32                  `json:"seq,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+	Errno  int32                  `json:"errno,omitempty"`
+	Result map[string]interface{} `json:"result,omitempty"`
+	Event  string                 `json:"event,omitempty"`
+	Data   interface{}            `json:"data,omitempty"`
+}
+
+type VideoInputState struct {
+	Ready          bool    `json:"ready"`
+	Error          string  `json:"error,omitempty"`
+	Width          int     `json:"width"`
+	Height         int     `json:"height"`
+	FramePerSecond float64 `json:"fps"`
+}
+
+type Simulator struct {
+	config Config
+	units  []accessUnit
+
+	mu            sync.Mutex
+	ctrl          net.Conn
+	videoState    VideoInputState
+	edid          string
+	qualityFactor float64
+	streaming     bool
+	screen        string
+	labels        map[string]string
+	objectStates  map[string]string
+
+	keyframeRequested chan struct{}
+}
+
+func New(config Config) (*Simulator, error) {
+	if config.CtrlSocket == "" {
+		config.CtrlSocket = DefaultCtrlSocket
+	}
+	if config.VideoSocket == "" {
+		config.VideoSocket = DefaultVideoSocket
+	}
+	if config.FPS <= 0 {
+		config.FPS = 30
+	}
+	s := &Simulator{
+		config:            config,
+		edid:              DefaultEDID,
+		qualityFactor:     1.0,
+		labels:            make(map[string]string),
+		objectStates:      make(map[string]string),
+		keyframeRequested: make(chan struct{}, 1),
+		videoState: VideoInputState{
+			Ready:          true,
+			Width:          config.Width,
+			Height:         config.Height,
+			FramePerSecond: config.FPS,
+		},
+	}
+	if config.VideoFile != "" {
+		units, err := loadH264File(config.VideoFile)
+		if err != nil {
+			return nil, err
+		}
+		s.units = units
+		log.Printf("loaded %d pictures from %s", len(units), config.VideoFile)
+	}
+	return s, nil
+}
+
+// Run keeps both sockets connected until ctx ends, reconnecting whenever the
+// app restarts
+func (s *Simulator) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.reconnectLoop(ctx, s.config.CtrlSocket, s.serveCtrl)
+	}()
+	go func() {
+		defer wg.Done()
+		s.reconnectLoop(ctx, s.config.VideoSocket, s.serveVideo)
+	}()
+	wg.Wait()
+}
+
+func (s *Simulator) reconnectLoop(ctx context.Context, path string, serve func(context.Context, net.Conn) error) {
+	logged := false
+	for ctx.Err() == nil {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "unixpacket", path)
+		if err != nil {
+			if !logged {
+				log.Printf("waiting for %s: %v", path, err)
+				logged = true
+			}
+		} else {
+			log.Printf("connected to %s", path)
+			logged = false
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			err = serve(ctx, conn)
+			stop()
+			conn.Close()
+			if ctx.Err() == nil {
+				log.Printf("disconnected from %s: %v", path, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(reconnectInterval):
+		}
+	}
+}
+
+func (s *Simulator) write(message interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctrl == nil {
+		return errors.New("ctrl socket not connected")
+	}
+	_, err = s.ctrl.Write(data)
+	return err
+}
+
+func (s *Simulator) serveCtrl(ctx context.Context, conn net.Conn) error {
+	s.mu.Lock()
+	s.ctrl = conn
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.ctrl = nil
+		s.mu.Unlock()
+	}()
+
+	// like the real binary, the video state is announced as soon as the app
+	// is reachable
+	if err := s.sendVideoState(); err != nil {
+		return err
+	}
+
+	buf := make([]byte, readBufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		var action ctrlAction
+		if err := json.Unmarshal(buf[:n], &action); err != nil {
+			log.Printf("invalid ctrl message %q: %v", buf[:n], err)
+			continue
+		}
+		response := s.handleAction(action)
+		// actions sent without a sequence number expect no response
+		if action.Seq == 0 {
+			if response.Error != "" {
+				log.Printf("%s failed: %s", action.Action, response.Error)
+			}
+			continue
+		}
+		response.Seq = action.Seq
+		if err := s.write(response); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Simulator) handleAction(action ctrlAction) ctrlResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stringParam := func(name string) (string, bool) {
+		value, ok := action.Params[name].(string)
+		return value, ok
+	}
+
+	switch action.Action {
+	case "lv_scr_load":
+		obj, ok := stringParam("obj")
+		if !ok {
+			return ctrlResponse{Error: "missing obj"}
+		}
+		s.screen = obj
+		log.Printf("display: screen %s", obj)
+	case "lv_label_set_text":
+		obj, ok := stringParam("obj")
+		if !ok {
+			return ctrlResponse{Error: "missing obj"}
+		}
+		text, _ := stringParam("text")
+		s.labels[obj] = text
+		log.Printf("display: %s = %q", obj, text)
+	case "lv_obj_set_state":
+		obj, ok := stringParam("obj")
+		if !ok {
+			return ctrlResponse{Error: "missing obj"}
+		}
+		state, _ := stringParam("state")
+		s.objectStates[obj] = state
+	case "set_edid":
+		edid, _ := stringParam("edid")
+		data, err := hex.DecodeString(edid)
+		if err != nil || len(data) == 0 || len(data)%128 != 0 {
+			return ctrlResponse{Error: "invalid edid", Errno: 22}
+		}
+		s.edid = edid
+		log.Printf("edid set (%d bytes)", len(data))
+	case "get_edid":
+		return ctrlResponse{Result: map[string]interface{}{"edid": s.edid}}
+	case "set_video_quality_factor":
+		factor, ok := action.Params["quality_factor"].(float64)
+		if !ok || factor <= 0 || factor > 1 {
+			return ctrlResponse{Error: "invalid quality_factor", Errno: 22}
+		}
+		s.qualityFactor = factor
+		log.Printf("video quality factor %.2f", factor)
+	case "start_video":
+		s.streaming = true
+		log.Print("video started")
+	case "stop_video":
+		s.streaming = false
+		log.Print("video stopped")
+	case "request_keyframe":
+		select {
+		case s.keyframeRequested <- struct{}{}:
+		default:
+		}
+	default:
+		return ctrlResponse{Error: fmt.Sprintf("unknown action: %s", action.Action), Errno: 38}
+	}
+	return ctrlResponse{}
+}
+
+func (s *Simulator) sendVideoState() error {
+	s.mu.Lock()
+	state := s.videoState
+	s.mu.Unlock()
+	return s.write(ctrlResponse{Event: "video_input_state", Data: state})
+}
+
+// SetSignal simulates plugging or unplugging the HDMI source. reason is one
+// of no_signal, no_lock or out_of_range when ready is false.
+func (s *Simulator) SetSignal(ready bool, reason string) {
+	s.mu.Lock()
+	s.videoState.Ready = ready
+	s.videoState.Error = ""
+	if !ready {
+		s.videoState.Error = reason
+	}
+	s.mu.Unlock()
+	if err := s.sendVideoState(); err != nil {
+		log.Printf("failed to send video state: %v", err)
+	}
+}
+
+func (s *Simulator) SignalReady() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.videoState.Ready
+}
+
+// serveVideo writes one picture per packet at the configured frame rate
+// while the app has video started and the simulated signal is present
+func (s *Simulator) serveVideo(ctx context.Context, conn net.Conn) error {
+	if len(s.units) == 0 {
+		// nothing to stream, keep the connection open like an idle encoder
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	// the app never writes to the video socket, a failed read means it closed
+	closed := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		closed <- err
+	}()
+
+	// a packet must fit the send buffer, keyframes can be large
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		_ = unixConn.SetWriteBuffer(maxPictureSize)
+	}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / s.config.FPS))
+	defer ticker.Stop()
+	next := 0
+	wasStreaming := false
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-closed:
+			return err
+		case <-s.keyframeRequested:
+			next = s.keyframeBefore(next)
+			continue
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		streaming := s.streaming && s.videoState.Ready
+		s.mu.Unlock()
+		if !streaming {
+			wasStreaming = false
+			continue
+		}
+		if !wasStreaming {
+			// an encoder always starts with a keyframe
+			next = s.keyframeBefore(next)
+			wasStreaming = true
+		}
+		if _, err := conn.Write(s.units[next].data); err != nil {
+			if !errors.Is(err, syscall.EMSGSIZE) {
+				return err
+			}
+			log.Printf("picture %d of %d bytes exceeds the socket buffer, skipped", next, len(s.units[next].data))
+		}
+		next = (next + 1) % len(s.units)
+	}
+}
+
+// keyframeBefore returns the index of the last keyframe at or before i, the
+// file starts with one
+func (s *Simulator) keyframeBefore(i int) int {
+	for ; i > 0; i-- {
+		if s.units[i].keyframe {
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,289 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// ISO9660 layout follows ECMA-119, with a Joliet supplementary volume
+// descriptor so the original (long, lower case) file names are preserved.
+
+const (
+	isoSectorSize = 2048
+	// the first 16 sectors are the system area
+	isoDescriptorsStart = 16
+
+	isoDescriptorPrimary       = 1
+	isoDescriptorSupplementary = 2
+	isoDescriptorTerminator    = 255
+
+	isoFlagDirectory = 0x02
+
+	jolietMaxNameLength = 64
+)
+
+func putBothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:], v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+func putBothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b[0:], v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+// isoName returns the level 1 file identifier (8.3 upper case d-characters)
+func isoName(name string) string {
+	clean := func(s string, maxLength int) string {
+		var b strings.Builder
+		for _, r := range strings.ToUpper(s) {
+			if b.Len() == maxLength {
+				break
+			}
+			if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+				b.WriteRune(r)
+			} else {
+				b.WriteRune('_')
+			}
+		}
+		return b.String()
+	}
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	return clean(base, 8) + "." + clean(ext, 3) + ";1"
+}
+
+// isoIdentifierLess orders file identifiers in a directory as ECMA-119 9.3
+// requires: by name, then by extension, the shorter one padded with spaces
+func isoIdentifierLess(a, b string) bool {
+	split := func(identifier string) (string, string) {
+		identifier, _, _ = strings.Cut(identifier, ";")
+		if i := strings.LastIndex(identifier, "."); i >= 0 {
+			return identifier[:i], identifier[i+1:]
+		}
+		return identifier, ""
+	}
+	pad := func(x, y string) (string, string) {
+		for len(x) < len(y) {
+			x += " "
+		}
+		for len(y) < len(x) {
+			y += " "
+		}
+		return x, y
+	}
+	nameA, extA := split(a)
+	nameB, extB := split(b)
+	if nameA != nameB {
+		nameA, nameB = pad(nameA, nameB)
+		return nameA < nameB
+	}
+	extA, extB = pad(extA, extB)
+	return extA < extB
+}
+
+func jolietName(name string) []byte {
+	units := utf16.Encode([]rune(name))
+	if len(units) > jolietMaxNameLength {
+		units = units[:jolietMaxNameLength]
+	}
+	b := make([]byte, len(units)*2)
+	for i, u := range units {
+		binary.BigEndian.PutUint16(b[i*2:], u)
+	}
+	return b
+}
+
+// putISOText fills a fixed size text field, padded with spaces
+func putISOText(b []byte, text string, joliet bool) {
+	if !joliet {
+		copy(b, text+strings.Repeat(" ", len(b)))
+		return
+	}
+	for i := 0; i+1 < len(b); i += 2 {
+		b[i], b[i+1] = 0x00, 0x20
+	}
+	copy(b, jolietName(text))
+}
+
+func isoRecordingDate(t time.Time) []byte {
+	return []byte{
+		byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()),
+		byte(t.Hour()), byte(t.Minute()), byte(t.Second()),
+		0, // UTC
+	}
+}
+
+func isoVolumeDate(t time.Time) []byte {
+	b := []byte(t.Format("20060102150405") + "00")
+	return append(b, 0)
+}
+
+func isoDirectoryRecord(identifier []byte, extent uint32, size uint32, flags byte, now time.Time) []byte {
+	length := 33 + len(identifier)
+	if length%2 != 0 {
+		length++
+	}
+	record := make([]byte, length)
+	record[0] = byte(length)
+	putBothEndian32(record[2:], extent)
+	putBothEndian32(record[10:], size)
+	copy(record[18:25], isoRecordingDate(now))
+	record[25] = flags
+	putBothEndian16(record[28:], 1)
+	record[32] = byte(len(identifier))
+	copy(record[33:], identifier)
+	return record
+}
+
+func isoPathTable(rootExtent uint32, bigEndian bool) []byte {
+	table := make([]byte, 10)
+	table[0] = 1
+	if bigEndian {
+		binary.BigEndian.PutUint32(table[2:], rootExtent)
+		binary.BigEndian.PutUint16(table[6:], 1)
+	} else {
+		binary.LittleEndian.PutUint32(table[2:], rootExtent)
+		binary.LittleEndian.PutUint16(table[6:], 1)
+	}
+	return table
+}
+
+// writeISO9660 writes an ISO9660 image holding files in its root directory
+// to w and returns the image size. Only a single root directory sector is
+// supported, which is plenty for seed images.
+func writeISO9660(w io.WriterAt, volumeID string, files []imageFile) (int64, error) {
+	now := time.Now().UTC()
+
+	// fixed layout: descriptors, path tables, then one root directory per descriptor
+	const (
+		primaryLBA       = isoDescriptorsStart
+		jolietLBA        = primaryLBA + 1
+		terminatorLBA    = jolietLBA + 1
+		pathTableLLBA    = terminatorLBA + 1
+		pathTableMLBA    = pathTableLLBA + 1
+		jolietPathLLBA   = pathTableMLBA + 1
+		jolietPathMLBA   = jolietPathLLBA + 1
+		primaryRootLBA   = jolietPathMLBA + 1
+		jolietRootLBA    = primaryRootLBA + 1
+		firstFileDataLBA = jolietRootLBA + 1
+	)
+
+	extents := make([]uint32, len(files))
+	nextLBA := uint32(firstFileDataLBA)
+	for i, file := range files {
+		extents[i] = nextLBA
+		nextLBA += uint32((len(file.Data) + isoSectorSize - 1) / isoSectorSize)
+	}
+	volumeSectors := nextLBA
+
+	buildRoot := func(rootLBA uint32, joliet bool) ([]byte, error) {
+		root := isoDirectoryRecord([]byte{0x00}, rootLBA, isoSectorSize, isoFlagDirectory, now)
+		root = append(root, isoDirectoryRecord([]byte{0x01}, rootLBA, isoSectorSize, isoFlagDirectory, now)...)
+		name := func(file imageFile) string {
+			if joliet {
+				return file.Name
+			}
+			return isoName(file.Name)
+		}
+		order := make([]int, len(files))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return isoIdentifierLess(name(files[order[i]]), name(files[order[j]]))
+		})
+		for _, i := range order {
+			identifier := []byte(isoName(files[i].Name))
+			if joliet {
+				identifier = jolietName(files[i].Name)
+			}
+			root = append(root, isoDirectoryRecord(identifier, extents[i], uint32(len(files[i].Data)), 0, now)...)
+		}
+		if len(root) > isoSectorSize {
+			return nil, errors.New("too many files for the root directory")
+		}
+		return root, nil
+	}
+
+	descriptor := func(descriptorType byte, rootLBA, pathL, pathM uint32, joliet bool) []byte {
+		d := make([]byte, isoSectorSize)
+		d[0] = descriptorType
+		copy(d[1:], "CD001")
+		d[6] = 1
+		putISOText(d[8:40], "LINUX", joliet)
+		putISOText(d[40:72], volumeID, joliet)
+		putBothEndian32(d[80:], volumeSectors)
+		if joliet {
+			// UCS-2 level 3 escape sequence
+			copy(d[88:], "%/E")
+		}
+		putBothEndian16(d[120:], 1)
+		putBothEndian16(d[124:], 1)
+		putBothEndian16(d[128:], isoSectorSize)
+		putBothEndian32(d[132:], 10)
+		binary.LittleEndian.PutUint32(d[140:], pathL)
+		binary.BigEndian.PutUint32(d[148:], pathM)
+		copy(d[156:190], isoDirectoryRecord([]byte{0x00}, rootLBA, isoSectorSize, isoFlagDirectory, now))
+		for _, field := range [][]byte{d[190:318], d[318:446], d[446:574], d[574:702], d[702:739], d[739:776], d[776:813]} {
+			putISOText(field, "", joliet)
+		}
+		putISOText(d[446:574], "JETKVM", joliet)
+		copy(d[813:830], isoVolumeDate(now))
+		copy(d[830:847], isoVolumeDate(now))
+		copy(d[847:864], "0000000000000000")
+		copy(d[864:881], "0000000000000000")
+		d[881] = 1
+		return d
+	}
+
+	primaryRoot, err := buildRoot(primaryRootLBA, false)
+	if err != nil {
+		return 0, err
+	}
+	jolietRoot, err := buildRoot(jolietRootLBA, true)
+	if err != nil {
+		return 0, err
+	}
+
+	terminator := make([]byte, isoSectorSize)
+	terminator[0] = isoDescriptorTerminator
+	copy(terminator[1:], "CD001")
+	terminator[6] = 1
+
+	sectors := []struct {
+		lba  uint32
+		data []byte
+	}{
+		{primaryLBA, descriptor(isoDescriptorPrimary, primaryRootLBA, pathTableLLBA, pathTableMLBA, false)},
+		{jolietLBA, descriptor(isoDescriptorSupplementary, jolietRootLBA, jolietPathLLBA, jolietPathMLBA, true)},
+		{terminatorLBA, terminator},
+		{pathTableLLBA, isoPathTable(primaryRootLBA, false)},
+		{pathTableMLBA, isoPathTable(primaryRootLBA, true)},
+		{jolietPathLLBA, isoPathTable(jolietRootLBA, false)},
+		{jolietPathMLBA, isoPathTable(jolietRootLBA, true)},
+		{primaryRootLBA, primaryRoot},
+		{jolietRootLBA, jolietRoot},
+	}
+	for i, file := range files {
+		sectors = append(sectors, struct {
+			lba  uint32
+			data []byte
+		}{extents[i], file.Data})
+	}
+	for _, sector := range sectors {
+		if _, err := w.WriteAt(sector.data, int64(sector.lba)*isoSectorSize); err != nil {
+			return 0, fmt.Errorf("failed to write sector %d: %w", sector.lba, err)
+		}
+	}
+
+	return int64(volumeSectors) * isoSectorSize, nil
+}
@@ -2,6 +2,7 @@ package kvm
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pion/webrtc/v4"
@@ -78,6 +80,16 @@ func writeJSONRPCEvent(event string, params interface{}, session *Session) {
 	}
 }
 
+// broadcastJSONRPCEvent sends an event to every connected session with an
+// RPC channel
+func broadcastJSONRPCEvent(event string, params interface{}) {
+	for _, session := range sessions.list() {
+		if session.RPCChannel != nil {
+			writeJSONRPCEvent(event, params, session)
+		}
+	}
+}
+
 func onRPCMessage(message webrtc.DataChannelMessage, session *Session) {
 	var request JSONRPCRequest
 	err := json.Unmarshal(message.Data, &request)
@@ -109,7 +121,26 @@ func onRPCMessage(message webrtc.DataChannelMessage, session *Session) {
 		return
 	}
 
-	result, err := callRPCHandler(handler, request.Params)
+	if handler.RequiresControl && !sessions.hasControl(session) {
+		errorResponse := JSONRPCResponse{
+			JSONRPC: "2.0",
+			Error: map[string]interface{}{
+				"code":    -32000,
+				"message": "Control required",
+				"data":    errControlRequired.Error(),
+			},
+			ID: request.ID,
+		}
+		writeJSONRPCResponse(errorResponse, session)
+		return
+	}
+	// input and other actions on the host keep the session from going idle,
+	// background polling does not
+	if handler.RequiresControl {
+		session.markActivity()
+	}
+
+	result, err := callRPCHandler(handler, request.Params, session)
 	if err != nil {
 		errorResponse := JSONRPCResponse{
 			JSONRPC: "2.0",
@@ -184,8 +215,17 @@ func rpcGetEDID() (string, error) {
 func rpcSetEDID(edid string) error {
 	if edid == "" {
 		log.Println("Restoring EDID to default")
-		edid = "00ffffffffffff0052620188008888881c150103800000780a0dc9a05747982712484c00000001010101010101010101010101010101023a801871382d40582c4500c48e2100001e011d007251d01e206e285500c48e2100001e000000fc00543734392d6648443732300a20000000fd00147801ff1d000a202020202020017b"
+		edid = defaultEDID
 	} else {
+		data, err := parseEDIDHex(edid)
+		if err != nil {
+			return err
+		}
+		edid = strings.Join(strings.Fields(edid), "")
+		if repaired := repairEDIDChecksums(data); len(repaired) > 0 {
+			logger.Warnf("repaired the checksum of EDID blocks %v", repaired)
+			edid = hex.EncodeToString(data)
+		}
 		log.Printf("Setting EDID to: %s", edid)
 	}
 	_, err := CallCtrlAction("set_edid", map[string]interface{}{"edid": edid})
@@ -375,7 +415,7 @@ func rpcSetSSHKeyState(sshKey string) error {
 	return nil
 }
 
-func callRPCHandler(handler RPCHandler, params map[string]interface{}) (interface{}, error) {
+func callRPCHandler(handler RPCHandler, params map[string]interface{}, session *Session) (interface{}, error) {
 	handlerValue := reflect.ValueOf(handler.Func)
 	handlerType := handlerValue.Type()
 
@@ -388,13 +428,20 @@ func callRPCHandler(handler RPCHandler, params map[string]interface{}) (interfac
 	// Get the parameter names from the RPCHandler
 	paramNames := handler.Params
 
-	if len(paramNames) != numParams {
+	// handlers taking a *Session first get the calling session
+	first := 0
+	if numParams > 0 && handlerType.In(0) == reflect.TypeOf(session) {
+		args[0] = reflect.ValueOf(session)
+		first = 1
+	}
+
+	if len(paramNames) != numParams-first {
 		return nil, errors.New("mismatch between handler parameters and defined parameter names")
 	}
 
-	for i := 0; i < numParams; i++ {
+	for i := first; i < numParams; i++ {
 		paramType := handlerType.In(i)
-		paramName := paramNames[i]
+		paramName := paramNames[i-first]
 		paramValue, ok := params[paramName]
 		if !ok {
 			return nil, errors.New("missing parameter: " + paramName)
@@ -475,6 +522,9 @@ func callRPCHandler(handler RPCHandler, params map[string]interface{}) (interfac
 type RPCHandler struct {
 	Func   interface{}
 	Params []string
+	// RequiresControl handlers act on the host or change the device state,
+	// they are refused to sessions without control
+	RequiresControl bool
 }
 
 func rpcSetMassStorageMode(mode string) (string, error) {
@@ -765,62 +815,123 @@ func rpcSetCloudUrl(apiUrl string, appUrl string) error {
 }
 
 var rpcHandlers = map[string]RPCHandler{
-	"ping":                   {Func: rpcPing},
-	"getDeviceID":            {Func: rpcGetDeviceID},
-	"deregisterDevice":       {Func: rpcDeregisterDevice},
-	"getCloudState":          {Func: rpcGetCloudState},
-	"keyboardReport":         {Func: rpcKeyboardReport, Params: []string{"modifier", "keys"}},
-	"absMouseReport":         {Func: rpcAbsMouseReport, Params: []string{"x", "y", "buttons"}},
-	"wheelReport":            {Func: rpcWheelReport, Params: []string{"wheelY"}},
-	"getVideoState":          {Func: rpcGetVideoState},
-	"getUSBState":            {Func: rpcGetUSBState},
-	"unmountImage":           {Func: rpcUnmountImage},
-	"rpcMountBuiltInImage":   {Func: rpcMountBuiltInImage, Params: []string{"filename"}},
-	"setJigglerState":        {Func: rpcSetJigglerState, Params: []string{"enabled"}},
-	"getJigglerState":        {Func: rpcGetJigglerState},
-	"sendWOLMagicPacket":     {Func: rpcSendWOLMagicPacket, Params: []string{"macAddress"}},
-	"getStreamQualityFactor": {Func: rpcGetStreamQualityFactor},
-	"setStreamQualityFactor": {Func: rpcSetStreamQualityFactor, Params: []string{"factor"}},
-	"getAutoUpdateState":     {Func: rpcGetAutoUpdateState},
-	"setAutoUpdateState":     {Func: rpcSetAutoUpdateState, Params: []string{"enabled"}},
-	"getEDID":                {Func: rpcGetEDID},
-	"setEDID":                {Func: rpcSetEDID, Params: []string{"edid"}},
-	"getDevChannelState":     {Func: rpcGetDevChannelState},
-	"setDevChannelState":     {Func: rpcSetDevChannelState, Params: []string{"enabled"}},
-	"getUpdateStatus":        {Func: rpcGetUpdateStatus},
-	"tryUpdate":              {Func: rpcTryUpdate},
-	"getDevModeState":        {Func: rpcGetDevModeState},
-	"setDevModeState":        {Func: rpcSetDevModeState, Params: []string{"enabled"}},
-	"getSSHKeyState":         {Func: rpcGetSSHKeyState},
-	"setSSHKeyState":         {Func: rpcSetSSHKeyState, Params: []string{"sshKey"}},
-	"setMassStorageMode":     {Func: rpcSetMassStorageMode, Params: []string{"mode"}},
-	"getMassStorageMode":     {Func: rpcGetMassStorageMode},
-	"isUpdatePending":        {Func: rpcIsUpdatePending},
-	"getUsbEmulationState":   {Func: rpcGetUsbEmulationState},
-	"setUsbEmulationState":   {Func: rpcSetUsbEmulationState, Params: []string{"enabled"}},
-	"getUsbConfig":           {Func: rpcGetUsbConfig},
-	"setUsbConfig":           {Func: rpcSetUsbConfig, Params: []string{"usbConfig"}},
-	"checkMountUrl":          {Func: rpcCheckMountUrl, Params: []string{"url"}},
-	"getVirtualMediaState":   {Func: rpcGetVirtualMediaState},
-	"getStorageSpace":        {Func: rpcGetStorageSpace},
-	"mountWithHTTP":          {Func: rpcMountWithHTTP, Params: []string{"url", "mode"}},
-	"mountWithWebRTC":        {Func: rpcMountWithWebRTC, Params: []string{"filename", "size", "mode"}},
-	"mountWithStorage":       {Func: rpcMountWithStorage, Params: []string{"filename", "mode"}},
-	"listStorageFiles":       {Func: rpcListStorageFiles},
-	"deleteStorageFile":      {Func: rpcDeleteStorageFile, Params: []string{"filename"}},
-	"startStorageFileUpload": {Func: rpcStartStorageFileUpload, Params: []string{"filename", "size"}},
-	"getWakeOnLanDevices":    {Func: rpcGetWakeOnLanDevices},
-	"setWakeOnLanDevices":    {Func: rpcSetWakeOnLanDevices, Params: []string{"params"}},
-	"resetConfig":            {Func: rpcResetConfig},
-	"setBacklightSettings":   {Func: rpcSetBacklightSettings, Params: []string{"params"}},
-	"getBacklightSettings":   {Func: rpcGetBacklightSettings},
-	"getDCPowerState":        {Func: rpcGetDCPowerState},
-	"setDCPowerState":        {Func: rpcSetDCPowerState, Params: []string{"enabled"}},
-	"getActiveExtension":     {Func: rpcGetActiveExtension},
-	"setActiveExtension":     {Func: rpcSetActiveExtension, Params: []string{"extensionId"}},
-	"getATXState":            {Func: rpcGetATXState},
-	"setATXPowerAction":      {Func: rpcSetATXPowerAction, Params: []string{"action"}},
-	"getSerialSettings":      {Func: rpcGetSerialSettings},
-	"setSerialSettings":      {Func: rpcSetSerialSettings, Params: []string{"settings"}},
-	"setCloudUrl":            {Func: rpcSetCloudUrl, Params: []string{"apiUrl", "appUrl"}},
+	"ping":                     {Func: rpcPing},
+	"getDeviceID":              {Func: rpcGetDeviceID},
+	"deregisterDevice":         {Func: rpcDeregisterDevice, RequiresControl: true},
+	"getCloudState":            {Func: rpcGetCloudState},
+	"keyboardReport":           {Func: rpcKeyboardReport, Params: []string{"modifier", "keys"}, RequiresControl: true},
+	"absMouseReport":           {Func: rpcAbsMouseReport, Params: []string{"x", "y", "buttons"}, RequiresControl: true},
+	"wheelReport":              {Func: rpcWheelReport, Params: []string{"wheelY"}, RequiresControl: true},
+	"getVideoState":            {Func: rpcGetVideoState},
+	"getUSBState":              {Func: rpcGetUSBState},
+	"unmountImage":             {Func: rpcUnmountImage, RequiresControl: true},
+	"rpcMountBuiltInImage":     {Func: rpcMountBuiltInImage, Params: []string{"filename"}, RequiresControl: true},
+	"setJigglerState":          {Func: rpcSetJigglerState, Params: []string{"enabled"}, RequiresControl: true},
+	"getJigglerState":          {Func: rpcGetJigglerState},
+	"sendWOLMagicPacket":       {Func: rpcSendWOLMagicPacket, Params: []string{"macAddress"}, RequiresControl: true},
+	"getStreamQualityFactor":   {Func: rpcGetStreamQualityFactor},
+	"setStreamQualityFactor":   {Func: rpcSetStreamQualityFactor, Params: []string{"factor"}, RequiresControl: true},
+	"getAutoUpdateState":       {Func: rpcGetAutoUpdateState},
+	"setAutoUpdateState":       {Func: rpcSetAutoUpdateState, Params: []string{"enabled"}, RequiresControl: true},
+	"getEDID":                  {Func: rpcGetEDID},
+	"setEDID":                  {Func: rpcSetEDID, Params: []string{"edid"}, RequiresControl: true},
+	"getEDIDInfo":              {Func: rpcGetEDIDInfo, Params: []string{"edid"}},
+	"getEDIDPresets":           {Func: rpcGetEDIDPresets},
+	"setEDIDPreset":            {Func: rpcSetEDIDPreset, Params: []string{"id"}, RequiresControl: true},
+	"repairEDID":               {Func: rpcRepairEDID, Params: []string{"edid"}},
+	"buildEDID":                {Func: rpcBuildEDID, Params: []string{"spec"}},
+	"getSavedEDIDs":            {Func: rpcGetSavedEDIDs},
+	"saveEDID":                 {Func: rpcSaveEDID, Params: []string{"name", "edid"}, RequiresControl: true},
+	"deleteSavedEDID":          {Func: rpcDeleteSavedEDID, Params: []string{"name"}, RequiresControl: true},
+	"getDevChannelState":       {Func: rpcGetDevChannelState},
+	"setDevChannelState":       {Func: rpcSetDevChannelState, Params: []string{"enabled"}, RequiresControl: true},
+	"getUpdateStatus":          {Func: rpcGetUpdateStatus},
+	"tryUpdate":                {Func: rpcTryUpdate, RequiresControl: true},
+	"getDevModeState":          {Func: rpcGetDevModeState},
+	"setDevModeState":          {Func: rpcSetDevModeState, Params: []string{"enabled"}, RequiresControl: true},
+	"getSSHKeyState":           {Func: rpcGetSSHKeyState},
+	"setSSHKeyState":           {Func: rpcSetSSHKeyState, Params: []string{"sshKey"}, RequiresControl: true},
+	"setMassStorageMode":       {Func: rpcSetMassStorageMode, Params: []string{"mode"}, RequiresControl: true},
+	"getMassStorageMode":       {Func: rpcGetMassStorageMode},
+	"isUpdatePending":          {Func: rpcIsUpdatePending},
+	"getUsbEmulationState":     {Func: rpcGetUsbEmulationState},
+	"setUsbEmulationState":     {Func: rpcSetUsbEmulationState, Params: []string{"enabled"}, RequiresControl: true},
+	"getUsbConfig":             {Func: rpcGetUsbConfig},
+	"setUsbConfig":             {Func: rpcSetUsbConfig, Params: []string{"usbConfig"}, RequiresControl: true},
+	"checkMountUrl":            {Func: rpcCheckMountUrl, Params: []string{"url"}},
+	"getVirtualMediaState":     {Func: rpcGetVirtualMediaState},
+	"getVirtualMediaActivity":  {Func: rpcGetVirtualMediaActivity},
+	"getVirtualMediaAutoEject": {Func: rpcGetVirtualMediaAutoEject},
+	"setVirtualMediaAutoEject": {Func: rpcSetVirtualMediaAutoEject, Params: []string{"params"}, RequiresControl: true},
+	"getStorageSpace":          {Func: rpcGetStorageSpace},
+	"mountWithHTTP":            {Func: rpcMountWithHTTP, Params: []string{"url", "mode"}, RequiresControl: true},
+	"mountWithWebRTC":          {Func: rpcMountWithWebRTC, Params: []string{"filename", "size", "mode"}, RequiresControl: true},
+	"mountWithStorage":         {Func: rpcMountWithStorage, Params: []string{"filename", "mode"}, RequiresControl: true},
+	"listStorageFiles":         {Func: rpcListStorageFiles},
+	"deleteStorageFile":        {Func: rpcDeleteStorageFile, Params: []string{"filename"}, RequiresControl: true},
+	"createStorageImage":       {Func: rpcCreateStorageImage, Params: []string{"name", "size", "format"}, RequiresControl: true},
+	"mountCompositeDisk":       {Func: rpcMountCompositeDisk, Params: []string{"params"}, RequiresControl: true},
+	"createSeedImage":          {Func: rpcCreateSeedImage, Params: []string{"params"}, RequiresControl: true},
+	"unmountSeedImage":         {Func: rpcUnmountSeedImage, RequiresControl: true},
+	"getSeedImageState":        {Func: rpcGetSeedImageState},
+	"startStorageFileUpload":   {Func: rpcStartStorageFileUpload, Params: []string{"filename", "size"}, RequiresControl: true},
+	"getWakeOnLanDevices":      {Func: rpcGetWakeOnLanDevices},
+	"setWakeOnLanDevices":      {Func: rpcSetWakeOnLanDevices, Params: []string{"params"}, RequiresControl: true},
+	"resetConfig":              {Func: rpcResetConfig, RequiresControl: true},
+	"setBacklightSettings":     {Func: rpcSetBacklightSettings, Params: []string{"params"}, RequiresControl: true},
+	"getBacklightSettings":     {Func: rpcGetBacklightSettings},
+	"startRecording":           {Func: rpcStartRecording, RequiresControl: true},
+	"stopRecording":            {Func: rpcStopRecording, RequiresControl: true},
+	"getRecordingState":        {Func: rpcGetRecordingState},
+	"listRecordings":           {Func: rpcListRecordings},
+	"deleteRecording":          {Func: rpcDeleteRecording, Params: []string{"filename"}, RequiresControl: true},
+	"getRecordingSettings":     {Func: rpcGetRecordingSettings},
+	"setRecordingSettings":     {Func: rpcSetRecordingSettings, Params: []string{"params"}, RequiresControl: true},
+	"getAdaptiveQuality":       {Func: rpcGetAdaptiveQuality},
+	"setAdaptiveQuality":       {Func: rpcSetAdaptiveQuality, Params: []string{"params"}, RequiresControl: true},
+	"getAdaptiveQualityState":  {Func: rpcGetAdaptiveQualityState},
+	"getWHEPToken":             {Func: rpcGetWHEPToken},
+	"generateWHEPToken":        {Func: rpcGenerateWHEPToken, RequiresControl: true},
+	"clearWHEPToken":           {Func: rpcClearWHEPToken, RequiresControl: true},
+	"getRTSPServerConfig":      {Func: rpcGetRTSPServerConfig},
+	"setRTSPServerConfig":      {Func: rpcSetRTSPServerConfig, Params: []string{"params"}, RequiresControl: true},
+	"getRTSPServerState":       {Func: rpcGetRTSPServerState},
+	"getStreamOutputConfig":    {Func: rpcGetStreamOutputConfig},
+	"startStreamOutput":        {Func: rpcStartStreamOutput, Params: []string{"url"}, RequiresControl: true},
+	"stopStreamOutput":         {Func: rpcStopStreamOutput, RequiresControl: true},
+	"getStreamOutputState":     {Func: rpcGetStreamOutputState},
+	"getVideoStateHistory":     {Func: rpcGetVideoStateHistory},
+	"getSignalLossAlert":       {Func: rpcGetSignalLossAlert},
+	"setSignalLossAlert":       {Func: rpcSetSignalLossAlert, Params: []string{"params"}, RequiresControl: true},
+	"getNativeStatus":          {Func: rpcGetNativeStatus},
+	"getNativeLogs":            {Func: rpcGetNativeLogs},
+	"restartNative":            {Func: rpcRestartNative, RequiresControl: true},
+	"getDCPowerState":          {Func: rpcGetDCPowerState},
+	"setDCPowerState":          {Func: rpcSetDCPowerState, Params: []string{"enabled"}, RequiresControl: true},
+	"getActiveExtension":       {Func: rpcGetActiveExtension},
+	"setActiveExtension":       {Func: rpcSetActiveExtension, Params: []string{"extensionId"}, RequiresControl: true},
+	"getATXState":              {Func: rpcGetATXState},
+	"setATXPowerAction":        {Func: rpcSetATXPowerAction, Params: []string{"action"}, RequiresControl: true},
+	"getSerialSettings":        {Func: rpcGetSerialSettings},
+	"setSerialSettings":        {Func: rpcSetSerialSettings, Params: []string{"settings"}, RequiresControl: true},
+	"setCloudUrl":              {Func: rpcSetCloudUrl, Params: []string{"apiUrl", "appUrl"}, RequiresControl: true},
+	"getControlState":          {Func: rpcGetControlState, Params: []string{}},
+	"requestControl":           {Func: rpcRequestControl, Params: []string{}},
+	"releaseControl":           {Func: rpcReleaseControl, Params: []string{}},
+	"respondTakeover":          {Func: rpcRespondTakeover, Params: []string{"requestId", "approve"}},
+	"forceTakeover":            {Func: rpcForceTakeover, Params: []string{}},
+	"renegotiate":              {Func: rpcRenegotiate, Params: []string{"sd"}},
+	"setICERestartAnswer":      {Func: rpcSetICERestartAnswer, Params: []string{"sd"}},
+	"restartICE":               {Func: rpcRestartICE, Params: []string{}},
+	"listSessions":             {Func: rpcListSessions},
+	"terminateSession":         {Func: rpcTerminateSession, Params: []string{"id"}},
+	"keepSessionAlive":         {Func: rpcKeepSessionAlive, Params: []string{}},
+	"getSessionPolicy":         {Func: rpcGetSessionPolicy},
+	"setSessionPolicy":         {Func: rpcSetSessionPolicy, Params: []string{"params"}, RequiresControl: true},
+	"getWebRTCNetworkConfig":   {Func: rpcGetWebRTCNetworkConfig},
+	"setWebRTCNetworkConfig":   {Func: rpcSetWebRTCNetworkConfig, Params: []string{"params"}, RequiresControl: true},
+	"getTakeoverConfig":        {Func: rpcGetTakeoverConfig},
+	"setTakeoverConfig":        {Func: rpcSetTakeoverConfig, Params: []string{"params"}, RequiresControl: true},
+	"getMultiSession":          {Func: rpcGetMultiSession},
+	"setMultiSession":          {Func: rpcSetMultiSession, Params: []string{"enabled"}, RequiresControl: true},
 }
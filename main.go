@@ -35,12 +35,18 @@ func Main() {
 
 	StartNativeCtrlSocketServer()
 	StartNativeVideoSocketServer()
+	go runAdaptiveQualityLoop()
+	go runSessionPolicy()
+	startRTSPServer()
+	startStreamOutput()
 
 	go func() {
 		err = ExtractAndRunNativeBin()
 		if err != nil {
 			logger.Errorf("failed to extract and run native bin: %v", err)
-			//TODO: prepare an error message screen buffer to show on kvm screen
+			if err := showFailureScreen("JetKVM failed to start", err.Error()); err != nil {
+				logger.Warnf("failed to show failure screen: %v", err)
+			}
 		}
 	}()
 
@@ -51,7 +57,7 @@ func Main() {
 			if config.AutoUpdateEnabled == false {
 				return
 			}
-			if currentSession != nil {
+			if hasActiveSessions() {
 				logger.Debugf("skipping update since a session is active")
 				time.Sleep(1 * time.Minute)
 				continue
@@ -0,0 +1,180 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// A single program MPEG transport stream muxer (ISO/IEC 13818-1) carrying
+// one H.264 stream, as expected by SRT ingest.
+
+const (
+	tsPacketSize  = 188
+	tsPIDPAT      = 0x0000
+	tsPIDPMT      = 0x1000
+	tsPIDVideo    = 0x0100
+	tsStreamH264  = 0x1b
+	tsStreamIDVid = 0xe0
+	tsClockRate   = 90000
+	// presentation lags the program clock so decoders can buffer
+	tsPTSOffset = tsClockRate / 2
+)
+
+// tsCRC32 is the MPEG-2 CRC used by PSI sections: polynomial 0x04C11DB7,
+// not reflected, initial value 0xffffffff
+func tsCRC32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+type tsMuxer struct {
+	w          io.Writer
+	continuity map[uint16]byte
+	time       time.Duration
+}
+
+func newTSMuxer(w io.Writer) *tsMuxer {
+	return &tsMuxer{w: w, continuity: make(map[uint16]byte)}
+}
+
+// psiSection wraps a table in a single packet payload with pointer field and CRC
+func psiSection(tableID byte, tableIDExtension uint16, body []byte) []byte {
+	section := []byte{tableID, 0, 0}
+	section = binary.BigEndian.AppendUint16(section, tableIDExtension)
+	section = append(section, 0xc1, 0, 0) // version 0, current, section 0 of 0
+	section = append(section, body...)
+	length := len(section) - 3 + 4
+	section[1] = 0xb0 | byte(length>>8) // section syntax indicator
+	section[2] = byte(length)
+	section = binary.BigEndian.AppendUint32(section, tsCRC32(section))
+	return append([]byte{0}, section...)
+}
+
+func (m *tsMuxer) writeTables() error {
+	pat := psiSection(0x00, 1, []byte{0x00, 0x01, 0xe0 | tsPIDPMT>>8, tsPIDPMT & 0xff})
+	pmt := psiSection(0x02, 1, []byte{
+		0xe0 | tsPIDVideo>>8, tsPIDVideo & 0xff, // PCR PID
+		0xf0, 0x00, // no program info
+		tsStreamH264, 0xe0 | tsPIDVideo>>8, tsPIDVideo & 0xff, 0xf0, 0x00,
+	})
+	if err := m.writePackets(tsPIDPAT, pat, false, -1); err != nil {
+		return err
+	}
+	return m.writePackets(tsPIDPMT, pmt, false, -1)
+}
+
+func tsTimestamp(prefix byte, ts uint64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>29)&0x0e | 1,
+		byte(ts >> 22),
+		byte(ts>>14) | 1,
+		byte(ts >> 7),
+		byte(ts<<1) | 1,
+	}
+}
+
+// WriteSample muxes an Annex B access unit. Keyframes are preceded by the
+// tables and carry the parameter sets, so a receiver can join at any of them.
+func (m *tsMuxer) WriteSample(nals [][]byte, sps []byte, pps []byte, duration time.Duration, keyframe bool) error {
+	dts := uint64(m.time * tsClockRate / time.Second)
+	m.time += duration
+
+	if keyframe {
+		if err := m.writeTables(); err != nil {
+			return err
+		}
+	}
+
+	es := []byte{0, 0, 0, 1, h264NALAUD, 0xf0}
+	if keyframe {
+		for _, nal := range [][]byte{sps, pps} {
+			es = append(es, 0, 0, 0, 1)
+			es = append(es, nal...)
+		}
+	}
+	for _, nal := range nals {
+		switch h264NALType(nal) {
+		case h264NALAUD, h264NALSPS, h264NALPPS:
+			continue
+		}
+		es = append(es, 0, 0, 0, 1)
+		es = append(es, nal...)
+	}
+
+	// video PES packets may leave the length unbounded
+	pes := []byte{0, 0, 1, tsStreamIDVid, 0, 0, 0x80, 0x80, 5}
+	pes = append(pes, tsTimestamp(2, dts+tsPTSOffset)...)
+	pes = append(pes, es...)
+	return m.writePackets(tsPIDVideo, pes, keyframe, int64(dts))
+}
+
+// writePackets splits a payload into transport packets. A pcr >= 0 is
+// carried in the first packet's adaptation field.
+func (m *tsMuxer) writePackets(pid uint16, payload []byte, randomAccess bool, pcr int64) error {
+	buf := make([]byte, 0, (len(payload)/(tsPacketSize-4)+2)*tsPacketSize)
+	first := true
+	for first || len(payload) > 0 {
+		packet := make([]byte, 4, tsPacketSize)
+		packet[0] = 0x47
+		packet[1] = byte(pid >> 8)
+		if first {
+			packet[1] |= 0x40 // payload unit start
+		}
+		packet[2] = byte(pid)
+		cc := m.continuity[pid]
+		m.continuity[pid] = (cc + 1) & 0x0f
+
+		var adaptation []byte
+		if first && (randomAccess || pcr >= 0) {
+			flags := byte(0)
+			if randomAccess {
+				flags |= 0x40
+			}
+			adaptation = []byte{0, flags}
+			if pcr >= 0 {
+				adaptation[1] |= 0x10
+				base := uint64(pcr)
+				adaptation = append(adaptation,
+					byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1), byte(base<<7)|0x7e, 0)
+			}
+		}
+		space := tsPacketSize - 4 - len(adaptation)
+		if len(payload) < space {
+			// stuffing goes in the adaptation field
+			if adaptation == nil {
+				adaptation = []byte{0}
+				if space-len(payload) > 1 {
+					adaptation = append(adaptation, 0)
+				}
+			}
+			for len(adaptation) < tsPacketSize-4-len(payload) {
+				adaptation = append(adaptation, 0xff)
+			}
+			space = len(payload)
+		}
+		if adaptation != nil {
+			adaptation[0] = byte(len(adaptation) - 1)
+			packet[3] = 0x30 | cc
+			packet = append(packet, adaptation...)
+		} else {
+			packet[3] = 0x10 | cc
+		}
+		packet = append(packet, payload[:space]...)
+		payload = payload[space:]
+		buf = append(buf, packet...)
+		first = false
+	}
+	_, err := m.w.Write(buf)
+	return err
+}
@@ -9,9 +9,7 @@ import (
 	"log"
 	"net"
 	"os"
-	"os/exec"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/pion/webrtc/v4/pkg/media"
@@ -95,6 +93,8 @@ var nativeCtrlSocketListener net.Listener
 var nativeVideoSocketListener net.Listener
 
 var ctrlClientConnected = make(chan struct{})
+var ctrlClientConnectedOnce sync.Once
+var ctrlClientConnects = 0
 
 func waitCtrlClientConnected() {
 	<-ctrlClientConnected
@@ -115,17 +115,22 @@ func StartNativeSocketServer(socketPath string, handleClient func(net.Conn), isC
 
 	log.Printf("Server listening on %s", socketPath)
 
+	// jetkvm_native connects again each time the supervisor restarts it
 	go func() {
-		conn, err := listener.Accept()
-		listener.Close()
-		if err != nil {
-			logger.Errorf("failed to accept sock: %v", err)
-		}
-		if isCtrl {
-			close(ctrlClientConnected)
-			logger.Debug("first native ctrl socket client connected")
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				logger.Errorf("failed to accept sock: %v", err)
+				return
+			}
+			if isCtrl {
+				ctrlClientConnectedOnce.Do(func() {
+					close(ctrlClientConnected)
+					logger.Debug("first native ctrl socket client connected")
+				})
+			}
+			go handleClient(conn)
 		}
-		handleClient(conn)
 	}()
 
 	return listener
@@ -151,9 +156,15 @@ func handleCtrlClient(conn net.Conn) {
 	}
 
 	ctrlSocketConn = conn
+	ctrlClientConnects++
 
 	// Restore HDMI EDID if applicable
 	go restoreHdmiEdid()
+	if ctrlClientConnects > 1 {
+		go restoreNativeState()
+	} else {
+		go restoreVideo()
+	}
 
 	readBuf := make([]byte, 4096)
 	for {
@@ -183,76 +194,208 @@ func handleCtrlClient(conn net.Conn) {
 	}
 
 	logger.Debug("ctrl sock disconnected")
+	if ctrlSocketConn == conn {
+		ctrlSocketConn = nil
+	}
 }
 
-func handleVideoClient(conn net.Conn) {
-	defer conn.Close()
+const (
+	videoSubscriberQueueSize = 32
+	// the cached GOP is dropped when it grows past these limits, new
+	// subscribers then wait for the next keyframe
+	videoGOPMaxSamples = 600
+	videoGOPMaxBytes   = 8 * 1024 * 1024
+	// replayed samples are sent back to back so the decoder catches up to live
+	videoReplaySampleDuration = time.Millisecond
+)
 
-	log.Printf("Native video socket client connected: %v", conn.RemoteAddr())
+// videoSubscriber receives the video samples for one consumer, e.g. the
+// track of a WebRTC session, from its own goroutine.
+type videoSubscriber struct {
+	// consumer labels the metrics, e.g. webrtc or rtsp
+	consumer string
+	samples  chan videoSample
+	write    func(media.Sample) error
+	// waitKeyframe is set after dropping samples, decoding can only resume on a keyframe
+	waitKeyframe bool
+	dropped      int64
+}
 
-	inboundPacket := make([]byte, maxFrameSize)
-	lastFrame := time.Now()
-	for {
-		n, err := conn.Read(inboundPacket)
-		if err != nil {
-			log.Println("error during read: %s", err)
-			return
+type videoSample struct {
+	media.Sample
+	keyframe bool
+}
+
+// videoBroadcaster fans the samples from jetkvm_native out to all
+// subscribers. Each subscriber has its own queue, a slow one drops samples
+// instead of stalling the others.
+type videoBroadcaster struct {
+	mu          sync.Mutex
+	subscribers map[*videoSubscriber]struct{}
+
+	// gop holds the samples since the last keyframe, replayed to new
+	// subscribers so they get a picture without waiting for the next one
+	gop      []videoSample
+	gopBytes int
+	gopValid bool
+	sps      []byte
+	pps      []byte
+}
+
+var broadcaster = &videoBroadcaster{subscribers: make(map[*videoSubscriber]struct{})}
+
+func (b *videoBroadcaster) subscribe(consumer string, write func(media.Sample) error) *videoSubscriber {
+	subscriber := &videoSubscriber{
+		consumer: consumer,
+		samples:  make(chan videoSample, videoSubscriberQueueSize),
+		write:    write,
+	}
+	b.mu.Lock()
+	b.subscribers[subscriber] = struct{}{}
+	replay := b.replaySamples()
+	b.mu.Unlock()
+	videoSubscribersGauge.WithLabelValues(consumer).Inc()
+
+	// an up to date keyframe is cheaper for the decoder than a long replay
+	go requestKeyframe()
+
+	go func() {
+		for _, sample := range replay {
+			if err := subscriber.write(sample); err != nil {
+				videoWriteErrorsCounter.WithLabelValues(consumer).Inc()
+				logger.Warnf("error writing replayed sample: %v", err)
+			}
 		}
-		now := time.Now()
-		sinceLastFrame := now.Sub(lastFrame)
-		lastFrame = now
-		//fmt.Println("Video packet received", n, sinceLastFrame)
-		if currentSession != nil {
-			err := currentSession.VideoTrack.WriteSample(media.Sample{Data: inboundPacket[:n], Duration: sinceLastFrame})
-			if err != nil {
-				log.Println("Error writing sample", err)
+		for sample := range subscriber.samples {
+			if err := subscriber.write(sample.Sample); err != nil {
+				videoWriteErrorsCounter.WithLabelValues(consumer).Inc()
+				logger.Warnf("error writing sample: %v", err)
 			}
 		}
-	}
+	}()
+	return subscriber
 }
 
-func ExtractAndRunNativeBin() error {
-	binaryPath := "/userdata/jetkvm/bin/jetkvm_native"
-	if err := ensureBinaryUpdated(binaryPath); err != nil {
-		return fmt.Errorf("failed to extract binary: %w", err)
+func (b *videoBroadcaster) unsubscribe(subscriber *videoSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[subscriber]; !ok {
+		return
 	}
+	delete(b.subscribers, subscriber)
+	close(subscriber.samples)
+	videoSubscribersGauge.WithLabelValues(subscriber.consumer).Dec()
+}
 
-	// Make the binary executable
-	if err := os.Chmod(binaryPath, 0755); err != nil {
-		return fmt.Errorf("failed to make binary executable: %w", err)
-	}
-	// Run the binary in the background
-	cmd := exec.Command(binaryPath)
+// parameterSets returns the last SPS and PPS seen, nil until the encoder sent them
+func (b *videoBroadcaster) parameterSets() (sps []byte, pps []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sps, b.pps
+}
 
-	// Redirect stdout and stderr to the current process
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// replaySamples returns the cached parameter sets and GOP, must be called
+// with b.mu held.
+func (b *videoBroadcaster) replaySamples() []media.Sample {
+	if !b.gopValid || len(b.gop) == 0 {
+		return nil
+	}
+	samples := make([]media.Sample, 0, len(b.gop)+1)
+	// the keyframe may not carry the parameter sets itself
+	if b.sps != nil && b.pps != nil && !bytes.Contains(b.gop[0].Data, b.sps) {
+		var parameterSets []byte
+		for _, nal := range [][]byte{b.sps, b.pps} {
+			parameterSets = append(parameterSets, 0, 0, 0, 1)
+			parameterSets = append(parameterSets, nal...)
+		}
+		samples = append(samples, media.Sample{Data: parameterSets, Duration: 0})
+	}
+	for _, sample := range b.gop {
+		samples = append(samples, media.Sample{Data: sample.Data, Duration: videoReplaySampleDuration})
+	}
+	return samples
+}
 
-	// Set the process group ID so we can kill the process and its children when this process exits
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid:   true,
-		Pdeathsig: syscall.SIGKILL,
+// updateGOP keeps the parameter sets and the samples since the last keyframe,
+// must be called with b.mu held.
+func (b *videoBroadcaster) updateGOP(sample videoSample, nals [][]byte) {
+	for _, nal := range nals {
+		switch h264NALType(nal) {
+		case h264NALSPS:
+			b.sps = append([]byte(nil), nal...)
+		case h264NALPPS:
+			b.pps = append([]byte(nil), nal...)
+		}
+	}
+	if sample.keyframe {
+		clear(b.gop)
+		b.gop = b.gop[:0]
+		b.gopBytes = 0
+		b.gopValid = true
 	}
+	if !b.gopValid {
+		return
+	}
+	b.gop = append(b.gop, sample)
+	b.gopBytes += len(sample.Data)
+	if len(b.gop) > videoGOPMaxSamples || b.gopBytes > videoGOPMaxBytes {
+		clear(b.gop)
+		b.gop = b.gop[:0]
+		b.gopBytes = 0
+		b.gopValid = false
+	}
+}
 
-	// Start the command
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start binary: %w", err)
+// broadcast hands a sample to every subscriber, data is copied once and
+// shared between them.
+func (b *videoBroadcaster) broadcast(data []byte, duration time.Duration) {
+	videoBytesSent.Add(int64(len(data)))
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	nals := splitAnnexB(data)
+	sample := videoSample{
+		Sample:   media.Sample{Data: append([]byte(nil), data...), Duration: duration},
+		keyframe: h264IsKeyframe(nals),
 	}
+	observeVideoFrame(len(data), duration, sample.keyframe)
+	b.updateGOP(sample, nals)
+	for subscriber := range b.subscribers {
+		if subscriber.waitKeyframe {
+			if !sample.keyframe {
+				continue
+			}
+			subscriber.waitKeyframe = false
+		}
+		select {
+		case subscriber.samples <- sample:
+		default:
+			subscriber.dropped++
+			subscriber.waitKeyframe = true
+			videoDroppedSamplesCounter.WithLabelValues(subscriber.consumer).Inc()
+		}
+	}
+}
 
-	//TODO: add auto restart
-	go func() {
-		<-appCtx.Done()
-		logger.Infof("killing process PID: %d", cmd.Process.Pid)
-		err := cmd.Process.Kill()
+func handleVideoClient(conn net.Conn) {
+	defer conn.Close()
+
+	log.Printf("Native video socket client connected: %v", conn.RemoteAddr())
+
+	inboundPacket := make([]byte, maxFrameSize)
+	lastFrame := time.Now()
+	for {
+		n, err := conn.Read(inboundPacket)
 		if err != nil {
-			logger.Errorf("failed to kill process: %v", err)
+			log.Printf("error during read: %s", err)
 			return
 		}
-	}()
-
-	fmt.Printf("Binary started with PID: %d\n", cmd.Process.Pid)
-
-	return nil
+		now := time.Now()
+		sinceLastFrame := now.Sub(lastFrame)
+		lastFrame = now
+		//fmt.Println("Video packet received", n, sinceLastFrame)
+		recorder.WriteSample(inboundPacket[:n], sinceLastFrame)
+		broadcaster.broadcast(inboundPacket[:n], sinceLastFrame)
+	}
 }
 
 func shouldOverwrite(destPath string, srcHash []byte) bool {
@@ -0,0 +1,335 @@
+package kvm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	nativeBinaryPath = "/userdata/jetkvm/bin/jetkvm_native"
+
+	nativeLogBufferLines = 1000
+	nativeMinBackoff     = 1 * time.Second
+	nativeMaxBackoff     = 1 * time.Minute
+	// a process that ran this long is considered healthy, the backoff resets
+	nativeStableUptime = 1 * time.Minute
+	// consecutive crashes before the failure screen is shown
+	nativeFailureScreenCrashes = 3
+)
+
+var (
+	nativeUpGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "jetkvm_native_up",
+		Help: "Whether jetkvm_native is running",
+	})
+	nativeCrashesCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "jetkvm_native_crashes_total",
+		Help: "Number of times jetkvm_native exited unexpectedly",
+	})
+	nativeRestartsCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "jetkvm_native_restarts_total",
+		Help: "Number of times jetkvm_native was restarted",
+	})
+)
+
+type NativeStatus struct {
+	State      string     `json:"state"` // starting, running, crashed, failed, external
+	PID        int        `json:"pid,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	Crashes    int        `json:"crashes"`
+	Restarts   int        `json:"restarts"`
+	LastExit   string     `json:"lastExit,omitempty"`
+	LastExitAt *time.Time `json:"lastExitAt,omitempty"`
+	// NextRestartAt is set while waiting to restart after a crash
+	NextRestartAt *time.Time `json:"nextRestartAt,omitempty"`
+}
+
+type NativeLogLine struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Line   string    `json:"line"`
+}
+
+// nativeLogBuffer keeps the last lines printed by jetkvm_native
+type nativeLogBuffer struct {
+	mu    sync.Mutex
+	lines []NativeLogLine
+	next  int
+}
+
+func (b *nativeLogBuffer) add(stream string, line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry := NativeLogLine{Time: time.Now(), Stream: stream, Line: line}
+	if len(b.lines) < nativeLogBufferLines {
+		b.lines = append(b.lines, entry)
+		return
+	}
+	b.lines[b.next] = entry
+	b.next = (b.next + 1) % nativeLogBufferLines
+}
+
+// snapshot returns the lines oldest first
+func (b *nativeLogBuffer) snapshot() []NativeLogLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := make([]NativeLogLine, 0, len(b.lines))
+	lines = append(lines, b.lines[b.next:]...)
+	return append(lines, b.lines[:b.next]...)
+}
+
+// nativeLogWriter splits the output of one stream into lines for the buffer
+// and still forwards it to our own output
+type nativeLogWriter struct {
+	stream  string
+	out     *os.File
+	buffer  *nativeLogBuffer
+	partial []byte
+}
+
+func (w *nativeLogWriter) Write(p []byte) (int, error) {
+	_, _ = w.out.Write(p)
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.buffer.add(w.stream, string(bytes.TrimRight(w.partial[:i], "\r")))
+		w.partial = w.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+type nativeSupervisor struct {
+	mu      sync.Mutex
+	status  NativeStatus
+	cmd     *exec.Cmd
+	restart chan struct{}
+	logs    nativeLogBuffer
+}
+
+var native = &nativeSupervisor{
+	status:  NativeStatus{State: "starting"},
+	restart: make(chan struct{}, 1),
+}
+
+func (s *nativeSupervisor) setStatus(update func(status *NativeStatus)) {
+	s.mu.Lock()
+	update(&s.status)
+	status := s.status
+	s.mu.Unlock()
+	broadcastJSONRPCEvent("nativeStatus", status)
+}
+
+func (s *nativeSupervisor) getStatus() NativeStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+func (s *nativeSupervisor) start(binaryPath string) (*exec.Cmd, error) {
+	cmd := exec.Command(binaryPath)
+	cmd.Stdout = &nativeLogWriter{stream: "stdout", out: os.Stdout, buffer: &s.logs}
+	cmd.Stderr = &nativeLogWriter{stream: "stderr", out: os.Stderr, buffer: &s.logs}
+	// Set the process group ID so we can kill the process and its children when this process exits
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.cmd = cmd
+	s.mu.Unlock()
+	return cmd, nil
+}
+
+// kill stops the process group of the running binary
+func (s *nativeSupervisor) kill() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cmd == nil || s.cmd.Process == nil {
+		return
+	}
+	logger.Infof("killing process PID: %d", s.cmd.Process.Pid)
+	if err := syscall.Kill(-s.cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		logger.Errorf("failed to kill process: %v", err)
+	}
+}
+
+// run keeps jetkvm_native running, restarting it with exponential backoff
+// when it exits
+func (s *nativeSupervisor) run(binaryPath string) {
+	backoff := nativeMinBackoff
+	consecutiveCrashes := 0
+	for {
+		startedAt := time.Now()
+		cmd, err := s.start(binaryPath)
+		var exitErr error
+		if err != nil {
+			exitErr = fmt.Errorf("failed to start binary: %w", err)
+		} else {
+			logger.Infof("Binary started with PID: %d", cmd.Process.Pid)
+			nativeUpGauge.Set(1)
+			s.setStatus(func(status *NativeStatus) {
+				status.State = "running"
+				status.PID = cmd.Process.Pid
+				status.StartedAt = &startedAt
+				status.NextRestartAt = nil
+			})
+
+			exited := make(chan error, 1)
+			go func() { exited <- cmd.Wait() }()
+			select {
+			case <-appCtx.Done():
+				s.kill()
+				<-exited
+				return
+			case exitErr = <-exited:
+			}
+			s.mu.Lock()
+			s.cmd = nil
+			s.mu.Unlock()
+			nativeUpGauge.Set(0)
+			if exitErr == nil {
+				exitErr = errors.New("exited with status 0")
+			}
+		}
+
+		requested := false
+		select {
+		case <-s.restart:
+			requested = true
+		default:
+		}
+
+		now := time.Now()
+		if now.Sub(startedAt) >= nativeStableUptime {
+			backoff = nativeMinBackoff
+			consecutiveCrashes = 0
+		}
+		delay := backoff
+		if requested {
+			logger.Info("jetkvm_native stopped for a requested restart")
+			delay = 0
+		} else {
+			consecutiveCrashes++
+			nativeCrashesCounter.Inc()
+			logger.Errorf("jetkvm_native crashed: %v, restarting in %v", exitErr, delay)
+			backoff = min(backoff*2, nativeMaxBackoff)
+		}
+		nextRestart := now.Add(delay)
+		s.setStatus(func(status *NativeStatus) {
+			status.State = "crashed"
+			if consecutiveCrashes >= nativeFailureScreenCrashes {
+				status.State = "failed"
+			}
+			status.PID = 0
+			status.LastExit = exitErr.Error()
+			status.LastExitAt = &now
+			status.NextRestartAt = &nextRestart
+			if !requested {
+				status.Crashes++
+			}
+		})
+		if consecutiveCrashes >= nativeFailureScreenCrashes {
+			message := fmt.Sprintf("The video and display service crashed %d times: %v. Retrying.", consecutiveCrashes, exitErr)
+			if err := showFailureScreen("JetKVM native service failed", message); err != nil {
+				logger.Warnf("failed to show failure screen: %v", err)
+			}
+		}
+
+		select {
+		case <-appCtx.Done():
+			return
+		case <-s.restart:
+		case <-time.After(delay):
+		}
+		nativeRestartsCounter.Inc()
+		s.setStatus(func(status *NativeStatus) {
+			status.State = "starting"
+			status.Restarts++
+			status.NextRestartAt = nil
+		})
+	}
+}
+
+func ExtractAndRunNativeBin() error {
+	// cmd/native_sim or another stand-in connects to the sockets instead
+	if os.Getenv("JETKVM_NATIVE_SIM") != "" {
+		logger.Info("JETKVM_NATIVE_SIM is set, not starting jetkvm_native")
+		native.setStatus(func(status *NativeStatus) {
+			status.State = "external"
+		})
+		return nil
+	}
+
+	if err := ensureBinaryUpdated(nativeBinaryPath); err != nil {
+		return fmt.Errorf("failed to extract binary: %w", err)
+	}
+
+	// Make the binary executable
+	if err := os.Chmod(nativeBinaryPath, 0755); err != nil {
+		return fmt.Errorf("failed to make binary executable: %w", err)
+	}
+
+	go native.run(nativeBinaryPath)
+	return nil
+}
+
+func rpcGetNativeStatus() (NativeStatus, error) {
+	return native.getStatus(), nil
+}
+
+func rpcGetNativeLogs() ([]NativeLogLine, error) {
+	return native.logs.snapshot(), nil
+}
+
+// rpcRestartNative restarts jetkvm_native right away, a pending backoff is skipped
+func rpcRestartNative() error {
+	select {
+	case native.restart <- struct{}{}:
+	default:
+	}
+	native.kill()
+	return nil
+}
+
+// restoreVideo starts the video if something is waiting for it. Outputs
+// resumed at boot ask for it before jetkvm_native first connects, their
+// start_video is lost then.
+func restoreVideo() {
+	if sessions.count() > 0 || hasVideoConsumers() || recorder.isRecording() {
+		if err := writeCtrlAction("start_video"); err != nil {
+			logger.Warnf("failed to restart video: %v", err)
+		}
+	}
+}
+
+// restoreNativeState brings a restarted jetkvm_native back to the state the
+// previous instance was in: display contents, video and quality factor
+func restoreNativeState() {
+	displayedTexts = make(map[string]string)
+	currentScreen = ""
+	if displayInited {
+		updateStaticContents()
+		requestDisplayUpdate()
+	}
+	restoreVideo()
+	if streamFactor != 1.0 {
+		if err := rpcSetStreamQualityFactor(streamFactor); err != nil {
+			logger.Warnf("failed to restore stream quality factor: %v", err)
+		}
+	}
+}
@@ -106,6 +106,9 @@ func checkNetworkState() {
 
 	if newState != networkState {
 		fmt.Println("network state changed")
+		if networkState.checked && newState.Up && (newState.IPv4 != networkState.IPv4 || newState.IPv6 != networkState.IPv6) {
+			go onLocalAddressChanged()
+		}
 		// restart MDNS
 		startMDNS()
 		networkState = newState
@@ -196,7 +199,7 @@ func init() {
 	done := make(chan struct{})
 
 	if err := netlink.LinkSubscribe(updates, done); err != nil {
-		fmt.Println("failed to subscribe to link updates: %v", err)
+		fmt.Printf("failed to subscribe to link updates: %v\n", err)
 		return
 	}
 
@@ -222,6 +225,6 @@ func init() {
 	}()
 	err := startMDNS()
 	if err != nil {
-		fmt.Println("failed to run mDNS: %v", err)
+		fmt.Printf("failed to run mDNS: %v\n", err)
 	}
 }
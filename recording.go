@@ -0,0 +1,375 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const recordingsFolder = "/userdata/jetkvm/recordings"
+
+const (
+	// recordings are split into files of this length, each one starting with a keyframe
+	recordingSegmentDuration = 15 * time.Minute
+	// samples are handed to the writer goroutine, the video path never blocks on storage
+	recordingQueueSize = 128
+)
+
+type RecordingSettings struct {
+	// AutoRecord records while at least one session is connected
+	AutoRecord bool `json:"auto_record"`
+	// MaxAgeDays and MaxSizeMB limit the kept recordings, 0 means unlimited
+	MaxAgeDays int `json:"max_age_days"`
+	MaxSizeMB  int `json:"max_size_mb"`
+}
+
+type RecordingState struct {
+	Recording bool       `json:"recording"`
+	Auto      bool       `json:"auto"`
+	Filename  string     `json:"filename,omitempty"`
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	Bytes     int64      `json:"bytes"`
+	Dropped   int64      `json:"dropped"`
+}
+
+type Recording struct {
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type recorderSample struct {
+	data     []byte
+	duration time.Duration
+}
+
+type videoRecorder struct {
+	mu      sync.Mutex
+	state   RecordingState
+	samples chan recorderSample
+	done    chan struct{}
+}
+
+var recorder = &videoRecorder{}
+
+// countingWriter tracks the size of the recording being written
+type countingWriter struct {
+	file *os.File
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.file.Write(p)
+	recorder.mu.Lock()
+	recorder.state.Bytes += int64(n)
+	recorder.mu.Unlock()
+	return n, err
+}
+
+func (r *videoRecorder) isRecording() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state.Recording
+}
+
+// WriteSample queues an access unit received from jetkvm_native. data is
+// reused by the caller, so it is copied.
+func (r *videoRecorder) WriteSample(data []byte, duration time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.state.Recording {
+		return
+	}
+	select {
+	case r.samples <- recorderSample{data: append([]byte(nil), data...), duration: duration}:
+	default:
+		r.state.Dropped++
+		videoDroppedSamplesCounter.WithLabelValues("recording").Inc()
+	}
+}
+
+func (r *videoRecorder) start(auto bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state.Recording {
+		return errors.New("recording is already running")
+	}
+	if err := os.MkdirAll(recordingsFolder, 0755); err != nil {
+		return fmt.Errorf("failed to create recordings folder: %w", err)
+	}
+	now := time.Now()
+	r.state = RecordingState{Recording: true, Auto: auto, StartedAt: &now}
+	r.samples = make(chan recorderSample, recordingQueueSize)
+	r.done = make(chan struct{})
+	go r.run(r.samples, r.done)
+	// the first segment starts at a keyframe, a static screen may not send
+	// one for a while
+	go requestKeyframe()
+	logger.Infof("recording started (auto: %v)", auto)
+	return nil
+}
+
+func (r *videoRecorder) stop() error {
+	r.mu.Lock()
+	if !r.state.Recording {
+		r.mu.Unlock()
+		return errors.New("recording is not running")
+	}
+	r.state.Recording = false
+	close(r.samples)
+	done := r.done
+	r.mu.Unlock()
+
+	<-done
+	logger.Info("recording stopped")
+	return nil
+}
+
+func (r *videoRecorder) setFilename(filename string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state.Filename = filename
+}
+
+func (r *videoRecorder) run(samples chan recorderSample, done chan struct{}) {
+	defer close(done)
+
+	var sps, pps []byte
+	var file *os.File
+	var writer *fmp4Writer
+	var segmentStart time.Time
+
+	closeSegment := func() {
+		if file == nil {
+			return
+		}
+		if err := writer.Flush(); err != nil {
+			logger.Warnf("failed to flush recording: %v", err)
+		}
+		_ = file.Close()
+		file, writer = nil, nil
+		r.setFilename("")
+		applyRecordingRetention()
+	}
+	defer closeSegment()
+
+	for sample := range samples {
+		nals := splitAnnexB(sample.data)
+		for _, nal := range nals {
+			switch h264NALType(nal) {
+			case h264NALSPS:
+				sps = append(sps[:0], nal...)
+			case h264NALPPS:
+				pps = append(pps[:0], nal...)
+			}
+		}
+		keyframe := h264IsKeyframe(nals)
+
+		if keyframe && file != nil && time.Since(segmentStart) >= recordingSegmentDuration {
+			closeSegment()
+		}
+		if file == nil {
+			// playback has to start on a keyframe with known parameter sets
+			if !keyframe || sps == nil || pps == nil {
+				continue
+			}
+			segmentStart = time.Now()
+			filename := fmt.Sprintf("recording-%s.mp4", segmentStart.Format("20060102-150405"))
+			var err error
+			file, err = os.OpenFile(filepath.Join(recordingsFolder, filename), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			if err != nil {
+				logger.Errorf("failed to create recording file: %v", err)
+				file = nil
+				continue
+			}
+			writer, err = newFMP4Writer(&countingWriter{file: file}, sps, pps)
+			if err != nil {
+				logger.Errorf("failed to start recording: %v", err)
+				_ = file.Close()
+				file = nil
+				continue
+			}
+			r.setFilename(filename)
+			logger.Infof("recording to %s", filename)
+		}
+
+		if err := writer.WriteSample(nals, sample.duration, keyframe); err != nil {
+			videoWriteErrorsCounter.WithLabelValues("recording").Inc()
+			logger.Errorf("failed to write recording, closing segment: %v", err)
+			closeSegment()
+		}
+	}
+}
+
+// listRecordings returns the recordings, oldest first
+func listRecordings() ([]Recording, error) {
+	entries, err := os.ReadDir(recordingsFolder)
+	if os.IsNotExist(err) {
+		return []Recording{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+	recordings := make([]Recording, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".mp4") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		recordings = append(recordings, Recording{
+			Filename:  entry.Name(),
+			Size:      info.Size(),
+			CreatedAt: info.ModTime(),
+		})
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Filename < recordings[j].Filename
+	})
+	return recordings, nil
+}
+
+// applyRecordingRetention deletes the oldest recordings exceeding the
+// configured age and total size, never the one being written.
+func applyRecordingRetention() {
+	settings := config.RecordingSettings
+	recordings, err := listRecordings()
+	if err != nil {
+		logger.Warnf("failed to apply recording retention: %v", err)
+		return
+	}
+	recorder.mu.Lock()
+	active := recorder.state.Filename
+	recorder.mu.Unlock()
+
+	var total int64
+	for _, recording := range recordings {
+		total += recording.Size
+	}
+	maxSize := int64(settings.MaxSizeMB) * 1024 * 1024
+	for _, recording := range recordings {
+		if recording.Filename == active {
+			continue
+		}
+		expired := settings.MaxAgeDays > 0 && time.Since(recording.CreatedAt) > time.Duration(settings.MaxAgeDays)*24*time.Hour
+		oversize := settings.MaxSizeMB > 0 && total > maxSize
+		if !expired && !oversize {
+			continue
+		}
+		if err := os.Remove(filepath.Join(recordingsFolder, recording.Filename)); err != nil {
+			logger.Warnf("failed to delete recording %s: %v", recording.Filename, err)
+			continue
+		}
+		logger.Infof("deleted recording %s due to retention policy", recording.Filename)
+		total -= recording.Size
+	}
+}
+
+// onRecordingSessionsChanged starts or stops auto-recording as sessions
+// come and go.
+func onRecordingSessionsChanged() {
+	if sessions.count() > 0 && config.RecordingSettings.AutoRecord && !recorder.isRecording() {
+		if err := recorder.start(true); err != nil {
+			logger.Warnf("failed to start auto-recording: %v", err)
+		}
+	}
+	if sessions.count() == 0 || !config.RecordingSettings.AutoRecord {
+		recorder.mu.Lock()
+		auto := recorder.state.Recording && recorder.state.Auto
+		recorder.mu.Unlock()
+		if auto {
+			_ = recorder.stop()
+		}
+	}
+}
+
+func rpcStartRecording() error {
+	err := recorder.start(false)
+	if err != nil {
+		return err
+	}
+	// video only flows while someone is watching, unless we ask for it
+	if sessions.count() == 0 {
+		_ = writeCtrlAction("start_video")
+	}
+	return nil
+}
+
+func rpcStopRecording() error {
+	err := recorder.stop()
+	if err != nil {
+		return err
+	}
+	if sessions.count() == 0 && !hasVideoConsumers() {
+		_ = writeCtrlAction("stop_video")
+	}
+	return nil
+}
+
+func rpcGetRecordingState() (RecordingState, error) {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	return recorder.state, nil
+}
+
+func rpcListRecordings() ([]Recording, error) {
+	return listRecordings()
+}
+
+func rpcDeleteRecording(filename string) error {
+	filename, err := sanitizeFilename(filename)
+	if err != nil {
+		return err
+	}
+	recorder.mu.Lock()
+	active := recorder.state.Filename
+	recorder.mu.Unlock()
+	if filename == active {
+		return errors.New("recording is being written")
+	}
+	err = os.Remove(filepath.Join(recordingsFolder, filename))
+	if err != nil {
+		return fmt.Errorf("failed to delete recording: %w", err)
+	}
+	return nil
+}
+
+func rpcGetRecordingSettings() (RecordingSettings, error) {
+	return config.RecordingSettings, nil
+}
+
+func rpcSetRecordingSettings(params RecordingSettings) error {
+	if params.MaxAgeDays < 0 || params.MaxSizeMB < 0 {
+		return errors.New("retention limits must not be negative")
+	}
+	config.RecordingSettings = params
+	if err := SaveConfig(); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	applyRecordingRetention()
+	onRecordingSessionsChanged()
+	return nil
+}
+
+func handleRecordingDownload(c *gin.Context) {
+	filename, err := sanitizeFilename(c.Param("filename"))
+	if err != nil || !strings.HasSuffix(filename, ".mp4") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filename"})
+		return
+	}
+	fullPath := filepath.Join(recordingsFolder, filename)
+	if _, err := os.Stat(fullPath); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recording not found"})
+		return
+	}
+	c.FileAttachment(fullPath, filename)
+}
@@ -15,6 +15,10 @@ type WebRTCDiskReader struct {
 
 var webRTCDiskReader WebRTCDiskReader
 
+// webRTCDiskSession is the session serving the image mounted with
+// mountWithWebRTC, guarded by virtualMediaStateMutex
+var webRTCDiskSession *Session
+
 func (w *WebRTCDiskReader) Read(ctx context.Context, offset int64, size int64) ([]byte, error) {
 	virtualMediaStateMutex.RLock()
 	if currentVirtualMediaState == nil {
@@ -26,6 +30,7 @@ func (w *WebRTCDiskReader) Read(ctx context.Context, offset int64, size int64) (
 		return nil, errors.New("image not mounted from webrtc")
 	}
 	mountedImageSize := currentVirtualMediaState.Size
+	session := webRTCDiskSession
 	virtualMediaStateMutex.RUnlock()
 	end := offset + size
 	if end > mountedImageSize {
@@ -40,12 +45,12 @@ func (w *WebRTCDiskReader) Read(ctx context.Context, offset int64, size int64) (
 		return nil, err
 	}
 
-	if currentSession == nil || currentSession.DiskChannel == nil {
+	if session == nil || session.DiskChannel == nil {
 		return nil, errors.New("not active session")
 	}
 
 	logger.Debugf("reading from webrtc %v", string(jsonBytes))
-	err = currentSession.DiskChannel.SendText(string(jsonBytes))
+	err = session.DiskChannel.SendText(string(jsonBytes))
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,649 @@
+package kvm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A publishing RTMP client: the simple handshake, the chunk stream and the
+// few AMF0 commands needed to publish a live H.264 stream as FLV video tags.
+// Specification: Adobe RTMP 1.0 and FLV 10.1.
+
+const (
+	rtmpDefaultPort    = "1935"
+	rtmpHandshakeSize  = 1536
+	rtmpOutChunkSize   = 4096
+	rtmpDefaultInChunk = 128
+
+	rtmpCSIDControl = 2
+	rtmpCSIDCommand = 3
+	rtmpCSIDData    = 4
+	rtmpCSIDVideo   = 6
+
+	rtmpMsgSetChunkSize = 1
+	rtmpMsgUserControl  = 4
+	rtmpMsgVideo        = 9
+	rtmpMsgDataAMF0     = 18
+	rtmpMsgCommandAMF0  = 20
+
+	rtmpUserControlPingRequest  = 6
+	rtmpUserControlPingResponse = 7
+
+	flvCodecAVC          = 7
+	flvFrameKeyframe     = 1
+	flvFrameInter        = 2
+	flvAVCSequenceHeader = 0
+	flvAVCNALU           = 1
+)
+
+// AMF0 type markers
+const (
+	amf0TypeNumber      = 0x00
+	amf0TypeBoolean     = 0x01
+	amf0TypeString      = 0x02
+	amf0TypeObject      = 0x03
+	amf0TypeNull        = 0x05
+	amf0TypeUndefined   = 0x06
+	amf0TypeECMAArray   = 0x08
+	amf0TypeObjectEnd   = 0x09
+	amf0TypeStrictArray = 0x0a
+)
+
+// amf0Property keeps the order of object properties, some servers care
+type amf0Property struct {
+	Key   string
+	Value interface{}
+}
+
+type amf0Object []amf0Property
+
+// amf0ECMA is encoded as an ECMA array, as onMetaData expects
+type amf0ECMA []amf0Property
+
+func amf0AppendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func amf0Encode(values ...interface{}) []byte {
+	var b []byte
+	for _, value := range values {
+		b = amf0AppendValue(b, value)
+	}
+	return b
+}
+
+func amf0AppendValue(b []byte, value interface{}) []byte {
+	appendProperties := func(b []byte, properties []amf0Property) []byte {
+		for _, p := range properties {
+			b = amf0AppendString(b, p.Key)
+			b = amf0AppendValue(b, p.Value)
+		}
+		return append(b, 0, 0, amf0TypeObjectEnd)
+	}
+	switch v := value.(type) {
+	case nil:
+		return append(b, amf0TypeNull)
+	case float64:
+		b = append(b, amf0TypeNumber)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+	case int:
+		return amf0AppendValue(b, float64(v))
+	case bool:
+		if v {
+			return append(b, amf0TypeBoolean, 1)
+		}
+		return append(b, amf0TypeBoolean, 0)
+	case string:
+		b = append(b, amf0TypeString)
+		return amf0AppendString(b, v)
+	case amf0Object:
+		return appendProperties(append(b, amf0TypeObject), v)
+	case amf0ECMA:
+		b = append(b, amf0TypeECMAArray)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+		return appendProperties(b, v)
+	default:
+		panic(fmt.Sprintf("unsupported AMF0 value %T", value))
+	}
+}
+
+// amf0Decode decodes a sequence of values. Objects become maps, which is
+// all that is needed to read command replies.
+func amf0Decode(data []byte) ([]interface{}, error) {
+	r := bytes.NewReader(data)
+	var values []interface{}
+	for r.Len() > 0 {
+		value, err := amf0ReadValue(r)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func amf0ReadString(r *bytes.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	s := make([]byte, length)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+func amf0ReadProperties(r *bytes.Reader) (map[string]interface{}, error) {
+	properties := make(map[string]interface{})
+	for {
+		key, err := amf0ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			marker, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if marker == amf0TypeObjectEnd {
+				return properties, nil
+			}
+			if err := r.UnreadByte(); err != nil {
+				return nil, err
+			}
+		}
+		value, err := amf0ReadValue(r)
+		if err != nil {
+			return nil, err
+		}
+		properties[key] = value
+	}
+}
+
+func amf0ReadValue(r *bytes.Reader) (interface{}, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch marker {
+	case amf0TypeNumber:
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(bits), nil
+	case amf0TypeBoolean:
+		b, err := r.ReadByte()
+		return b != 0, err
+	case amf0TypeString:
+		return amf0ReadString(r)
+	case amf0TypeObject:
+		return amf0ReadProperties(r)
+	case amf0TypeECMAArray:
+		if _, err := r.Seek(4, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		return amf0ReadProperties(r)
+	case amf0TypeStrictArray:
+		var count uint32
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, 0, min(count, 64))
+		for i := uint32(0); i < count; i++ {
+			value, err := amf0ReadValue(r)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	case amf0TypeNull, amf0TypeUndefined:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported AMF0 type 0x%02x", marker)
+	}
+}
+
+type rtmpMessage struct {
+	msgType   byte
+	streamID  uint32
+	timestamp uint32
+	payload   []byte
+}
+
+// rtmpChunkState is what a chunk stream remembers for header compression
+type rtmpChunkState struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	msgType   byte
+	streamID  uint32
+	extended  bool
+	buf       []byte
+}
+
+type rtmpClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMu sync.Mutex
+	inChunk uint32
+	chunks  map[uint32]*rtmpChunkState
+
+	streamKey string
+	streamID  uint32
+	txn       int
+	bytesSent int64
+
+	sentSPS []byte
+	sentPPS []byte
+	time    time.Duration
+}
+
+// dialRTMP connects to rtmp://host[:port]/app[/...]/streamkey and starts
+// publishing
+func dialRTMP(ctx context.Context, target *url.URL) (*rtmpClient, error) {
+	path := strings.Trim(target.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	if slash <= 0 {
+		return nil, errors.New("RTMP URL must be rtmp://host/app/streamkey")
+	}
+	app, streamKey := path[:slash], path[slash+1:]
+	if target.RawQuery != "" {
+		streamKey += "?" + target.RawQuery
+	}
+	host := target.Host
+	if target.Port() == "" {
+		host = net.JoinHostPort(target.Hostname(), rtmpDefaultPort)
+	}
+
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	c := &rtmpClient{
+		conn:      conn,
+		reader:    bufio.NewReader(conn),
+		inChunk:   rtmpDefaultInChunk,
+		chunks:    make(map[uint32]*rtmpChunkState),
+		streamKey: streamKey,
+	}
+	// the context only bounds the setup, the stream itself runs until closed
+	_ = conn.SetDeadline(time.Now().Add(15 * time.Second))
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	tcURL := fmt.Sprintf("rtmp://%s/%s", target.Host, app)
+	if err := c.handshake(); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	if err := c.publish(app, tcURL); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func (c *rtmpClient) handshake() error {
+	c1 := make([]byte, 1+rtmpHandshakeSize)
+	c1[0] = 3 // version
+	binary.BigEndian.PutUint32(c1[1:], uint32(time.Now().Unix()))
+	_, _ = rand.Read(c1[9:])
+	if _, err := c.conn.Write(c1); err != nil {
+		return err
+	}
+	s0s1 := make([]byte, 1+rtmpHandshakeSize)
+	if _, err := io.ReadFull(c.reader, s0s1); err != nil {
+		return err
+	}
+	if s0s1[0] != 3 {
+		return fmt.Errorf("unsupported RTMP version %d", s0s1[0])
+	}
+	// C2 echoes S1
+	if _, err := c.conn.Write(s0s1[1:]); err != nil {
+		return err
+	}
+	s2 := make([]byte, rtmpHandshakeSize)
+	_, err := io.ReadFull(c.reader, s2)
+	return err
+}
+
+func (c *rtmpClient) writeMessage(csid byte, msgType byte, streamID uint32, timestamp uint32, payload []byte) error {
+	extended := timestamp >= 0xffffff
+	header := make([]byte, 0, 16)
+	header = append(header, csid&0x3f)
+	tsField := min(timestamp, 0xffffff)
+	header = append(header, byte(tsField>>16), byte(tsField>>8), byte(tsField))
+	header = append(header, byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)))
+	header = append(header, msgType)
+	header = binary.LittleEndian.AppendUint32(header, streamID)
+	if extended {
+		header = binary.BigEndian.AppendUint32(header, timestamp)
+	}
+
+	buf := make([]byte, 0, len(header)+len(payload)+len(payload)/rtmpOutChunkSize*5)
+	buf = append(buf, header...)
+	for offset := 0; offset < len(payload); offset += rtmpOutChunkSize {
+		if offset > 0 {
+			buf = append(buf, 0xc0|csid&0x3f)
+			if extended {
+				buf = binary.BigEndian.AppendUint32(buf, timestamp)
+			}
+		}
+		buf = append(buf, payload[offset:min(offset+rtmpOutChunkSize, len(payload))]...)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	n, err := c.conn.Write(buf)
+	c.bytesSent += int64(n)
+	return err
+}
+
+func (c *rtmpClient) readMessage() (*rtmpMessage, error) {
+	for {
+		basic, err := c.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		format := basic >> 6
+		csid := uint32(basic & 0x3f)
+		switch csid {
+		case 0:
+			b, err := c.reader.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(b)
+		case 1:
+			b := make([]byte, 2)
+			if _, err := io.ReadFull(c.reader, b); err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(b[0]) + uint32(b[1])*256
+		}
+		state, ok := c.chunks[csid]
+		if !ok {
+			state = &rtmpChunkState{}
+			c.chunks[csid] = state
+		}
+
+		headerSizes := [4]int{11, 7, 3, 0}
+		header := make([]byte, headerSizes[format])
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return nil, err
+		}
+		var tsField uint32
+		if format < 3 {
+			tsField = uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+			state.extended = tsField == 0xffffff
+		}
+		if format < 2 {
+			state.length = uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+			state.msgType = header[6]
+		}
+		if format == 0 {
+			state.streamID = binary.LittleEndian.Uint32(header[7:])
+		}
+		if state.extended {
+			ext := make([]byte, 4)
+			if _, err := io.ReadFull(c.reader, ext); err != nil {
+				return nil, err
+			}
+			tsField = binary.BigEndian.Uint32(ext)
+		}
+		if len(state.buf) == 0 {
+			switch format {
+			case 0:
+				state.timestamp = tsField
+			case 1, 2:
+				state.delta = tsField
+				state.timestamp += tsField
+			case 3:
+				state.timestamp += state.delta
+			}
+		}
+
+		size := min(c.inChunk, state.length-uint32(len(state.buf)))
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, chunk); err != nil {
+			return nil, err
+		}
+		state.buf = append(state.buf, chunk...)
+		if uint32(len(state.buf)) < state.length {
+			continue
+		}
+		msg := &rtmpMessage{msgType: state.msgType, streamID: state.streamID, timestamp: state.timestamp, payload: state.buf}
+		state.buf = nil
+		if err := c.handleControl(msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+}
+
+// handleControl applies protocol control messages from the server
+func (c *rtmpClient) handleControl(msg *rtmpMessage) error {
+	switch msg.msgType {
+	case rtmpMsgSetChunkSize:
+		if len(msg.payload) < 4 {
+			return errors.New("invalid set chunk size message")
+		}
+		c.inChunk = binary.BigEndian.Uint32(msg.payload) & 0x7fffffff
+		if c.inChunk == 0 {
+			return errors.New("invalid chunk size")
+		}
+	case rtmpMsgUserControl:
+		if len(msg.payload) >= 6 && binary.BigEndian.Uint16(msg.payload) == rtmpUserControlPingRequest {
+			response := binary.BigEndian.AppendUint16(nil, rtmpUserControlPingResponse)
+			response = append(response, msg.payload[2:6]...)
+			return c.writeMessage(rtmpCSIDControl, rtmpMsgUserControl, 0, 0, response)
+		}
+	}
+	return nil
+}
+
+func (c *rtmpClient) command(streamID uint32, name string, args ...interface{}) (int, error) {
+	c.txn++
+	payload := amf0Encode(append([]interface{}{name, c.txn}, args...)...)
+	return c.txn, c.writeMessage(rtmpCSIDCommand, rtmpMsgCommandAMF0, streamID, 0, payload)
+}
+
+// waitCommand reads until a command named in names arrives for the given
+// transaction, 0 matches any
+func (c *rtmpClient) waitCommand(txn int, names ...string) ([]interface{}, error) {
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg.msgType != rtmpMsgCommandAMF0 {
+			continue
+		}
+		values, err := amf0Decode(msg.payload)
+		if err != nil || len(values) < 2 {
+			continue
+		}
+		name, _ := values[0].(string)
+		id, _ := values[1].(float64)
+		if name == "_error" && (txn == 0 || int(id) == txn) {
+			return nil, fmt.Errorf("server rejected the request: %v", rtmpStatusDescription(values))
+		}
+		for _, expected := range names {
+			if name == expected && (txn == 0 || int(id) == txn) {
+				return values, nil
+			}
+		}
+	}
+}
+
+func rtmpStatusDescription(values []interface{}) string {
+	for _, value := range values {
+		if info, ok := value.(map[string]interface{}); ok {
+			return fmt.Sprintf("%v: %v", info["code"], info["description"])
+		}
+	}
+	return "unknown error"
+}
+
+func (c *rtmpClient) publish(app string, tcURL string) error {
+	chunkSize := binary.BigEndian.AppendUint32(nil, rtmpOutChunkSize)
+	if err := c.writeMessage(rtmpCSIDControl, rtmpMsgSetChunkSize, 0, 0, chunkSize); err != nil {
+		return err
+	}
+
+	txn, err := c.command(0, "connect", amf0Object{
+		{"app", app},
+		{"type", "nonprivate"},
+		{"flashVer", "FMLE/3.0 (compatible; JetKVM)"},
+		{"tcUrl", tcURL},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := c.waitCommand(txn, "_result"); err != nil {
+		return fmt.Errorf("connect failed: %w", err)
+	}
+
+	// releaseStream and FCPublish are what encoders send, replies are optional
+	if _, err := c.command(0, "releaseStream", nil, c.streamKey); err != nil {
+		return err
+	}
+	if _, err := c.command(0, "FCPublish", nil, c.streamKey); err != nil {
+		return err
+	}
+	txn, err = c.command(0, "createStream", nil)
+	if err != nil {
+		return err
+	}
+	reply, err := c.waitCommand(txn, "_result")
+	if err != nil {
+		return fmt.Errorf("createStream failed: %w", err)
+	}
+	if len(reply) < 4 {
+		return errors.New("createStream returned no stream id")
+	}
+	streamID, ok := reply[3].(float64)
+	if !ok {
+		return errors.New("createStream returned an invalid stream id")
+	}
+	c.streamID = uint32(streamID)
+
+	if _, err := c.command(c.streamID, "publish", nil, c.streamKey, "live"); err != nil {
+		return err
+	}
+	for {
+		status, err := c.waitCommand(0, "onStatus")
+		if err != nil {
+			return fmt.Errorf("publish failed: %w", err)
+		}
+		for _, value := range status {
+			info, ok := value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if info["code"] == "NetStream.Publish.Start" {
+				return nil
+			}
+			if info["level"] == "error" {
+				return fmt.Errorf("publish failed: %s", rtmpStatusDescription(status))
+			}
+		}
+	}
+}
+
+// run reads from the server until the connection closes, answering pings
+func (c *rtmpClient) run() error {
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		if msg.msgType != rtmpMsgCommandAMF0 {
+			continue
+		}
+		values, err := amf0Decode(msg.payload)
+		if err != nil || len(values) == 0 {
+			continue
+		}
+		if values[0] == "onStatus" {
+			for _, value := range values {
+				if info, ok := value.(map[string]interface{}); ok && info["level"] == "error" {
+					return fmt.Errorf("stream error: %s", rtmpStatusDescription(values))
+				}
+			}
+		}
+	}
+}
+
+// WriteSample sends an access unit as an FLV video tag, preceded by the
+// decoder configuration whenever the parameter sets change
+func (c *rtmpClient) WriteSample(nals [][]byte, sps []byte, pps []byte, duration time.Duration, keyframe bool) error {
+	timestamp := uint32(c.time.Milliseconds())
+	c.time += duration
+
+	if keyframe && (!bytes.Equal(sps, c.sentSPS) || !bytes.Equal(pps, c.sentPPS)) {
+		if c.sentSPS == nil {
+			if err := c.writeMetadata(sps); err != nil {
+				return err
+			}
+		}
+		header := append([]byte{flvFrameKeyframe<<4 | flvCodecAVC, flvAVCSequenceHeader, 0, 0, 0}, avcDecoderConfigurationRecord(sps, pps)...)
+		if err := c.writeMessage(rtmpCSIDVideo, rtmpMsgVideo, c.streamID, timestamp, header); err != nil {
+			return err
+		}
+		c.sentSPS, c.sentPPS = sps, pps
+	}
+
+	data := avccPayload(nals)
+	if len(data) == 0 {
+		return nil
+	}
+	frameType := byte(flvFrameInter)
+	if keyframe {
+		frameType = flvFrameKeyframe
+	}
+	tag := append([]byte{frameType<<4 | flvCodecAVC, flvAVCNALU, 0, 0, 0}, data...)
+	return c.writeMessage(rtmpCSIDVideo, rtmpMsgVideo, c.streamID, timestamp, tag)
+}
+
+func (c *rtmpClient) writeMetadata(sps []byte) error {
+	metadata := amf0ECMA{{"videocodecid", flvCodecAVC}}
+	if info, err := parseH264SPS(sps); err == nil {
+		metadata = append(metadata, amf0Property{"width", info.Width}, amf0Property{"height", info.Height})
+	}
+	metadata = append(metadata, amf0Property{"encoder", "JetKVM"})
+	payload := amf0Encode("@setDataFrame", "onMetaData", metadata)
+	return c.writeMessage(rtmpCSIDData, rtmpMsgDataAMF0, c.streamID, 0, payload)
+}
+
+func (c *rtmpClient) BytesSent() int64 {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.bytesSent
+}
+
+func (c *rtmpClient) Close() error {
+	// a clean unpublish lets the server end the stream right away
+	_, _ = c.command(c.streamID, "FCUnpublish", nil, c.streamKey)
+	_, _ = c.command(0, "deleteStream", nil, float64(c.streamID))
+	return c.conn.Close()
+}
@@ -0,0 +1,521 @@
+package kvm
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// A minimal RTSP 1.0 server (RFC 2326) for NVRs and video walls. It serves a
+// single H.264 track, the same samples the WebRTC sessions get, over RTP on
+// UDP or interleaved in the RTSP connection.
+
+const (
+	rtspRealm          = "JetKVM"
+	rtspSessionTimeout = 60 * time.Second
+	rtspPayloadType    = 96
+	rtspClockRate      = 90000
+	rtspMTU            = 1400
+	rtspMaxBodySize    = 64 * 1024
+)
+
+type RTSPServerConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	// Password is never returned by getRTSPServerConfig, setting it empty
+	// keeps the current one
+	Password string `json:"password"`
+}
+
+type RTSPServerState struct {
+	Running bool   `json:"running"`
+	Port    int    `json:"port"`
+	Players int    `json:"players"`
+	Error   string `json:"error,omitempty"`
+}
+
+type rtspServer struct {
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[*rtspConn]struct{}
+	port     int
+	players  int
+	err      error
+}
+
+var rtspVideoServer = &rtspServer{conns: make(map[*rtspConn]struct{})}
+
+type rtspRequest struct {
+	method  string
+	uri     string
+	headers textproto.MIMEHeader
+}
+
+type rtspConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+	nonce   string
+	session string
+
+	// transport chosen in SETUP
+	interleaved bool
+	rtpChannel  byte
+	udpConn     *net.UDPConn
+	udpRTCP     *net.UDPConn
+	clientAddr  *net.UDPAddr
+
+	packetizer rtp.Packetizer
+	subscriber *videoSubscriber
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *rtspServer) start(settings RTSPServerConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		return errors.New("RTSP server is already running")
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", settings.Port))
+	if err != nil {
+		s.err = err
+		return fmt.Errorf("failed to listen on port %d: %w", settings.Port, err)
+	}
+	s.listener = listener
+	s.port = settings.Port
+	s.err = nil
+	logger.Infof("RTSP server listening on port %d", settings.Port)
+	go s.accept(listener)
+	return nil
+}
+
+func (s *rtspServer) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return
+	}
+	_ = s.listener.Close()
+	s.listener = nil
+	for c := range s.conns {
+		_ = c.conn.Close()
+	}
+	logger.Info("RTSP server stopped")
+}
+
+func (s *rtspServer) state() RTSPServerState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := RTSPServerState{Running: s.listener != nil, Port: s.port, Players: s.players}
+	if s.err != nil {
+		state.Error = s.err.Error()
+	}
+	return state
+}
+
+func (s *rtspServer) addPlayers(delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.players += delta
+}
+
+func (s *rtspServer) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warnf("RTSP accept failed: %v", err)
+			}
+			return
+		}
+		c := &rtspConn{conn: conn, reader: bufio.NewReader(conn), nonce: randomHex(16)}
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		go func() {
+			c.serve()
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (c *rtspConn) serve() {
+	defer c.close()
+	logger.Infof("RTSP client connected from %s", c.conn.RemoteAddr())
+	for {
+		// clients keep the session alive with OPTIONS or GET_PARAMETER
+		_ = c.conn.SetReadDeadline(time.Now().Add(2 * rtspSessionTimeout))
+		req, err := c.readRequest()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.Debugf("RTSP connection from %s closed: %v", c.conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if !c.handle(req) {
+			return
+		}
+	}
+}
+
+func (c *rtspConn) close() {
+	if c.subscriber != nil {
+		broadcaster.unsubscribe(c.subscriber)
+		c.subscriber = nil
+		rtspVideoServer.addPlayers(-1)
+		releaseVideo()
+	}
+	if c.udpConn != nil {
+		_ = c.udpConn.Close()
+		_ = c.udpRTCP.Close()
+	}
+	_ = c.conn.Close()
+	logger.Infof("RTSP client %s disconnected", c.conn.RemoteAddr())
+}
+
+// readRequest reads the next request, skipping interleaved RTCP from the client
+func (c *rtspConn) readRequest() (*rtspRequest, error) {
+	for {
+		first, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if first[0] != '$' {
+			break
+		}
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return nil, err
+		}
+		if _, err := c.reader.Discard(int(binary.BigEndian.Uint16(header[2:]))); err != nil {
+			return nil, err
+		}
+	}
+
+	tp := textproto.NewReader(c.reader)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/1.") {
+		return nil, fmt.Errorf("malformed request line: %q", line)
+	}
+	headers, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	if length, _ := strconv.Atoi(headers.Get("Content-Length")); length > 0 {
+		if length > rtspMaxBodySize {
+			return nil, errors.New("request body too large")
+		}
+		if _, err := c.reader.Discard(length); err != nil {
+			return nil, err
+		}
+	}
+	return &rtspRequest{method: parts[0], uri: parts[1], headers: headers}, nil
+}
+
+func (c *rtspConn) respond(req *rtspRequest, status int, reason string, headers map[string]string, body string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\n", status, reason)
+	fmt.Fprintf(&b, "CSeq: %s\r\n", req.headers.Get("CSeq"))
+	b.WriteString("Server: JetKVM\r\n")
+	if c.session != "" {
+		fmt.Fprintf(&b, "Session: %s;timeout=%d\r\n", c.session, int(rtspSessionTimeout.Seconds()))
+	}
+	for k, v := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+	}
+	if body != "" {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n")
+	b.WriteString(body)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write([]byte(b.String()))
+	return err
+}
+
+// handle answers one request, it returns false when the connection should close
+func (c *rtspConn) handle(req *rtspRequest) bool {
+	if req.method != "OPTIONS" && !c.authorized(req) {
+		err := c.respond(req, 401, "Unauthorized", map[string]string{
+			"WWW-Authenticate": fmt.Sprintf(`Digest realm="%s", nonce="%s"`, rtspRealm, c.nonce),
+		}, "")
+		return err == nil
+	}
+
+	var err error
+	switch req.method {
+	case "OPTIONS":
+		err = c.respond(req, 200, "OK", map[string]string{
+			"Public": "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER",
+		}, "")
+	case "DESCRIBE":
+		err = c.handleDescribe(req)
+	case "SETUP":
+		err = c.handleSetup(req)
+	case "PLAY":
+		err = c.handlePlay(req)
+	case "GET_PARAMETER":
+		err = c.respond(req, 200, "OK", nil, "")
+	case "TEARDOWN":
+		_ = c.respond(req, 200, "OK", nil, "")
+		return false
+	default:
+		err = c.respond(req, 501, "Not Implemented", nil, "")
+	}
+	if err != nil {
+		logger.Debugf("RTSP %s from %s failed: %v", req.method, c.conn.RemoteAddr(), err)
+		return false
+	}
+	return true
+}
+
+// parseDigestParams parses the comma separated key="value" list of a Digest
+// Authorization header
+func parseDigestParams(header string) map[string]string {
+	params := make(map[string]string)
+	rest, ok := strings.CutPrefix(header, "Digest ")
+	if !ok {
+		return params
+	}
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				break
+			}
+			params[strings.TrimSpace(key)] = value[1 : end+1]
+			rest = value[end+2:]
+			continue
+		}
+		value, rest, _ = strings.Cut(value, ",")
+		params[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return params
+}
+
+func (c *rtspConn) authorized(req *rtspRequest) bool {
+	settings := config.RTSPServer
+	params := parseDigestParams(req.headers.Get("Authorization"))
+	if params["username"] != settings.Username || params["realm"] != rtspRealm || params["nonce"] != c.nonce {
+		return false
+	}
+	ha1 := md5Hex(settings.Username + ":" + rtspRealm + ":" + settings.Password)
+	ha2 := md5Hex(req.method + ":" + params["uri"])
+	expected := md5Hex(ha1 + ":" + c.nonce + ":" + ha2)
+	return params["response"] == expected
+}
+
+func (c *rtspConn) handleDescribe(req *rtspRequest) error {
+	sps, pps := broadcaster.parameterSets()
+	fmtp := "packetization-mode=1"
+	if len(sps) >= 4 && pps != nil {
+		fmtp += fmt.Sprintf(";profile-level-id=%s;sprop-parameter-sets=%s,%s",
+			hex.EncodeToString(sps[1:4]),
+			base64.StdEncoding.EncodeToString(sps),
+			base64.StdEncoding.EncodeToString(pps))
+	}
+	host, _, _ := net.SplitHostPort(c.conn.LocalAddr().String())
+	sdp := strings.Join([]string{
+		"v=0",
+		fmt.Sprintf("o=- %d 1 IN IP4 %s", time.Now().Unix(), host),
+		"s=JetKVM",
+		"c=IN IP4 0.0.0.0",
+		"t=0 0",
+		"a=control:*",
+		fmt.Sprintf("m=video 0 RTP/AVP %d", rtspPayloadType),
+		fmt.Sprintf("a=rtpmap:%d H264/%d", rtspPayloadType, rtspClockRate),
+		fmt.Sprintf("a=fmtp:%d %s", rtspPayloadType, fmtp),
+		"a=control:trackID=0",
+		"",
+	}, "\r\n")
+	return c.respond(req, 200, "OK", map[string]string{
+		"Content-Type": "application/sdp",
+		"Content-Base": strings.TrimSuffix(req.uri, "/") + "/",
+	}, sdp)
+}
+
+func (c *rtspConn) handleSetup(req *rtspRequest) error {
+	if c.subscriber != nil {
+		return c.respond(req, 455, "Method Not Valid in This State", nil, "")
+	}
+	transport := req.headers.Get("Transport")
+	var params = make(map[string]string)
+	for _, part := range strings.Split(transport, ";") {
+		key, value, _ := strings.Cut(part, "=")
+		params[key] = value
+	}
+	if _, multicast := params["multicast"]; multicast {
+		return c.respond(req, 461, "Unsupported Transport", nil, "")
+	}
+
+	var reply string
+	if strings.HasPrefix(transport, "RTP/AVP/TCP") {
+		first, _, _ := strings.Cut(params["interleaved"], "-")
+		channel, err := strconv.Atoi(first)
+		if err != nil {
+			channel = 0
+		}
+		c.interleaved = true
+		c.rtpChannel = byte(channel)
+		reply = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1)
+	} else if strings.HasPrefix(transport, "RTP/AVP") {
+		first, second, _ := strings.Cut(params["client_port"], "-")
+		rtpPort, err := strconv.Atoi(first)
+		if err != nil {
+			return c.respond(req, 461, "Unsupported Transport", nil, "")
+		}
+		rtcpPort, err := strconv.Atoi(second)
+		if err != nil {
+			rtcpPort = rtpPort + 1
+		}
+		remote := c.conn.RemoteAddr().(*net.TCPAddr)
+		if c.udpConn == nil {
+			if c.udpConn, err = net.ListenUDP("udp", nil); err != nil {
+				return c.respond(req, 500, "Internal Server Error", nil, "")
+			}
+			// RTCP from the client is not used, the socket only reserves the port
+			if c.udpRTCP, err = net.ListenUDP("udp", nil); err != nil {
+				_ = c.udpConn.Close()
+				c.udpConn = nil
+				return c.respond(req, 500, "Internal Server Error", nil, "")
+			}
+		}
+		c.clientAddr = &net.UDPAddr{IP: remote.IP, Port: rtpPort}
+		reply = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d", rtpPort, rtcpPort,
+			c.udpConn.LocalAddr().(*net.UDPAddr).Port, c.udpRTCP.LocalAddr().(*net.UDPAddr).Port)
+	} else {
+		return c.respond(req, 461, "Unsupported Transport", nil, "")
+	}
+
+	if c.session == "" {
+		c.session = randomHex(8)
+	}
+	return c.respond(req, 200, "OK", map[string]string{"Transport": reply}, "")
+}
+
+func (c *rtspConn) handlePlay(req *rtspRequest) error {
+	if c.session == "" || (!c.interleaved && c.clientAddr == nil) {
+		return c.respond(req, 455, "Method Not Valid in This State", nil, "")
+	}
+	if c.subscriber != nil {
+		return c.respond(req, 200, "OK", nil, "")
+	}
+	ssrc := make([]byte, 4)
+	_, _ = rand.Read(ssrc)
+	c.packetizer = rtp.NewPacketizer(rtspMTU, rtspPayloadType, binary.BigEndian.Uint32(ssrc), &codecs.H264Payloader{}, rtp.NewRandomSequencer(), rtspClockRate)
+	if err := c.respond(req, 200, "OK", map[string]string{"Range": "npt=0.000-"}, ""); err != nil {
+		return err
+	}
+	logger.Infof("RTSP client %s started playing", c.conn.RemoteAddr())
+	acquireVideo()
+	rtspVideoServer.addPlayers(1)
+	c.subscriber = broadcaster.subscribe("rtsp", c.writeSample)
+	return nil
+}
+
+// writeSample sends an access unit as RTP packets
+func (c *rtspConn) writeSample(sample media.Sample) error {
+	samples := uint32(sample.Duration.Seconds() * rtspClockRate)
+	for _, packet := range c.packetizer.Packetize(sample.Data, samples) {
+		data, err := packet.Marshal()
+		if err != nil {
+			return err
+		}
+		if c.interleaved {
+			frame := make([]byte, 4, 4+len(data))
+			frame[0] = '$'
+			frame[1] = c.rtpChannel
+			binary.BigEndian.PutUint16(frame[2:], uint16(len(data)))
+			c.writeMu.Lock()
+			_, err = c.conn.Write(append(frame, data...))
+			c.writeMu.Unlock()
+		} else {
+			_, err = c.udpConn.WriteToUDP(data, c.clientAddr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startRTSPServer() {
+	if !config.RTSPServer.Enabled {
+		return
+	}
+	if err := rtspVideoServer.start(config.RTSPServer); err != nil {
+		logger.Errorf("failed to start RTSP server: %v", err)
+	}
+}
+
+// rpcGetRTSPServerConfig leaves out the password, every session can read it
+func rpcGetRTSPServerConfig() (RTSPServerConfig, error) {
+	rtspConfig := config.RTSPServer
+	rtspConfig.Password = ""
+	return rtspConfig, nil
+}
+
+func rpcSetRTSPServerConfig(params RTSPServerConfig) error {
+	if params.Port <= 0 || params.Port > 65535 {
+		return errors.New("invalid port")
+	}
+	if params.Password == "" {
+		params.Password = config.RTSPServer.Password
+	}
+	if params.Enabled && (params.Username == "" || params.Password == "") {
+		return errors.New("username and password are required")
+	}
+	rtspVideoServer.stop()
+	config.RTSPServer = params
+	if err := SaveConfig(); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	if params.Enabled {
+		return rtspVideoServer.start(params)
+	}
+	return nil
+}
+
+func rpcGetRTSPServerState() (RTSPServerState, error) {
+	return rtspVideoServer.state(), nil
+}
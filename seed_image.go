@@ -0,0 +1,243 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type SeedImageType string
+
+const (
+	// SeedImageNoCloud is a cloud-init NoCloud ISO labelled CIDATA
+	SeedImageNoCloud SeedImageType = "nocloud"
+	// SeedImageWindows is a FAT32 disk holding autounattend.xml
+	SeedImageWindows SeedImageType = "windows"
+)
+
+const (
+	seedLunName = "lun.1"
+	// Windows setup scans removable drives for the answer file, a small
+	// disk is enough but it has to be large enough for FAT32
+	windowsSeedImageSize = 64 * 1024 * 1024
+)
+
+type CreateSeedImageParams struct {
+	Filename      string        `json:"filename"`
+	Type          SeedImageType `json:"type"`
+	UserData      string        `json:"userData"`
+	MetaData      string        `json:"metaData"`
+	NetworkConfig string        `json:"networkConfig"`
+	AnswerFile    string        `json:"answerFile"`
+	// Mount presents the image on a second LUN, next to the installer media
+	Mount bool `json:"mount"`
+	// Overwrite replaces an existing image with the same name, e.g. to
+	// regenerate a seed image
+	Overwrite bool `json:"overwrite"`
+}
+
+var currentSeedImage string
+var seedImageMutex sync.Mutex
+
+// ensureSeedLun adds the second LUN to the mass storage function. LUNs can
+// only be created while the gadget is unbound, so the host briefly sees the
+// device disconnect the first time.
+func ensureSeedLun() error {
+	lunPath := path.Join(massStorageFunctionPath, seedLunName)
+	if _, err := os.Stat(lunPath); err == nil {
+		return nil
+	}
+
+	udcPath := path.Join(kvmGadgetPath, "UDC")
+	err := writeFile(udcPath, "\n")
+	if err != nil {
+		return fmt.Errorf("failed to unbind usb gadget: %w", err)
+	}
+	err = os.MkdirAll(lunPath, 0755)
+	if err == nil {
+		err = writeGadgetAttrs(lunPath, [][]string{
+			{"cdrom", "0"},
+			{"ro", "1"},
+			{"removable", "1"},
+			{"file", "\n"},
+			{"inquiry_string", "JetKVM Seed Media"},
+		})
+	}
+	bindErr := writeFile(udcPath, udc)
+	if err != nil {
+		return fmt.Errorf("failed to create seed lun: %w", err)
+	}
+	if bindErr != nil {
+		return fmt.Errorf("failed to bind usb gadget: %w", bindErr)
+	}
+	return nil
+}
+
+func mountSeedImage(imagePath string, cdrom bool) error {
+	err := ensureSeedLun()
+	if err != nil {
+		return err
+	}
+	lunPath := path.Join(massStorageFunctionPath, seedLunName)
+	mode := "0"
+	if cdrom {
+		mode = "1"
+	}
+	// cdrom and ro can only be changed while no image is attached
+	err = writeFile(path.Join(lunPath, "file"), "\n")
+	if err != nil {
+		return fmt.Errorf("failed to remove seed image: %w", err)
+	}
+	err = writeFile(path.Join(lunPath, "cdrom"), mode)
+	if err != nil {
+		return fmt.Errorf("failed to set cdrom mode: %w", err)
+	}
+	err = writeFile(path.Join(lunPath, "ro"), "1")
+	if err != nil {
+		return fmt.Errorf("failed to set read-only mode: %w", err)
+	}
+	err = writeFile(path.Join(lunPath, "file"), imagePath)
+	if err != nil {
+		return fmt.Errorf("failed to set seed image path: %w", err)
+	}
+	return nil
+}
+
+func rpcUnmountSeedImage() error {
+	seedImageMutex.Lock()
+	defer seedImageMutex.Unlock()
+	if currentSeedImage == "" {
+		return nil
+	}
+	err := writeFile(path.Join(massStorageFunctionPath, seedLunName, "file"), "\n")
+	if err != nil {
+		return fmt.Errorf("failed to remove seed image: %w", err)
+	}
+	currentSeedImage = ""
+	return nil
+}
+
+func rpcGetSeedImageState() (string, error) {
+	seedImageMutex.Lock()
+	defer seedImageMutex.Unlock()
+	return currentSeedImage, nil
+}
+
+// writeSeedImage writes the image contents to file and returns the final
+// image size.
+func writeSeedImage(file *os.File, params CreateSeedImageParams) (int64, error) {
+	switch params.Type {
+	case SeedImageNoCloud:
+		// meta-data has to exist even if empty, network-config is optional
+		files := []imageFile{
+			{Name: "user-data", Data: []byte(params.UserData)},
+			{Name: "meta-data", Data: []byte(params.MetaData)},
+		}
+		if params.NetworkConfig != "" {
+			files = append(files, imageFile{Name: "network-config", Data: []byte(params.NetworkConfig)})
+		}
+		size, err := writeISO9660(file, "CIDATA", files)
+		if err != nil {
+			return 0, err
+		}
+		return size, file.Truncate(size)
+	case SeedImageWindows:
+		err := file.Truncate(windowsSeedImageSize)
+		if err != nil {
+			return 0, err
+		}
+		files := []imageFile{{Name: "autounattend.xml", Data: []byte(params.AnswerFile)}}
+		return windowsSeedImageSize, writeStorageImageLayout(file, windowsSeedImageSize, StorageImageMBRFAT32, "UNATTEND", files)
+	default:
+		return 0, fmt.Errorf("invalid seed image type: %s", params.Type)
+	}
+}
+
+func rpcCreateSeedImage(params CreateSeedImageParams) (*StorageFile, error) {
+	switch params.Type {
+	case SeedImageNoCloud:
+		if params.Filename == "" {
+			params.Filename = "cidata.iso"
+		}
+	case SeedImageWindows:
+		if strings.TrimSpace(params.AnswerFile) == "" {
+			return nil, errors.New("answer file is required")
+		}
+		if params.Filename == "" {
+			params.Filename = "autounattend.img"
+		}
+	default:
+		return nil, fmt.Errorf("invalid seed image type: %s", params.Type)
+	}
+	filename, err := sanitizeFilename(params.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	seedImageMutex.Lock()
+	defer seedImageMutex.Unlock()
+
+	fullPath := filepath.Join(imagesFolder, filename)
+	if _, err := os.Stat(fullPath); err == nil && !params.Overwrite {
+		return nil, fmt.Errorf("file already exists: %s", filename)
+	}
+
+	// existing images are only replaced when not in use
+	virtualMediaStateMutex.RLock()
+	inUse := currentVirtualMediaState != nil && currentVirtualMediaState.Source == Storage && currentVirtualMediaState.Filename == filename
+	virtualMediaStateMutex.RUnlock()
+	if inUse {
+		return nil, fmt.Errorf("image %s is currently mounted", filename)
+	}
+	if currentSeedImage == filename {
+		err = writeFile(path.Join(massStorageFunctionPath, seedLunName, "file"), "\n")
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove seed image: %w", err)
+		}
+		currentSeedImage = ""
+	}
+
+	tmpPath := fullPath + ".incomplete"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image file: %w", err)
+	}
+	size, err := writeSeedImage(file, params)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, fullPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return nil, fmt.Errorf("failed to create %s seed image: %w", params.Type, err)
+	}
+	logger.Infof("created %s seed image %s with size %d", params.Type, filename, size)
+
+	if params.Mount {
+		err = mountSeedImage(fullPath, params.Type == SeedImageNoCloud)
+		if err != nil {
+			return nil, fmt.Errorf("failed to mount seed image: %w", err)
+		}
+		currentSeedImage = filename
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+	return &StorageFile{
+		Filename:  filename,
+		Size:      info.Size(),
+		CreatedAt: info.ModTime(),
+	}, nil
+}
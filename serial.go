@@ -55,12 +55,10 @@ func runATXControl() {
 		newBtnRSTState := line[2] == '1'
 		newBtnPWRState := line[3] == '1'
 
-		if currentSession != nil {
-			writeJSONRPCEvent("atxState", ATXState{
-				Power: newLedPWRState,
-				HDD:   newLedHDDState,
-			}, currentSession)
-		}
+		broadcastJSONRPCEvent("atxState", ATXState{
+			Power: newLedPWRState,
+			HDD:   newLedHDDState,
+		})
 
 		if newLedHDDState != ledHDDState ||
 			newLedPWRState != ledPWRState ||
@@ -182,9 +180,7 @@ func runDCControl() {
 		dcState.Current = amps
 		dcState.Power = watts
 
-		if currentSession != nil {
-			writeJSONRPCEvent("dcState", dcState, currentSession)
-		}
+		broadcastJSONRPCEvent("dcState", dcState)
 	}
 }
 
@@ -232,7 +228,7 @@ func reopenSerialPort() error {
 	return nil
 }
 
-func handleSerialChannel(d *webrtc.DataChannel) {
+func handleSerialChannel(d *webrtc.DataChannel, session *Session) {
 	d.OnOpen(func() {
 		go func() {
 			buf := make([]byte, 1024)
@@ -257,6 +253,10 @@ func handleSerialChannel(d *webrtc.DataChannel) {
 		if port == nil {
 			return
 		}
+		// everyone sees the console, only the controller types into it
+		if !sessions.hasControl(session) {
+			return
+		}
 		_, err := port.Write(msg.Data)
 		if err != nil {
 			logger.Errorf("Failed to write to serial: %v", err)
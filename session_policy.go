@@ -0,0 +1,137 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SessionPolicyConfig ends sessions left open, e.g. a forgotten browser tab.
+// A session is idle when it has sent no user input, i.e. no HID report or
+// other RPC that needs control, see RPCHandler.RequiresControl, and has not
+// called keepSessionAlive. RPCs polling the device state do not count.
+type SessionPolicyConfig struct {
+	// IdleTimeoutMin ends sessions idle for that long, 0 to disable. WHEP
+	// players are never ended for being idle.
+	IdleTimeoutMin int `json:"idle_timeout_min"`
+	// MaxDurationMin ends sessions connected for that long, 0 to disable
+	MaxDurationMin int `json:"max_duration_min"`
+	// WarningSec is how long before the end the sessionExpiring event is sent
+	WarningSec int `json:"warning_sec"`
+}
+
+// SessionExpiring is sent to a session before it is ended, Reason is idle or
+// max_duration
+type SessionExpiring struct {
+	Reason      string    `json:"reason"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	SecondsLeft int       `json:"secondsLeft"`
+}
+
+const sessionPolicyInterval = 5 * time.Second
+
+func (s *Session) markActivity() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (s *Session) lastActivityTime() time.Time {
+	if last := s.lastActivity.Load(); last != 0 {
+		return time.Unix(0, last)
+	}
+	return s.connectedAt
+}
+
+func idleTimeout() time.Duration {
+	return time.Duration(config.SessionPolicy.IdleTimeoutMin) * time.Minute
+}
+
+// hasActiveSessions reports whether a session was active within the idle
+// timeout, the auto update does not wait for idle sessions
+func hasActiveSessions() bool {
+	timeout := idleTimeout()
+	for _, session := range sessions.list() {
+		if timeout == 0 || time.Since(session.lastActivityTime()) < timeout {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionDeadline returns when session ends and why, a zero time if never
+func sessionDeadline(session *Session, policy SessionPolicyConfig) (time.Time, string) {
+	var deadline time.Time
+	reason := ""
+	if policy.IdleTimeoutMin > 0 && session.source != "whep" {
+		deadline = session.lastActivityTime().Add(time.Duration(policy.IdleTimeoutMin) * time.Minute)
+		reason = "idle"
+	}
+	if policy.MaxDurationMin > 0 {
+		end := session.connectedAt.Add(time.Duration(policy.MaxDurationMin) * time.Minute)
+		if deadline.IsZero() || end.Before(deadline) {
+			deadline = end
+			reason = "max_duration"
+		}
+	}
+	return deadline, reason
+}
+
+func enforceSessionPolicy() {
+	policy := config.SessionPolicy
+	warning := time.Duration(policy.WarningSec) * time.Second
+	now := time.Now()
+	for _, session := range sessions.list() {
+		deadline, reason := sessionDeadline(session, policy)
+		if deadline.IsZero() {
+			continue
+		}
+		if !now.Before(deadline) {
+			if reason == "idle" {
+				terminateSession(session, "idle timeout")
+			} else {
+				terminateSession(session, "maximum session duration reached")
+			}
+			continue
+		}
+		// one warning per deadline, activity after it moves an idle deadline
+		if now.Add(warning).Before(deadline) || session.expiryWarned.Equal(deadline) {
+			continue
+		}
+		session.expiryWarned = deadline
+		if session.RPCChannel != nil {
+			writeJSONRPCEvent("sessionExpiring", SessionExpiring{
+				Reason:      reason,
+				ExpiresAt:   deadline,
+				SecondsLeft: int(deadline.Sub(now).Seconds()),
+			}, session)
+		}
+	}
+}
+
+func runSessionPolicy() {
+	for {
+		time.Sleep(sessionPolicyInterval)
+		enforceSessionPolicy()
+	}
+}
+
+// rpcKeepSessionAlive resets the idle timeout of the calling session, e.g.
+// after a sessionExpiring event. It does not extend the maximum duration.
+func rpcKeepSessionAlive(session *Session) error {
+	session.markActivity()
+	return nil
+}
+
+func rpcGetSessionPolicy() (SessionPolicyConfig, error) {
+	return config.SessionPolicy, nil
+}
+
+func rpcSetSessionPolicy(params SessionPolicyConfig) error {
+	if params.IdleTimeoutMin < 0 || params.MaxDurationMin < 0 || params.WarningSec < 0 {
+		return errors.New("durations must not be negative")
+	}
+	config.SessionPolicy = params
+	if err := SaveConfig(); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,428 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v4"
+)
+
+// sessionRegistry tracks the connected WebRTC sessions. With
+// Config.MultiSession any number of them can watch the video, one at a time
+// controls the host: HID, ATX, power, virtual media and the settings. Moving
+// control to another session needs the controller's approval, see
+// takeover.go. Without it only the controller stays connected, besides
+// WHEP players: a new session asks the controller for control the same way
+// and replaces it once approved, or is closed when denied.
+type sessionRegistry struct {
+	mu         sync.Mutex
+	sessions   []*Session // oldest first
+	controller *Session
+}
+
+var sessions = &sessionRegistry{}
+
+// SessionIdentity describes who is behind a session
+type SessionIdentity struct {
+	ID string `json:"id"`
+	// Source is local for the device web UI, cloud for sessions relayed by
+	// the cloud and whep for WHEP players
+	Source string `json:"source"`
+	// Identity is the account of cloud sessions, empty for the others
+	Identity string `json:"identity"`
+	// RemoteAddress is the client IP for local and WHEP sessions and the
+	// address of the ICE candidate in use for cloud ones
+	RemoteAddress string    `json:"remoteAddress"`
+	ConnectedAt   time.Time `json:"connectedAt"`
+}
+
+// SessionInfo is a session in listSessions and the session lifecycle events
+type SessionInfo struct {
+	SessionIdentity
+	ViewOnly   bool `json:"viewOnly"`
+	HasControl bool `json:"hasControl"`
+	// State is the ICE connection state
+	State         string   `json:"state"`
+	BytesSent     uint64   `json:"bytesSent"`
+	BytesReceived uint64   `json:"bytesReceived"`
+	DataChannels  []string `json:"dataChannels"`
+	// LastActivity is the last user input of the session, see
+	// SessionPolicyConfig
+	LastActivity time.Time `json:"lastActivity"`
+}
+
+// ControlState is sent to each session, HasControl differs between them
+type ControlState struct {
+	SessionID  string           `json:"sessionId"`
+	HasControl bool             `json:"hasControl"`
+	Controller *SessionIdentity `json:"controller,omitempty"`
+	// Takeover is the request waiting for the controller's answer, only
+	// returned by requestControl
+	Takeover *TakeoverRequest `json:"takeover,omitempty"`
+}
+
+var errControlRequired = errors.New("this session is view-only, request control first")
+
+func (s *Session) identity() SessionIdentity {
+	return SessionIdentity{
+		ID:            s.ID,
+		Source:        s.source,
+		Identity:      s.remoteIdentity,
+		RemoteAddress: s.remoteAddress(),
+		ConnectedAt:   s.connectedAt,
+	}
+}
+
+func (s *Session) remoteAddress() string {
+	if s.remoteAddr != "" {
+		return s.remoteAddr
+	}
+	// the transports may not be set up yet or already torn down
+	sctp := s.peerConnection.SCTP()
+	if sctp == nil || sctp.Transport() == nil || sctp.Transport().ICETransport() == nil {
+		return ""
+	}
+	pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return ""
+	}
+	return net.JoinHostPort(pair.Remote.Address, strconv.Itoa(int(pair.Remote.Port)))
+}
+
+func (s *Session) String() string {
+	who := s.remoteIdentity
+	if who == "" {
+		who = s.remoteAddress()
+	}
+	return fmt.Sprintf("%s (%s %s)", s.ID, s.source, who)
+}
+
+func (s *Session) info() SessionInfo {
+	info := SessionInfo{
+		SessionIdentity: s.identity(),
+		ViewOnly:        s.viewOnly,
+		HasControl:      sessions.hasControl(s),
+		State:           s.peerConnection.ICEConnectionState().String(),
+		DataChannels:    s.openDataChannels(),
+		LastActivity:    s.lastActivityTime(),
+	}
+	for _, stat := range s.peerConnection.GetStats() {
+		if transport, ok := stat.(webrtc.TransportStats); ok {
+			info.BytesSent += transport.BytesSent
+			info.BytesReceived += transport.BytesReceived
+		}
+	}
+	return info
+}
+
+// trackDataChannel records a data channel the browser opened, the channel
+// handlers own OnClose so closed ones are dropped when listed
+func (s *Session) trackDataChannel(d *webrtc.DataChannel) {
+	s.channelsLock.Lock()
+	defer s.channelsLock.Unlock()
+	s.channels = append(s.channels, d)
+}
+
+func (s *Session) openDataChannels() []string {
+	s.channelsLock.Lock()
+	defer s.channelsLock.Unlock()
+	labels := []string{}
+	open := s.channels[:0]
+	for _, d := range s.channels {
+		switch d.ReadyState() {
+		case webrtc.DataChannelStateClosing, webrtc.DataChannelStateClosed:
+			continue
+		case webrtc.DataChannelStateOpen:
+			labels = append(labels, d.Label())
+		}
+		open = append(open, d)
+	}
+	s.channels = open
+	return labels
+}
+
+// add registers a connected session, it takes control if nobody has it.
+// Without Config.MultiSession it asks the controller for it otherwise. It
+// returns the number of sessions.
+func (r *sessionRegistry) add(session *Session) int {
+	r.mu.Lock()
+	r.sessions = append(r.sessions, session)
+	count := len(r.sessions)
+	controller := r.controller
+	changed := false
+	if r.controller == nil && !session.viewOnly {
+		r.controller = session
+		changed = true
+	}
+	r.mu.Unlock()
+	logger.Infof("session %s connected", session)
+	broadcastJSONRPCEvent("sessionConnected", session.info())
+	if changed {
+		announceControl()
+		replaceOtherSessions(session)
+	} else if controller != nil && !session.viewOnly && !config.MultiSession {
+		// one session at a time, the controller decides whether the new
+		// one replaces it
+		if _, err := requestTakeover(session, controller); err != nil {
+			terminateSession(session, err.Error())
+		}
+	}
+	return count
+}
+
+// replaceOtherSessions closes the sessions other than the controller when
+// MultiSession is off
+func replaceOtherSessions(controller *Session) {
+	if config.MultiSession {
+		return
+	}
+	for _, s := range sessions.list() {
+		if s != controller && !s.viewOnly {
+			replaceSession(s)
+		}
+	}
+}
+
+// replaceSession closes a session replaced by a newer one, the UI offers to
+// take the device back
+func replaceSession(session *Session) {
+	logger.Infof("session %s replaced by a new session", session)
+	if session.RPCChannel != nil {
+		writeJSONRPCEvent("otherSessionConnected", nil, session)
+	}
+	peerConn := session.peerConnection
+	go func() {
+		time.Sleep(1 * time.Second)
+		_ = peerConn.Close()
+	}()
+}
+
+// remove unregisters a session, control passes to the most recent session
+// left. It returns the number of sessions left.
+func (r *sessionRegistry) remove(session *Session) int {
+	r.mu.Lock()
+	for i, s := range r.sessions {
+		if s == session {
+			r.sessions = append(r.sessions[:i], r.sessions[i+1:]...)
+			break
+		}
+	}
+	changed := false
+	if r.controller == session {
+		r.controller = nil
+		for i := len(r.sessions) - 1; i >= 0; i-- {
+			if !r.sessions[i].viewOnly {
+				r.controller = r.sessions[i]
+				break
+			}
+		}
+		changed = true
+	}
+	count := len(r.sessions)
+	r.mu.Unlock()
+	logger.Infof("session %s disconnected", session)
+	broadcastJSONRPCEvent("sessionDisconnected", session.info())
+	onTakeoverSessionGone(session)
+	if changed {
+		announceControl()
+	}
+	return count
+}
+
+func (r *sessionRegistry) get(id string) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sessions {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func (r *sessionRegistry) contains(session *Session) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sessions {
+		if s == session {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *sessionRegistry) list() []*Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Session(nil), r.sessions...)
+}
+
+func (r *sessionRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+func (r *sessionRegistry) getController() *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.controller
+}
+
+func (r *sessionRegistry) hasControl(session *Session) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return session != nil && r.controller == session
+}
+
+// setController hands control to session, nil leaves nobody in control
+func (r *sessionRegistry) setController(session *Session) {
+	r.mu.Lock()
+	if r.controller == session {
+		r.mu.Unlock()
+		return
+	}
+	r.controller = session
+	r.mu.Unlock()
+	announceControl()
+	if session != nil {
+		replaceOtherSessions(session)
+	}
+}
+
+func (r *sessionRegistry) controlState(session *Session) ControlState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state := ControlState{SessionID: session.ID, HasControl: r.controller == session}
+	if r.controller != nil {
+		controller := r.controller.identity()
+		state.Controller = &controller
+	}
+	return state
+}
+
+// announceControl sends every session its own view of who is in control
+func announceControl() {
+	controller := sessions.getController()
+	if controller != nil {
+		logger.Infof("session %s has control", controller)
+	} else {
+		logger.Info("no session has control")
+	}
+	for _, session := range sessions.list() {
+		if session.RPCChannel != nil {
+			writeJSONRPCEvent("controlChanged", sessions.controlState(session), session)
+		}
+	}
+}
+
+func rpcGetControlState(session *Session) (ControlState, error) {
+	return sessions.controlState(session), nil
+}
+
+// rpcRequestControl gives the calling session control right away when
+// nobody has it, otherwise it asks the controller with a takeover request
+func rpcRequestControl(session *Session) (ControlState, error) {
+	if session.viewOnly {
+		return ControlState{}, errors.New("view-only sessions cannot take control")
+	}
+	controller := sessions.getController()
+	if controller == nil {
+		sessions.setController(session)
+		return sessions.controlState(session), nil
+	}
+	state := sessions.controlState(session)
+	if controller == session {
+		return state, nil
+	}
+	request, err := requestTakeover(session, controller)
+	if err != nil {
+		return ControlState{}, err
+	}
+	state.Takeover = request
+	return state, nil
+}
+
+// rpcReleaseControl hands control to a pending takeover requester, or
+// leaves nobody in control until a session requests it
+func rpcReleaseControl(session *Session) (ControlState, error) {
+	if sessions.hasControl(session) {
+		sessions.setController(nil)
+		onTakeoverSessionGone(session)
+	}
+	return sessions.controlState(session), nil
+}
+
+// terminateSession closes a session, it is told why first
+func terminateSession(session *Session, reason string) {
+	logger.Infof("terminating session %s: %s", session, reason)
+	if session.RPCChannel != nil {
+		writeJSONRPCEvent("sessionTerminated", map[string]string{"reason": reason}, session)
+	}
+	_ = session.peerConnection.Close()
+}
+
+func listSessions() []SessionInfo {
+	list := sessions.list()
+	infos := make([]SessionInfo, 0, len(list))
+	for _, session := range list {
+		infos = append(infos, session.info())
+	}
+	return infos
+}
+
+func rpcListSessions() ([]SessionInfo, error) {
+	return listSessions(), nil
+}
+
+// rpcTerminateSession closes the session with id, sessions other than the
+// caller's need an admin
+func rpcTerminateSession(session *Session, id string) error {
+	target := sessions.get(id)
+	if target == nil {
+		return fmt.Errorf("session %s not found", id)
+	}
+	if target != session && !session.admin {
+		return errors.New("only admin sessions can terminate other sessions")
+	}
+	terminateSession(target, fmt.Sprintf("terminated by session %s", session.ID))
+	return nil
+}
+
+func rpcGetMultiSession() (bool, error) {
+	return config.MultiSession, nil
+}
+
+func rpcSetMultiSession(enabled bool) error {
+	config.MultiSession = enabled
+	if err := SaveConfig(); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
+
+func handleListSessions(c *gin.Context) {
+	c.JSON(http.StatusOK, listSessions())
+}
+
+// handleTerminateSession closes any session, like an admin session can, so
+// it needs the local password
+func handleTerminateSession(c *gin.Context) {
+	if config.LocalAuthMode != "password" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "terminating sessions needs a local password"})
+		return
+	}
+	target := sessions.get(c.Param("id"))
+	if target == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	terminateSession(target, "terminated from "+c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"message": "session terminated"})
+}
@@ -0,0 +1,358 @@
+package kvm
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v4"
+)
+
+// Trickle ICE signaling. The browser sends its offer and then its candidates
+// as it finds them, the device answers right away and trickles its own
+// candidates back, so a slow or unreachable STUN server no longer delays the
+// session setup.
+//
+// Local sessions use the websocket at /webrtc/signaling, cloud sessions the
+// cloud websocket, see runWebsocketClient. Both also carry the ICE restart
+// offers and answers, see ice_restart.go.
+
+// SignalingMessage is the envelope of the local signaling websocket.
+//
+// The browser sends offer, a WebRTCSessionRequest whose SessionID and
+// ResumeToken resume an existing session, new-ice-candidate, and answer to a
+// device offer. The device sends answer, session with the SignalingSession
+// of a new session, new-ice-candidate, offer with a SignalingOffer to
+// restart ICE, and error. A new-ice-candidate with null data ends the
+// candidates.
+type SignalingMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// SignalingSession identifies a new session, ResumeToken is needed to resume
+// it later and only sent here
+type SignalingSession struct {
+	SessionID   string `json:"sessionId"`
+	ResumeToken string `json:"resumeToken"`
+}
+
+// SignalingOffer is an ICE restart offer from the device
+type SignalingOffer struct {
+	SessionID string `json:"sessionId"`
+	Sd        string `json:"sd"`
+}
+
+// trickleSignaler holds the local candidates until the answer is sent, the
+// browser cannot add them before it has the answer. It only trickles the
+// first gathering, ICE restarts send complete descriptions.
+type trickleSignaler struct {
+	mu        sync.Mutex
+	answered  bool
+	done      bool
+	pending   []*webrtc.ICECandidateInit
+	candidate func(*webrtc.ICECandidateInit) error
+}
+
+func newTrickleSignaler(candidate func(*webrtc.ICECandidateInit) error) *trickleSignaler {
+	return &trickleSignaler{candidate: candidate}
+}
+
+func (t *trickleSignaler) onCandidate(candidate *webrtc.ICECandidateInit) {
+	t.mu.Lock()
+	if t.done {
+		t.mu.Unlock()
+		return
+	}
+	t.done = candidate == nil
+	if !t.answered {
+		t.pending = append(t.pending, candidate)
+		t.mu.Unlock()
+		return
+	}
+	t.mu.Unlock()
+	if err := t.candidate(candidate); err != nil {
+		logger.Warnf("failed to send ICE candidate: %v", err)
+	}
+}
+
+// answer sends the answer with send, then the candidates found meanwhile
+func (t *trickleSignaler) answer(send func() error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := send(); err != nil {
+		return err
+	}
+	t.answered = true
+	for _, candidate := range t.pending {
+		if err := t.candidate(candidate); err != nil {
+			logger.Warnf("failed to send ICE candidate: %v", err)
+		}
+	}
+	t.pending = nil
+	return nil
+}
+
+var (
+	signalingSessionsLock sync.Mutex
+	// signalingSessions are the sessions by ID from their creation until
+	// they close, including those still connecting, for the signaling
+	// messages that refer to a session
+	signalingSessions = map[string]*Session{}
+)
+
+func registerSignalingSession(session *Session) {
+	signalingSessionsLock.Lock()
+	defer signalingSessionsLock.Unlock()
+	signalingSessions[session.ID] = session
+}
+
+func unregisterSignalingSession(session *Session) {
+	signalingSessionsLock.Lock()
+	defer signalingSessionsLock.Unlock()
+	delete(signalingSessions, session.ID)
+}
+
+func lookupSignalingSession(id string) *Session {
+	signalingSessionsLock.Lock()
+	defer signalingSessionsLock.Unlock()
+	return signalingSessions[id]
+}
+
+// handleWebRTCSignaling serves the local trickle ICE signaling websocket. The
+// websocket may stay open after the session connected, closing it does not
+// end the session.
+func handleWebRTCSignaling(c *gin.Context) {
+	conn, err := websocket.Accept(c.Writer, c.Request, nil)
+	if err != nil {
+		logger.Warnf("failed to accept signaling websocket: %v", err)
+		return
+	}
+	defer conn.CloseNow()
+
+	ctx := c.Request.Context()
+	send := func(msgType string, data interface{}) error {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		return wsjson.Write(ctx, conn, SignalingMessage{Type: msgType, Data: raw})
+	}
+
+	// the websocket signals for one session at a time, the last offered or
+	// resumed
+	var session *Session
+	var path *signalingPath
+	attach := func(s *Session) {
+		if session != nil {
+			session.clearSignalingPath(path)
+		}
+		session = s
+		path = &signalingPath{sendOffer: func(sd string) error {
+			return send("offer", SignalingOffer{SessionID: s.ID, Sd: sd})
+		}}
+		s.setSignalingPath(path)
+	}
+	defer func() {
+		if session != nil {
+			session.clearSignalingPath(path)
+		}
+	}()
+	for {
+		var msg SignalingMessage
+		if err := wsjson.Read(ctx, conn, &msg); err != nil {
+			if websocket.CloseStatus(err) != websocket.StatusNormalClosure && ctx.Err() == nil {
+				logger.Debugf("signaling websocket closed: %v", err)
+			}
+			return
+		}
+
+		switch msg.Type {
+		case "offer":
+			var req WebRTCSessionRequest
+			if err := json.Unmarshal(msg.Data, &req); err != nil {
+				_ = send("error", err.Error())
+				continue
+			}
+			if req.SessionID != "" {
+				resumed, err := resumeLocalSession(req, send)
+				if err != nil {
+					logger.Warnf("failed to resume session %s: %v", req.SessionID, err)
+					_ = send("error", err.Error())
+					continue
+				}
+				attach(resumed)
+				continue
+			}
+			created, err := newLocalTrickleSession(c, req.Sd, send)
+			if err != nil {
+				logger.Warnf("failed to start session over signaling websocket: %v", err)
+				_ = send("error", err.Error())
+				continue
+			}
+			attach(created)
+		case "answer":
+			if session == nil {
+				_ = send("error", "answer before offer")
+				continue
+			}
+			var sd string
+			if err := json.Unmarshal(msg.Data, &sd); err != nil {
+				_ = send("error", err.Error())
+				continue
+			}
+			if err := rpcSetICERestartAnswer(session, sd); err != nil {
+				_ = send("error", err.Error())
+			}
+		case "new-ice-candidate":
+			if session == nil {
+				_ = send("error", "new-ice-candidate before offer")
+				continue
+			}
+			var candidate webrtc.ICECandidateInit
+			if err := json.Unmarshal(msg.Data, &candidate); err != nil {
+				_ = send("error", err.Error())
+				continue
+			}
+			if err := session.AddICECandidate(candidate); err != nil {
+				logger.Warnf("session %s: %v", session.ID, err)
+			}
+		default:
+			_ = send("error", "unknown message type "+msg.Type)
+		}
+	}
+}
+
+func newLocalTrickleSession(c *gin.Context, offer string, send func(string, interface{}) error) (*Session, error) {
+	// admins like in handleWebRTCSession
+	session, err := newSession(SessionConfig{
+		Source:     "local",
+		RemoteAddr: c.ClientIP(),
+		Admin:      config.LocalAuthMode == "password",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signaler := newTrickleSignaler(func(candidate *webrtc.ICECandidateInit) error {
+		return send("new-ice-candidate", candidate)
+	})
+	sd, err := session.ExchangeOfferTrickle(offer, signaler.onCandidate)
+	if err != nil {
+		_ = session.peerConnection.Close()
+		return nil, err
+	}
+	if err := signaler.answer(func() error { return send("answer", sd) }); err != nil {
+		_ = session.peerConnection.Close()
+		return nil, err
+	}
+	if err := send("session", SignalingSession{SessionID: session.ID, ResumeToken: session.resumeToken}); err != nil {
+		_ = session.peerConnection.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+// resumableLocalSession returns the local session req resumes, nil unless
+// it carries the resume token of the session. Any local client could guess
+// or see a session ID, the token only went to the browser that started it.
+func resumableLocalSession(req WebRTCSessionRequest) *Session {
+	session := lookupSignalingSession(req.SessionID)
+	if session == nil || session.source != "local" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(req.ResumeToken), []byte(session.resumeToken)) != 1 {
+		logger.Warnf("session %s: resume attempt with a wrong token", session.ID)
+		return nil
+	}
+	return session
+}
+
+// resumeLocalSession answers an ICE restart offer for a local session, e.g.
+// from a browser that reconnected the websocket after changing network
+func resumeLocalSession(req WebRTCSessionRequest, send func(string, interface{}) error) (*Session, error) {
+	session := resumableLocalSession(req)
+	if session == nil {
+		return nil, errors.New("no such session")
+	}
+	sd, err := rpcRenegotiate(session, req.Sd)
+	if err != nil {
+		return nil, err
+	}
+	if err := send("answer", sd); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// CloudSignalingMessage is a signaling message for a session already set up
+// over the cloud websocket. Type is new-ice-candidate in both directions, a
+// nil candidate ending them, offer for a device ICE restart offer and answer
+// for the browser answer to it.
+type CloudSignalingMessage struct {
+	Type      string                   `json:"type"`
+	SessionID string                   `json:"sessionId"`
+	Candidate *webrtc.ICECandidateInit `json:"candidate"`
+	Sd        string                   `json:"sd,omitempty"`
+}
+
+func handleCloudSignalingMessage(msg CloudSignalingMessage) {
+	switch msg.Type {
+	case "new-ice-candidate":
+		handleCloudICECandidate(msg)
+	case "answer":
+		session := lookupSignalingSession(msg.SessionID)
+		if session == nil || session.source != "cloud" {
+			cloudLogger.Warnf("answer for unknown session %s", msg.SessionID)
+			return
+		}
+		if err := rpcSetICERestartAnswer(session, msg.Sd); err != nil {
+			cloudLogger.Warnf("session %s: %v", session.ID, err)
+		}
+	default:
+		cloudLogger.Warnf("unknown signaling message type %s", msg.Type)
+	}
+}
+
+// handleCloudICECandidate adds a candidate the cloud relayed from the browser
+func handleCloudICECandidate(msg CloudSignalingMessage) {
+	session := lookupSignalingSession(msg.SessionID)
+	if session == nil || session.source != "cloud" {
+		cloudLogger.Warnf("ICE candidate for unknown session %s", msg.SessionID)
+		return
+	}
+	if msg.Candidate == nil {
+		return
+	}
+	if err := session.AddICECandidate(*msg.Candidate); err != nil {
+		cloudLogger.Warnf("session %s: %v", session.ID, err)
+	}
+}
+
+// cloudSignalingPath sends the device ICE restart offers of session to the
+// cloud, they stop when the cloud websocket closes
+func cloudSignalingPath(c *websocket.Conn, session *Session) *signalingPath {
+	return &signalingPath{sendOffer: func(sd string) error {
+		return wsjson.Write(context.Background(), c, CloudSignalingMessage{
+			Type:      "offer",
+			SessionID: session.ID,
+			Sd:        sd,
+		})
+	}}
+}
+
+// cloudCandidateSender trickles the device candidates of session to the cloud
+func cloudCandidateSender(c *websocket.Conn, session *Session) func(*webrtc.ICECandidateInit) error {
+	return func(candidate *webrtc.ICECandidateInit) error {
+		return wsjson.Write(context.Background(), c, CloudSignalingMessage{
+			Type:      "new-ice-candidate",
+			SessionID: session.ID,
+			Candidate: candidate,
+		})
+	}
+}
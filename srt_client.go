@@ -0,0 +1,410 @@
+package kvm
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A minimal SRT caller (live mode, no encryption) sending an MPEG transport
+// stream. It implements the HSv5 handshake, ACK/ACKACK, keepalives and
+// retransmission on NAK, which is what listeners such as ffmpeg, OBS or
+// mediamtx need. Specification: draft-sharabayko-srt.
+
+const (
+	srtHeaderSize      = 16
+	srtPayloadSize     = 7 * tsPacketSize
+	srtMTU             = 1500
+	srtFlowWindow      = 8192
+	srtDefaultLatency  = 120 * time.Millisecond
+	srtHandshakeTries  = 5
+	srtHandshakeWait   = 1 * time.Second
+	srtKeepalivePeriod = 1 * time.Second
+	srtPeerTimeout     = 5 * time.Second
+	srtSendBufferSize  = 4096
+
+	srtCtrlHandshake = 0x0000
+	srtCtrlKeepalive = 0x0001
+	srtCtrlACK       = 0x0002
+	srtCtrlNAK       = 0x0003
+	srtCtrlShutdown  = 0x0005
+	srtCtrlACKACK    = 0x0006
+
+	srtHandshakeInduction  = 1
+	srtHandshakeConclusion = 0xffffffff
+	srtHandshakeMagic      = 0x4a17
+	srtHandshakeRejectMin  = 1000
+
+	srtExtHSReq = 1
+	srtExtSID   = 5
+
+	srtExtFlagHSReq  = 0x01
+	srtExtFlagConfig = 0x04
+
+	srtVersion         = 0x00010502
+	srtFlagTSBPDSender = 0x01
+	srtFlagTSBPDRecv   = 0x02
+	srtFlagTLPktDrop   = 0x08
+	srtFlagNAKReport   = 0x10
+	srtFlagRexmit      = 0x20
+
+	srtSeqMask = 0x7fffffff
+)
+
+type srtClient struct {
+	conn      *net.UDPConn
+	start     time.Time
+	socketID  uint32
+	peerID    uint32
+	latency   time.Duration
+	bytesSent int64
+
+	mu       sync.Mutex
+	seq      uint32
+	msgNo    uint32
+	sent     map[uint32][]byte
+	sentSeqs []uint32
+	pending  []byte
+	closed   chan struct{}
+	muxer    *tsMuxer
+}
+
+func srtRandomUint32() uint32 {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return binary.BigEndian.Uint32(b)
+}
+
+// dialSRT performs the caller handshake with srt://host:port?streamid=...&latency=ms
+func dialSRT(ctx context.Context, target *url.URL) (*srtClient, error) {
+	query := target.Query()
+	if query.Get("passphrase") != "" {
+		return nil, errors.New("encrypted SRT streams are not supported")
+	}
+	latency := srtDefaultLatency
+	if value := query.Get("latency"); value != "" {
+		ms, err := strconv.Atoi(value)
+		if err != nil || ms < 0 {
+			return nil, fmt.Errorf("invalid latency: %s", value)
+		}
+		latency = time.Duration(ms) * time.Millisecond
+	}
+	if target.Port() == "" {
+		return nil, errors.New("SRT URL must include a port")
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", target.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &srtClient{
+		conn:     conn,
+		start:    time.Now(),
+		socketID: srtRandomUint32() & 0x3fffffff,
+		seq:      srtRandomUint32() & srtSeqMask,
+		latency:  latency,
+		sent:     make(map[uint32][]byte),
+		closed:   make(chan struct{}),
+	}
+	c.muxer = newTSMuxer(c)
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	defer stop()
+	if err := c.handshake(addr, query.Get("streamid")); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	return c, nil
+}
+
+func (c *srtClient) timestamp() uint32 {
+	return uint32(time.Since(c.start).Microseconds())
+}
+
+func (c *srtClient) controlPacket(ctrlType uint16, typeInfo uint32, cif []byte) []byte {
+	packet := make([]byte, srtHeaderSize, srtHeaderSize+len(cif))
+	binary.BigEndian.PutUint16(packet[0:], 0x8000|ctrlType)
+	binary.BigEndian.PutUint32(packet[4:], typeInfo)
+	binary.BigEndian.PutUint32(packet[8:], c.timestamp())
+	binary.BigEndian.PutUint32(packet[12:], c.peerID)
+	return append(packet, cif...)
+}
+
+// srtStreamIDExtension encodes the stream id, SRT sends it as little endian
+// 32-bit words
+func srtStreamIDExtension(streamID string) []byte {
+	padded := []byte(streamID)
+	for len(padded)%4 != 0 {
+		padded = append(padded, 0)
+	}
+	for i := 0; i < len(padded); i += 4 {
+		padded[i], padded[i+1], padded[i+2], padded[i+3] = padded[i+3], padded[i+2], padded[i+1], padded[i]
+	}
+	return padded
+}
+
+func (c *srtClient) handshakeCIF(version uint32, extField uint16, hsType uint32, cookie uint32, addr *net.UDPAddr) []byte {
+	cif := binary.BigEndian.AppendUint32(nil, version)
+	cif = binary.BigEndian.AppendUint16(cif, 0) // no encryption
+	cif = binary.BigEndian.AppendUint16(cif, extField)
+	cif = binary.BigEndian.AppendUint32(cif, c.seq)
+	cif = binary.BigEndian.AppendUint32(cif, srtMTU)
+	cif = binary.BigEndian.AppendUint32(cif, srtFlowWindow)
+	cif = binary.BigEndian.AppendUint32(cif, hsType)
+	cif = binary.BigEndian.AppendUint32(cif, c.socketID)
+	cif = binary.BigEndian.AppendUint32(cif, cookie)
+	ip := make([]byte, 16)
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		// libsrt writes an IPv4 address as a little endian first word
+		copy(ip, []byte{ip4[3], ip4[2], ip4[1], ip4[0]})
+	} else {
+		copy(ip, addr.IP.To16())
+	}
+	return append(cif, ip...)
+}
+
+// exchangeHandshake sends a handshake and waits for the reply, retrying a few times
+func (c *srtClient) exchangeHandshake(packet []byte) ([]byte, error) {
+	reply := make([]byte, srtMTU)
+	for try := 0; try < srtHandshakeTries; try++ {
+		if _, err := c.conn.Write(packet); err != nil {
+			return nil, err
+		}
+		_ = c.conn.SetReadDeadline(time.Now().Add(srtHandshakeWait))
+		for {
+			n, err := c.conn.Read(reply)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if n >= srtHeaderSize+48 && binary.BigEndian.Uint16(reply)&0x7fff == srtCtrlHandshake && reply[0]&0x80 != 0 {
+				_ = c.conn.SetReadDeadline(time.Time{})
+				return reply[:n], nil
+			}
+		}
+	}
+	return nil, errors.New("no response from listener")
+}
+
+func (c *srtClient) handshake(addr *net.UDPAddr, streamID string) error {
+	induction := c.controlPacket(srtCtrlHandshake, 0, c.handshakeCIF(4, 2, srtHandshakeInduction, 0, addr))
+	reply, err := c.exchangeHandshake(induction)
+	if err != nil {
+		return err
+	}
+	cif := reply[srtHeaderSize:]
+	if binary.BigEndian.Uint32(cif[0:]) != 5 || binary.BigEndian.Uint16(cif[6:]) != srtHandshakeMagic {
+		return errors.New("listener does not support HSv5")
+	}
+	cookie := binary.BigEndian.Uint32(cif[28:])
+
+	extFlags := uint16(srtExtFlagHSReq)
+	if streamID != "" {
+		extFlags |= srtExtFlagConfig
+	}
+	conclusion := c.handshakeCIF(5, extFlags, srtHandshakeConclusion, cookie, addr)
+	latency := uint32(c.latency.Milliseconds())
+	conclusion = binary.BigEndian.AppendUint16(conclusion, srtExtHSReq)
+	conclusion = binary.BigEndian.AppendUint16(conclusion, 3)
+	conclusion = binary.BigEndian.AppendUint32(conclusion, srtVersion)
+	conclusion = binary.BigEndian.AppendUint32(conclusion, srtFlagTSBPDSender|srtFlagTSBPDRecv|srtFlagTLPktDrop|srtFlagNAKReport|srtFlagRexmit)
+	conclusion = binary.BigEndian.AppendUint32(conclusion, latency<<16|latency)
+	if streamID != "" {
+		sid := srtStreamIDExtension(streamID)
+		conclusion = binary.BigEndian.AppendUint16(conclusion, srtExtSID)
+		conclusion = binary.BigEndian.AppendUint16(conclusion, uint16(len(sid)/4))
+		conclusion = append(conclusion, sid...)
+	}
+	reply, err = c.exchangeHandshake(c.controlPacket(srtCtrlHandshake, 0, conclusion))
+	if err != nil {
+		return err
+	}
+	cif = reply[srtHeaderSize:]
+	hsType := binary.BigEndian.Uint32(cif[20:])
+	if hsType >= srtHandshakeRejectMin && hsType != srtHandshakeConclusion {
+		return fmt.Errorf("listener rejected the connection (reason %d)", hsType-srtHandshakeRejectMin)
+	}
+	if hsType != srtHandshakeConclusion {
+		return fmt.Errorf("unexpected handshake type 0x%x", hsType)
+	}
+	c.peerID = binary.BigEndian.Uint32(cif[24:])
+	return nil
+}
+
+// Write is called by the transport stream muxer, whole TS packets are
+// grouped into SRT payloads of seven
+func (c *srtClient) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, p...)
+	for len(c.pending) >= srtPayloadSize {
+		if err := c.sendData(c.pending[:srtPayloadSize]); err != nil {
+			return 0, err
+		}
+		c.pending = c.pending[srtPayloadSize:]
+	}
+	return len(p), nil
+}
+
+// flush sends a partially filled payload, at the end of an access unit
+func (c *srtClient) flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) == 0 {
+		return nil
+	}
+	err := c.sendData(c.pending)
+	c.pending = nil
+	return err
+}
+
+// sendData must be called with c.mu held
+func (c *srtClient) sendData(payload []byte) error {
+	packet := make([]byte, srtHeaderSize, srtHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(packet[0:], c.seq)
+	c.msgNo = (c.msgNo + 1) & 0x03ffffff
+	binary.BigEndian.PutUint32(packet[4:], 0xc0000000|c.msgNo) // solo packet, in order not required
+	binary.BigEndian.PutUint32(packet[8:], c.timestamp())
+	binary.BigEndian.PutUint32(packet[12:], c.peerID)
+	packet = append(packet, payload...)
+
+	c.sent[c.seq] = packet
+	c.sentSeqs = append(c.sentSeqs, c.seq)
+	if len(c.sentSeqs) > srtSendBufferSize {
+		delete(c.sent, c.sentSeqs[0])
+		c.sentSeqs = c.sentSeqs[1:]
+	}
+	c.seq = (c.seq + 1) & srtSeqMask
+
+	n, err := c.conn.Write(packet)
+	c.bytesSent += int64(n)
+	return err
+}
+
+func (c *srtClient) WriteSample(nals [][]byte, sps []byte, pps []byte, duration time.Duration, keyframe bool) error {
+	if err := c.muxer.WriteSample(nals, sps, pps, duration, keyframe); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+func (c *srtClient) BytesSent() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytesSent
+}
+
+// acknowledge drops the packets the receiver got, everything before seq
+func (c *srtClient) acknowledge(seq uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.sentSeqs) > 0 && (seq-c.sentSeqs[0])&srtSeqMask < srtSeqMask/2 && c.sentSeqs[0] != seq {
+		delete(c.sent, c.sentSeqs[0])
+		c.sentSeqs = c.sentSeqs[1:]
+	}
+}
+
+// retransmit resends the packets listed in a loss report
+func (c *srtClient) retransmit(cif []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i+4 <= len(cif); i += 4 {
+		first := binary.BigEndian.Uint32(cif[i:])
+		last := first
+		if first&0x80000000 != 0 && i+8 <= len(cif) {
+			first &= srtSeqMask
+			i += 4
+			last = binary.BigEndian.Uint32(cif[i:]) & srtSeqMask
+		}
+		for seq := first; ; seq = (seq + 1) & srtSeqMask {
+			if packet, ok := c.sent[seq]; ok {
+				packet[4] |= 0x04 // retransmitted flag
+				binary.BigEndian.PutUint32(packet[8:], c.timestamp())
+				n, err := c.conn.Write(packet)
+				c.bytesSent += int64(n)
+				if err != nil {
+					return err
+				}
+			}
+			if seq == last || (seq-first)&srtSeqMask > srtSendBufferSize {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// run handles control packets from the listener until the connection fails
+func (c *srtClient) run() error {
+	go c.keepalive()
+	buf := make([]byte, srtMTU)
+	for {
+		_ = c.conn.SetReadDeadline(time.Now().Add(srtPeerTimeout))
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return errors.New("listener stopped responding")
+			}
+			return err
+		}
+		if n < srtHeaderSize || buf[0]&0x80 == 0 {
+			continue
+		}
+		packet := buf[:n]
+		typeInfo := binary.BigEndian.Uint32(packet[4:])
+		cif := packet[srtHeaderSize:]
+		switch binary.BigEndian.Uint16(packet) & 0x7fff {
+		case srtCtrlACK:
+			if len(cif) >= 4 {
+				c.acknowledge(binary.BigEndian.Uint32(cif) & srtSeqMask)
+			}
+			// light ACKs carry only the sequence number and are not acknowledged
+			if len(cif) > 4 {
+				if _, err := c.conn.Write(c.controlPacket(srtCtrlACKACK, typeInfo, nil)); err != nil {
+					return err
+				}
+			}
+		case srtCtrlNAK:
+			if err := c.retransmit(cif); err != nil {
+				return err
+			}
+		case srtCtrlShutdown:
+			return errors.New("listener closed the connection")
+		}
+	}
+}
+
+func (c *srtClient) keepalive() {
+	ticker := time.NewTicker(srtKeepalivePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			if _, err := c.conn.Write(c.controlPacket(srtCtrlKeepalive, 0, nil)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *srtClient) Close() error {
+	close(c.closed)
+	_, _ = c.conn.Write(c.controlPacket(srtCtrlShutdown, 0, nil))
+	return c.conn.Close()
+}
@@ -0,0 +1,297 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+)
+
+type StorageImageFormat string
+
+const (
+	StorageImageRaw      StorageImageFormat = "raw"
+	StorageImageMBRFAT32 StorageImageFormat = "mbr-fat32"
+	StorageImageMBRExFAT StorageImageFormat = "mbr-exfat"
+	StorageImageGPTFAT32 StorageImageFormat = "gpt-fat32"
+	StorageImageGPTExFAT StorageImageFormat = "gpt-exfat"
+)
+
+const (
+	sectorSize = 512
+	// partitions start at 1MiB, which keeps them aligned for flash media
+	partitionAlignment = 1024 * 1024 / sectorSize
+	// number of sectors used by the GPT partition entries (128 entries of 128 bytes)
+	gptEntriesSectors = 32
+	gptEntriesCount   = 128
+	gptEntrySize      = 128
+
+	mbrTypeExFAT         = 0x07
+	mbrTypeFAT32LBA      = 0x0c
+	mbrTypeGPTProtective = 0xee
+
+	storageImageLabel = "JETKVM"
+)
+
+const gptTypeBasicData = "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"
+
+// imageFile is a file placed in the root directory of a generated image
+type imageFile struct {
+	Name string
+	Data []byte
+}
+
+type diskPartition struct {
+	// Start and Sectors are in units of 512 byte sectors
+	Start   int64
+	Sectors int64
+	MBRType byte
+	GPTType string
+	Name    string
+}
+
+// putGUID stores a GUID in the mixed-endian layout used by GPT.
+func putGUID(b []byte, guid uuid.UUID) {
+	binary.LittleEndian.PutUint32(b[0:], binary.BigEndian.Uint32(guid[0:]))
+	binary.LittleEndian.PutUint16(b[4:], binary.BigEndian.Uint16(guid[4:]))
+	binary.LittleEndian.PutUint16(b[6:], binary.BigEndian.Uint16(guid[6:]))
+	copy(b[8:], guid[8:])
+}
+
+func putMBRPartition(entry []byte, start int64, sectors int64, partitionType byte) {
+	// CHS addressing is not used, fill in the maximum values like other tools do
+	entry[0] = 0x00
+	copy(entry[1:4], []byte{0xfe, 0xff, 0xff})
+	entry[4] = partitionType
+	copy(entry[5:8], []byte{0xfe, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(entry[8:], uint32(min(start, 0xffffffff)))
+	binary.LittleEndian.PutUint32(entry[12:], uint32(min(sectors, 0xffffffff)))
+}
+
+// buildMBR returns the first sector of a disk with an MBR partition table
+// holding up to four partitions.
+func buildMBR(partitions []diskPartition) ([]byte, error) {
+	if len(partitions) > 4 {
+		return nil, errors.New("MBR supports at most 4 primary partitions")
+	}
+	mbr := make([]byte, sectorSize)
+	diskID := uuid.New()
+	copy(mbr[440:444], diskID[:4])
+	for i, partition := range partitions {
+		if partition.Start+partition.Sectors > 0xffffffff {
+			return nil, errors.New("disk is too large for an MBR partition table")
+		}
+		putMBRPartition(mbr[446+i*16:], partition.Start, partition.Sectors, partition.MBRType)
+	}
+	mbr[510] = 0x55
+	mbr[511] = 0xaa
+	return mbr, nil
+}
+
+// buildGPT returns the protective MBR, primary GPT header and entries that go
+// at the start of the disk, and the backup entries and header that fill its
+// last gptEntriesSectors+1 sectors.
+func buildGPT(diskSectors int64, partitions []diskPartition) (primary []byte, backup []byte, err error) {
+	if len(partitions) > gptEntriesCount {
+		return nil, nil, fmt.Errorf("GPT supports at most %d partitions", gptEntriesCount)
+	}
+	lastLBA := diskSectors - 1
+	firstUsable := int64(2 + gptEntriesSectors)
+	lastUsable := lastLBA - 1 - gptEntriesSectors
+
+	entries := make([]byte, gptEntriesSectors*sectorSize)
+	for i, partition := range partitions {
+		if partition.Start < firstUsable || partition.Start+partition.Sectors-1 > lastUsable {
+			return nil, nil, fmt.Errorf("partition %d is outside of the usable area", i+1)
+		}
+		typeGUID, err := uuid.Parse(partition.GPTType)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid partition type: %w", err)
+		}
+		entry := entries[i*gptEntrySize:]
+		putGUID(entry[0:], typeGUID)
+		putGUID(entry[16:], uuid.New())
+		binary.LittleEndian.PutUint64(entry[32:], uint64(partition.Start))
+		binary.LittleEndian.PutUint64(entry[40:], uint64(partition.Start+partition.Sectors-1))
+		name := utf16.Encode([]rune(partition.Name))
+		for j := 0; j < len(name) && j < 36; j++ {
+			binary.LittleEndian.PutUint16(entry[56+j*2:], name[j])
+		}
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries)
+
+	diskGUID := uuid.New()
+	header := func(myLBA, alternateLBA, entriesLBA int64) []byte {
+		h := make([]byte, sectorSize)
+		copy(h[0:], "EFI PART")
+		binary.LittleEndian.PutUint32(h[8:], 0x00010000)
+		binary.LittleEndian.PutUint32(h[12:], 92)
+		binary.LittleEndian.PutUint64(h[24:], uint64(myLBA))
+		binary.LittleEndian.PutUint64(h[32:], uint64(alternateLBA))
+		binary.LittleEndian.PutUint64(h[40:], uint64(firstUsable))
+		binary.LittleEndian.PutUint64(h[48:], uint64(lastUsable))
+		putGUID(h[56:], diskGUID)
+		binary.LittleEndian.PutUint64(h[72:], uint64(entriesLBA))
+		binary.LittleEndian.PutUint32(h[80:], gptEntriesCount)
+		binary.LittleEndian.PutUint32(h[84:], gptEntrySize)
+		binary.LittleEndian.PutUint32(h[88:], entriesCRC)
+		binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h[:92]))
+		return h
+	}
+
+	protectiveMBR := make([]byte, sectorSize)
+	putMBRPartition(protectiveMBR[446:], 1, diskSectors-1, mbrTypeGPTProtective)
+	protectiveMBR[510] = 0x55
+	protectiveMBR[511] = 0xaa
+
+	primary = append(primary, protectiveMBR...)
+	primary = append(primary, header(1, lastLBA, 2)...)
+	primary = append(primary, entries...)
+
+	backup = append(backup, entries...)
+	backup = append(backup, header(lastLBA, 1, lastLBA-gptEntriesSectors)...)
+	return primary, backup, nil
+}
+
+// sectionWriter translates offsets so a filesystem can be written into a
+// partition without knowing where the partition starts.
+type sectionWriter struct {
+	w    io.WriterAt
+	base int64
+}
+
+func (s *sectionWriter) WriteAt(p []byte, off int64) (int, error) {
+	return s.w.WriteAt(p, s.base+off)
+}
+
+// writeStorageImageLayout partitions and formats the zero filled file,
+// placing files in the root directory of the filesystem.
+func writeStorageImageLayout(file *os.File, size int64, format StorageImageFormat, label string, files []imageFile) error {
+	diskSectors := size / sectorSize
+	partition := diskPartition{
+		Start: partitionAlignment,
+		Name:  label,
+	}
+
+	switch format {
+	case StorageImageMBRFAT32, StorageImageMBRExFAT:
+		partition.Sectors = diskSectors - partition.Start
+	case StorageImageGPTFAT32, StorageImageGPTExFAT:
+		// leave room for the backup GPT at the end of the disk
+		partition.Sectors = diskSectors - partition.Start - gptEntriesSectors - 1
+		partition.GPTType = gptTypeBasicData
+	}
+	// keep the partition a whole number of alignment units
+	partition.Sectors -= partition.Sectors % partitionAlignment
+	if partition.Sectors <= 0 {
+		return errors.New("image is too small for a partition")
+	}
+
+	fsWriter := &sectionWriter{w: file, base: partition.Start * sectorSize}
+	var err error
+	switch format {
+	case StorageImageMBRFAT32, StorageImageGPTFAT32:
+		partition.MBRType = mbrTypeFAT32LBA
+		err = formatFAT32(fsWriter, partition.Start, partition.Sectors, label, files)
+	case StorageImageMBRExFAT, StorageImageGPTExFAT:
+		partition.MBRType = mbrTypeExFAT
+		if len(files) > 0 {
+			return errors.New("adding files is only supported on FAT32")
+		}
+		err = formatExFAT(fsWriter, partition.Start, partition.Sectors, label)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to format partition: %w", err)
+	}
+
+	switch format {
+	case StorageImageMBRFAT32, StorageImageMBRExFAT:
+		mbr, err := buildMBR([]diskPartition{partition})
+		if err != nil {
+			return err
+		}
+		_, err = file.WriteAt(mbr, 0)
+		return err
+	default:
+		primary, backup, err := buildGPT(diskSectors, []diskPartition{partition})
+		if err != nil {
+			return err
+		}
+		if _, err := file.WriteAt(primary, 0); err != nil {
+			return err
+		}
+		_, err = file.WriteAt(backup, (diskSectors-gptEntriesSectors-1)*sectorSize)
+		return err
+	}
+}
+
+func rpcCreateStorageImage(name string, size int64, format StorageImageFormat) (*StorageFile, error) {
+	filename, err := sanitizeFilename(name)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "", StorageImageRaw:
+		format = StorageImageRaw
+	case StorageImageMBRFAT32, StorageImageMBRExFAT, StorageImageGPTFAT32, StorageImageGPTExFAT:
+	default:
+		return nil, fmt.Errorf("invalid image format: %s", format)
+	}
+	if size <= 0 {
+		return nil, errors.New("size must be a positive number of bytes")
+	}
+	// round up to whole alignment units so partitions fit exactly
+	alignmentBytes := int64(partitionAlignment * sectorSize)
+	size = (size + alignmentBytes - 1) / alignmentBytes * alignmentBytes
+
+	// the image is sparse, but the host is expected to fill it
+	space, err := rpcGetStorageSpace()
+	if err != nil {
+		return nil, err
+	}
+	if size > space.BytesFree {
+		return nil, fmt.Errorf("not enough free space for a %d byte image", size)
+	}
+
+	fullPath := filepath.Join(imagesFolder, filename)
+	file, err := os.OpenFile(fullPath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("file already exists: %s", filename)
+		}
+		return nil, fmt.Errorf("failed to create image file: %w", err)
+	}
+
+	err = file.Truncate(size)
+	if err == nil && format != StorageImageRaw {
+		err = writeStorageImageLayout(file, size, format, storageImageLabel, nil)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(fullPath)
+		return nil, fmt.Errorf("failed to create %s image: %w", format, err)
+	}
+
+	logger.Infof("created %s storage image %s with size %d", format, filename, size)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+	return &StorageFile{
+		Filename:  filename,
+		Size:      info.Size(),
+		CreatedAt: info.ModTime(),
+	}, nil
+}
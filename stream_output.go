@@ -0,0 +1,278 @@
+package kvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+const (
+	streamOutputMinBackoff = 1 * time.Second
+	streamOutputMaxBackoff = 30 * time.Second
+)
+
+type StreamOutputConfig struct {
+	// URL is rtmp://host[:port]/app/key or srt://host:port[?streamid=...&latency=ms]
+	URL string `json:"url"`
+	// Enabled resumes the output after a restart
+	Enabled bool `json:"enabled"`
+}
+
+type StreamOutputState struct {
+	State      string     `json:"state"` // idle, connecting, streaming, reconnecting
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	BytesSent  int64      `json:"bytesSent"`
+	Reconnects int        `json:"reconnects"`
+}
+
+// streamSink is a pushed stream: RTMP publishing FLV or SRT carrying MPEG-TS
+type streamSink interface {
+	WriteSample(nals [][]byte, sps []byte, pps []byte, duration time.Duration, keyframe bool) error
+	BytesSent() int64
+	// run blocks until the connection fails
+	run() error
+	Close() error
+}
+
+type streamOutputManager struct {
+	mu     sync.Mutex
+	state  StreamOutputState
+	sink   streamSink
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var streamOutput = &streamOutputManager{state: StreamOutputState{State: "idle"}}
+
+func dialStreamSink(ctx context.Context, target *url.URL) (streamSink, error) {
+	switch target.Scheme {
+	case "rtmp":
+		return dialRTMP(ctx, target)
+	case "srt":
+		return dialSRT(ctx, target)
+	default:
+		return nil, fmt.Errorf("unsupported scheme: %s", target.Scheme)
+	}
+}
+
+func parseStreamOutputURL(rawURL string) (*url.URL, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	if target.Scheme != "rtmp" && target.Scheme != "srt" {
+		return nil, errors.New("only rtmp:// and srt:// URLs are supported")
+	}
+	if target.Hostname() == "" {
+		return nil, errors.New("URL has no host")
+	}
+	return target, nil
+}
+
+func (m *streamOutputManager) setState(update func(state *StreamOutputState)) {
+	m.mu.Lock()
+	update(&m.state)
+	state := m.state
+	m.mu.Unlock()
+	broadcastJSONRPCEvent("streamOutputState", state)
+}
+
+func (m *streamOutputManager) getState() StreamOutputState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state := m.state
+	if m.sink != nil {
+		state.BytesSent += m.sink.BytesSent()
+	}
+	return state
+}
+
+func (m *streamOutputManager) start(target *url.URL) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel != nil {
+		return errors.New("stream output is already running")
+	}
+	ctx, cancel := context.WithCancel(appCtx)
+	m.cancel = cancel
+	m.done = make(chan struct{})
+	now := time.Now()
+	m.state = StreamOutputState{State: "connecting", StartedAt: &now}
+	go m.run(ctx, target, m.done)
+	return nil
+}
+
+func (m *streamOutputManager) stop() error {
+	m.mu.Lock()
+	if m.cancel == nil {
+		m.mu.Unlock()
+		return errors.New("stream output is not running")
+	}
+	m.cancel()
+	done := m.done
+	m.cancel, m.done = nil, nil
+	m.mu.Unlock()
+
+	<-done
+	m.setState(func(state *StreamOutputState) {
+		*state = StreamOutputState{State: "idle"}
+	})
+	return nil
+}
+
+// run keeps the stream connected, reconnecting with exponential backoff
+func (m *streamOutputManager) run(ctx context.Context, target *url.URL, done chan struct{}) {
+	defer close(done)
+	backoff := streamOutputMinBackoff
+	for {
+		sink, err := dialStreamSink(ctx, target)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Warnf("failed to connect stream output to %s: %v, retrying in %v", target.Host, err, backoff)
+			m.setState(func(state *StreamOutputState) {
+				state.State = "reconnecting"
+				state.Error = err.Error()
+			})
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, streamOutputMaxBackoff)
+			continue
+		}
+		backoff = streamOutputMinBackoff
+
+		logger.Infof("stream output connected to %s://%s", target.Scheme, target.Host)
+		m.mu.Lock()
+		m.sink = sink
+		m.mu.Unlock()
+		m.setState(func(state *StreamOutputState) {
+			state.State = "streaming"
+			state.Error = ""
+		})
+
+		err = m.stream(ctx, sink)
+		bytesSent := sink.BytesSent()
+		_ = sink.Close()
+		m.mu.Lock()
+		m.sink = nil
+		m.mu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warnf("stream output to %s lost: %v", target.Host, err)
+		m.setState(func(state *StreamOutputState) {
+			state.State = "reconnecting"
+			state.Error = err.Error()
+			state.BytesSent += bytesSent
+			state.Reconnects++
+		})
+	}
+}
+
+// stream feeds the video to a connected sink until it fails or ctx ends
+func (m *streamOutputManager) stream(ctx context.Context, sink streamSink) error {
+	failed := make(chan error, 1)
+	var sps, pps []byte
+	started, broken := false, false
+	write := func(sample media.Sample) error {
+		if broken {
+			return nil
+		}
+		nals := splitAnnexB(sample.Data)
+		for _, nal := range nals {
+			switch h264NALType(nal) {
+			case h264NALSPS:
+				sps = append([]byte(nil), nal...)
+			case h264NALPPS:
+				pps = append([]byte(nil), nal...)
+			}
+		}
+		keyframe := h264IsKeyframe(nals)
+		// receivers can only start decoding at a keyframe
+		if !started && (!keyframe || sps == nil || pps == nil) {
+			return nil
+		}
+		started = true
+		if err := sink.WriteSample(nals, sps, pps, sample.Duration, keyframe); err != nil {
+			broken = true
+			failed <- err
+		}
+		return nil
+	}
+
+	acquireVideo()
+	defer releaseVideo()
+	subscriber := broadcaster.subscribe("stream_output", write)
+	defer broadcaster.unsubscribe(subscriber)
+
+	closed := make(chan error, 1)
+	go func() { closed <- sink.run() }()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-failed:
+		return err
+	case err := <-closed:
+		return err
+	}
+}
+
+func startStreamOutput() {
+	if !config.StreamOutput.Enabled {
+		return
+	}
+	target, err := parseStreamOutputURL(config.StreamOutput.URL)
+	if err != nil {
+		logger.Errorf("invalid stream output URL: %v", err)
+		return
+	}
+	_ = streamOutput.start(target)
+}
+
+func rpcGetStreamOutputConfig() (StreamOutputConfig, error) {
+	return config.StreamOutput, nil
+}
+
+// rpcStartStreamOutput starts pushing to rawURL, or to the saved URL if empty
+func rpcStartStreamOutput(rawURL string) error {
+	if rawURL == "" {
+		rawURL = config.StreamOutput.URL
+	}
+	target, err := parseStreamOutputURL(rawURL)
+	if err != nil {
+		return err
+	}
+	if err := streamOutput.start(target); err != nil {
+		return err
+	}
+	config.StreamOutput = StreamOutputConfig{URL: rawURL, Enabled: true}
+	if err := SaveConfig(); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
+
+func rpcStopStreamOutput() error {
+	if err := streamOutput.stop(); err != nil {
+		return err
+	}
+	config.StreamOutput.Enabled = false
+	if err := SaveConfig(); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
+
+func rpcGetStreamOutputState() (StreamOutputState, error) {
+	return streamOutput.getState(), nil
+}
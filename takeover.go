@@ -0,0 +1,200 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TakeoverConfig decides what happens when the controller does not answer a
+// takeover request
+type TakeoverConfig struct {
+	TimeoutSec int `json:"timeout_sec"`
+	// ApproveOnTimeout hands control over when the controller does not
+	// answer, e.g. a forgotten tab. Off by default, the request is denied.
+	ApproveOnTimeout bool `json:"approve_on_timeout"`
+}
+
+// TakeoverRequest is sent to the controller in the takeoverRequested event
+type TakeoverRequest struct {
+	ID         string          `json:"id"`
+	Requester  SessionIdentity `json:"requester"`
+	ExpiresAt  time.Time       `json:"expiresAt"`
+	TimeoutSec int             `json:"timeoutSec"`
+	// ApproveOnTimeout tells the controller what not answering does
+	ApproveOnTimeout bool `json:"approveOnTimeout"`
+}
+
+// TakeoverResult is sent to the requester in the takeoverResult event,
+// Reason is approved, denied, timeout, forced or cancelled
+type TakeoverResult struct {
+	ID       string `json:"id"`
+	Approved bool   `json:"approved"`
+	Reason   string `json:"reason"`
+}
+
+// pendingTakeover is the one takeover request waiting for the controller
+type pendingTakeover struct {
+	request    TakeoverRequest
+	requester  *Session
+	controller *Session
+	timer      *time.Timer
+}
+
+var (
+	takeoverLock    sync.Mutex
+	currentTakeover *pendingTakeover
+)
+
+// requestTakeover asks the controller to hand control to requester, the
+// answer comes with respondTakeover or the timeout
+func requestTakeover(requester, controller *Session) (*TakeoverRequest, error) {
+	takeoverLock.Lock()
+	defer takeoverLock.Unlock()
+	if currentTakeover != nil {
+		if currentTakeover.requester == requester {
+			request := currentTakeover.request
+			return &request, nil
+		}
+		return nil, errors.New("another takeover request is pending")
+	}
+
+	timeout := config.Takeover.TimeoutSec
+	if timeout < 1 {
+		timeout = defaultConfig.Takeover.TimeoutSec
+	}
+	pending := &pendingTakeover{
+		request: TakeoverRequest{
+			ID:               uuid.New().String(),
+			Requester:        requester.identity(),
+			ExpiresAt:        time.Now().Add(time.Duration(timeout) * time.Second),
+			TimeoutSec:       timeout,
+			ApproveOnTimeout: config.Takeover.ApproveOnTimeout,
+		},
+		requester:  requester,
+		controller: controller,
+	}
+	id := pending.request.ID
+	pending.timer = time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+		resolveTakeover(id, pending.request.ApproveOnTimeout, "timeout")
+	})
+	currentTakeover = pending
+
+	logger.Infof("session %s requested control from %s", requester, controller.ID)
+	if controller.RPCChannel != nil {
+		go writeJSONRPCEvent("takeoverRequested", pending.request, controller)
+	}
+	request := pending.request
+	return &request, nil
+}
+
+// resolveTakeover ends the pending request with id, an empty id ends
+// whichever is pending. The requester gets control if approved and is still
+// connected.
+func resolveTakeover(id string, approved bool, reason string) bool {
+	takeoverLock.Lock()
+	pending := currentTakeover
+	if pending == nil || (id != "" && pending.request.ID != id) {
+		takeoverLock.Unlock()
+		return false
+	}
+	currentTakeover = nil
+	pending.timer.Stop()
+	takeoverLock.Unlock()
+
+	if approved && !sessions.contains(pending.requester) {
+		approved, reason = false, "cancelled"
+	}
+	logger.Infof("takeover request %s %s", pending.request.ID, reason)
+	result := TakeoverResult{ID: pending.request.ID, Approved: approved, Reason: reason}
+	if pending.requester.RPCChannel != nil {
+		writeJSONRPCEvent("takeoverResult", result, pending.requester)
+	}
+	if pending.controller.RPCChannel != nil && pending.controller != pending.requester {
+		writeJSONRPCEvent("takeoverResolved", result, pending.controller)
+	}
+	if approved {
+		sessions.setController(pending.requester)
+	} else if !config.MultiSession && sessions.contains(pending.requester) && !sessions.hasControl(pending.requester) {
+		// only the controller stays connected in single-session mode
+		terminateSession(pending.requester, "control request "+reason)
+	}
+	return true
+}
+
+// onTakeoverSessionGone settles the pending request when one of its sessions
+// disconnects or the controller lets go: a requester leaving cancels it, the
+// controller leaving approves it.
+func onTakeoverSessionGone(session *Session) {
+	takeoverLock.Lock()
+	pending := currentTakeover
+	takeoverLock.Unlock()
+	if pending == nil {
+		return
+	}
+	switch session {
+	case pending.requester:
+		resolveTakeover(pending.request.ID, false, "cancelled")
+	case pending.controller:
+		resolveTakeover(pending.request.ID, true, "approved")
+	}
+}
+
+// rpcRespondTakeover is the controller's answer to a takeoverRequested event
+func rpcRespondTakeover(session *Session, requestId string, approve bool) error {
+	takeoverLock.Lock()
+	pending := currentTakeover
+	takeoverLock.Unlock()
+	if pending == nil || pending.request.ID != requestId {
+		return errors.New("no such takeover request")
+	}
+	if !sessions.hasControl(session) {
+		return errors.New("only the session in control can answer a takeover request")
+	}
+	reason := "denied"
+	if approve {
+		reason = "approved"
+	}
+	resolveTakeover(requestId, approve, reason)
+	return nil
+}
+
+// rpcForceTakeover takes control without asking, for admin sessions only:
+// the cloud session of the device owner and, when a local password is set,
+// every local session, knowing the password makes them the owner too
+func rpcForceTakeover(session *Session) (ControlState, error) {
+	if session.viewOnly {
+		return ControlState{}, errors.New("view-only sessions cannot take control")
+	}
+	if !session.admin {
+		return ControlState{}, errors.New("only admin sessions can force a takeover")
+	}
+	if controller := sessions.getController(); controller != nil && controller != session {
+		logger.Warnf("session %s forced a takeover from %s", session, controller.ID)
+		if controller.RPCChannel != nil {
+			writeJSONRPCEvent("controlTakenOver", session.identity(), controller)
+		}
+	}
+	// control first, a pending request of session itself is not denied then
+	sessions.setController(session)
+	resolveTakeover("", false, "forced")
+	return sessions.controlState(session), nil
+}
+
+func rpcGetTakeoverConfig() (TakeoverConfig, error) {
+	return config.Takeover, nil
+}
+
+func rpcSetTakeoverConfig(params TakeoverConfig) error {
+	if params.TimeoutSec < 1 {
+		return errors.New("timeout must be at least 1 second")
+	}
+	config.Takeover = params
+	if err := SaveConfig(); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
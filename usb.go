@@ -374,11 +374,7 @@ func rpcGetUSBState() (state string) {
 
 func triggerUSBStateUpdate() {
 	go func() {
-		if currentSession == nil {
-			log.Println("No active RPC session, skipping update state update")
-			return
-		}
-		writeJSONRPCEvent("usbState", usbState, currentSession)
+		broadcastJSONRPCEvent("usbState", usbState)
 	}()
 }
 
@@ -52,6 +52,20 @@ func setMassStorageMode(cdrom bool) error {
 	return nil
 }
 
+// setMassStorageReadOnly controls whether the host can write to the LUN, it
+// can only be changed while no image is attached.
+func setMassStorageReadOnly(readOnly bool) error {
+	ro := "0"
+	if readOnly {
+		ro = "1"
+	}
+	err := writeFile(path.Join(massStorageFunctionPath, "lun.0", "ro"), ro)
+	if err != nil {
+		return fmt.Errorf("failed to set read-only mode: %w", err)
+	}
+	return nil
+}
+
 func onDiskMessage(msg webrtc.DataChannelMessage) {
 	fmt.Println("Disk Message, len:", len(msg.Data))
 	diskReadChan <- msg.Data
@@ -60,11 +74,11 @@ func onDiskMessage(msg webrtc.DataChannelMessage) {
 func mountImage(imagePath string) error {
 	err := setMassStorageImage("")
 	if err != nil {
-		return fmt.Errorf("Remove Mass Storage Image Error", err)
+		return fmt.Errorf("Remove Mass Storage Image Error: %w", err)
 	}
 	err = setMassStorageImage(imagePath)
 	if err != nil {
-		return fmt.Errorf("Set Mass Storage Image Error", err)
+		return fmt.Errorf("Set Mass Storage Image Error: %w", err)
 	}
 	return nil
 }
@@ -132,9 +146,10 @@ func rpcCheckMountUrl(url string) (*VirtualMediaUrlInfo, error) {
 type VirtualMediaSource string
 
 const (
-	WebRTC  VirtualMediaSource = "WebRTC"
-	HTTP    VirtualMediaSource = "HTTP"
-	Storage VirtualMediaSource = "Storage"
+	WebRTC    VirtualMediaSource = "WebRTC"
+	HTTP      VirtualMediaSource = "HTTP"
+	Storage   VirtualMediaSource = "Storage"
+	Composite VirtualMediaSource = "Composite"
 )
 
 type VirtualMediaMode string
@@ -149,7 +164,10 @@ type VirtualMediaState struct {
 	Mode     VirtualMediaMode   `json:"mode"`
 	Filename string             `json:"filename,omitempty"`
 	URL      string             `json:"url,omitempty"`
-	Size     int64              `json:"size"`
+	Format   DiskImageFormat    `json:"format,omitempty"`
+	// Partitions lists the images making up a composite disk
+	Partitions []string `json:"partitions,omitempty"`
+	Size       int64    `json:"size"`
 }
 
 var currentVirtualMediaState *VirtualMediaState
@@ -162,6 +180,7 @@ func rpcGetVirtualMediaState() (*VirtualMediaState, error) {
 }
 
 func rpcUnmountImage() error {
+	stopVirtualMediaActivity()
 	virtualMediaStateMutex.Lock()
 	defer virtualMediaStateMutex.Unlock()
 	err := setMassStorageImage("\n")
@@ -174,12 +193,24 @@ func rpcUnmountImage() error {
 		nbdDevice.Close()
 		nbdDevice = nil
 	}
+	if storageDiskImage != nil {
+		storageDiskImage.Close()
+		storageDiskImage = nil
+	}
 	currentVirtualMediaState = nil
+	if webRTCDiskSession != nil {
+		webRTCDiskSession.shouldUmountVirtualMedia = false
+		webRTCDiskSession = nil
+	}
 	return nil
 }
 
 var httpRangeReader *httpreadat.RangeReader
 
+// storageDiskImage is set while a non-raw image or a composite disk made of
+// images from imagesFolder is mounted
+var storageDiskImage diskImage
+
 func rpcMountWithHTTP(url string, mode VirtualMediaMode) error {
 	virtualMediaStateMutex.Lock()
 	if currentVirtualMediaState != nil {
@@ -201,9 +232,15 @@ func rpcMountWithHTTP(url string, mode VirtualMediaMode) error {
 	}
 	virtualMediaStateMutex.Unlock()
 
+	return mountNBDDevice()
+}
+
+// mountNBDDevice starts the NBD device backed by remoteImageBackend and
+// presents it to the host, currentVirtualMediaState must already be set.
+func mountNBDDevice() error {
 	logger.Debug("Starting nbd device")
 	nbdDevice = NewNBDDevice()
-	err = nbdDevice.Start()
+	err := nbdDevice.Start()
 	if err != nil {
 		logger.Errorf("failed to start nbd device: %v", err)
 		return err
@@ -211,15 +248,24 @@ func rpcMountWithHTTP(url string, mode VirtualMediaMode) error {
 	logger.Debug("nbd device started")
 	//TODO: replace by polling on block device having right size
 	time.Sleep(1 * time.Second)
-	err = setMassStorageImage("/dev/nbd0")
+	err = setMassStorageReadOnly(true)
+	if err != nil {
+		return err
+	}
+	err = setMassStorageImage(nbdDevicePath)
 	if err != nil {
 		return err
 	}
+	virtualMediaStateMutex.RLock()
+	startVirtualMediaActivity(currentVirtualMediaState.Size, true)
+	virtualMediaStateMutex.RUnlock()
 	logger.Info("usb mass storage mounted")
 	return nil
 }
 
-func rpcMountWithWebRTC(filename string, size int64, mode VirtualMediaMode) error {
+// rpcMountWithWebRTC mounts an image read from the calling session's browser,
+// it is unmounted when that session disconnects
+func rpcMountWithWebRTC(session *Session, filename string, size int64, mode VirtualMediaMode) error {
 	virtualMediaStateMutex.Lock()
 	if currentVirtualMediaState != nil {
 		virtualMediaStateMutex.Unlock()
@@ -231,24 +277,11 @@ func rpcMountWithWebRTC(filename string, size int64, mode VirtualMediaMode) erro
 		Filename: filename,
 		Size:     size,
 	}
+	webRTCDiskSession = session
+	session.shouldUmountVirtualMedia = true
 	virtualMediaStateMutex.Unlock()
 	logger.Debugf("currentVirtualMediaState is %v", currentVirtualMediaState)
-	logger.Debug("Starting nbd device")
-	nbdDevice = NewNBDDevice()
-	err := nbdDevice.Start()
-	if err != nil {
-		logger.Errorf("failed to start nbd device: %v", err)
-		return err
-	}
-	logger.Debug("nbd device started")
-	//TODO: replace by polling on block device having right size
-	time.Sleep(1 * time.Second)
-	err = setMassStorageImage("/dev/nbd0")
-	if err != nil {
-		return err
-	}
-	logger.Info("usb mass storage mounted")
-	return nil
+	return mountNBDDevice()
 }
 
 func rpcMountWithStorage(filename string, mode VirtualMediaMode) error {
@@ -258,28 +291,61 @@ func rpcMountWithStorage(filename string, mode VirtualMediaMode) error {
 	}
 
 	virtualMediaStateMutex.Lock()
-	defer virtualMediaStateMutex.Unlock()
 	if currentVirtualMediaState != nil {
+		virtualMediaStateMutex.Unlock()
 		return fmt.Errorf("another virtual media is already mounted")
 	}
 
 	fullPath := filepath.Join(imagesFolder, filename)
-	fileInfo, err := os.Stat(fullPath)
+	image, format, err := openDiskImage(fullPath)
 	if err != nil {
-		return fmt.Errorf("failed to get file info: %w", err)
+		virtualMediaStateMutex.Unlock()
+		return err
 	}
 
-	err = setMassStorageImage(fullPath)
-	if err != nil {
-		return fmt.Errorf("failed to set mass storage image: %w", err)
+	if format == RawImage {
+		// raw images are handed to the mass storage gadget directly
+		defer virtualMediaStateMutex.Unlock()
+		image.Close()
+		fileInfo, err := os.Stat(fullPath)
+		if err != nil {
+			return fmt.Errorf("failed to get file info: %w", err)
+		}
+
+		// images mounted as a disk are writable, e.g. blank images from createStorageImage
+		err = setMassStorageReadOnly(mode != Disk)
+		if err != nil {
+			return err
+		}
+		err = setMassStorageImage(fullPath)
+		if err != nil {
+			return fmt.Errorf("failed to set mass storage image: %w", err)
+		}
+		currentVirtualMediaState = &VirtualMediaState{
+			Source:   Storage,
+			Mode:     mode,
+			Filename: filename,
+			Format:   RawImage,
+			Size:     fileInfo.Size(),
+		}
+		// the kernel reads the file itself, only mounts over nbd are tracked
+		startVirtualMediaActivity(fileInfo.Size(), false)
+		return nil
 	}
+
+	// container formats are translated by remoteImageBackend and served over nbd
+	logger.Infof("using %s image %s with virtual size %d", format, filename, image.Size())
+	storageDiskImage = image
 	currentVirtualMediaState = &VirtualMediaState{
 		Source:   Storage,
 		Mode:     mode,
 		Filename: filename,
-		Size:     fileInfo.Size(),
+		Format:   format,
+		Size:     image.Size(),
 	}
-	return nil
+	virtualMediaStateMutex.Unlock()
+
+	return mountNBDDevice()
 }
 
 type StorageSpace struct {
@@ -3,6 +3,8 @@ package kvm
 import (
 	"encoding/json"
 	"log"
+	"sync"
+	"time"
 )
 
 // max frame size for 1080p video, specified in mpp venc setting
@@ -20,6 +22,59 @@ func writeCtrlAction(action string) error {
 	return err
 }
 
+// keyframes are expensive, viewers asking at the same time share one
+const keyframeRequestInterval = 500 * time.Millisecond
+
+var lastKeyframeRequest time.Time
+var keyframeRequestLock = &sync.Mutex{}
+
+// requestKeyframe asks the encoder in jetkvm_native for an IDR frame, at
+// most once per keyframeRequestInterval. It does not wait for an answer like
+// start_video, so a burst of requests never holds up other ctrl actions. The
+// error answer of a jetkvm_native without request_keyframe is dropped.
+func requestKeyframe() {
+	keyframeRequestLock.Lock()
+	if time.Since(lastKeyframeRequest) < keyframeRequestInterval {
+		keyframeRequestLock.Unlock()
+		return
+	}
+	lastKeyframeRequest = time.Now()
+	keyframeRequestLock.Unlock()
+
+	if err := writeCtrlAction("request_keyframe"); err != nil {
+		logger.Debugf("failed to request keyframe: %v", err)
+	}
+}
+
+// videoConsumers counts the outputs other than WebRTC sessions (RTSP players,
+// pushed streams) that keep the encoder running
+var videoConsumers = 0
+var videoConsumersLock = &sync.Mutex{}
+
+func acquireVideo() {
+	videoConsumersLock.Lock()
+	defer videoConsumersLock.Unlock()
+	videoConsumers++
+	if videoConsumers == 1 && sessions.count() == 0 {
+		_ = writeCtrlAction("start_video")
+	}
+}
+
+func releaseVideo() {
+	videoConsumersLock.Lock()
+	defer videoConsumersLock.Unlock()
+	videoConsumers--
+	if videoConsumers == 0 && sessions.count() == 0 && !recorder.isRecording() {
+		_ = writeCtrlAction("stop_video")
+	}
+}
+
+func hasVideoConsumers() bool {
+	videoConsumersLock.Lock()
+	defer videoConsumersLock.Unlock()
+	return videoConsumers > 0
+}
+
 type VideoInputState struct {
 	Ready          bool    `json:"ready"`
 	Error          string  `json:"error,omitempty"` //no_signal, no_lock, out_of_range
@@ -32,7 +87,7 @@ var lastVideoState VideoInputState
 
 func triggerVideoStateUpdate() {
 	go func() {
-		writeJSONRPCEvent("videoInputState", lastVideoState, currentSession)
+		broadcastJSONRPCEvent("videoInputState", lastVideoState)
 	}()
 }
 func HandleVideoStateMessage(event CtrlResponse) {
@@ -42,6 +97,8 @@ func HandleVideoStateMessage(event CtrlResponse) {
 		log.Println("Error parsing video state json:", err)
 		return
 	}
+	recordVideoState(lastVideoState, videoState)
+	observeVideoInputState(videoState)
 	lastVideoState = videoState
 	triggerVideoStateUpdate()
 	requestDisplayUpdate()
@@ -0,0 +1,163 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	videoStateHistorySize = 500
+	// fps reported by the capture chip jitters a little around the real rate
+	videoFPSChangeThreshold = 0.5
+)
+
+type SignalLossAlertConfig struct {
+	Enabled bool `json:"enabled"`
+	// ThresholdSec is how long the signal must be gone before alerting
+	ThresholdSec int `json:"threshold_sec"`
+}
+
+// VideoStateChange is one transition of the HDMI input
+type VideoStateChange struct {
+	Time  time.Time       `json:"time"`
+	State VideoInputState `json:"state"`
+	// Change is signal_lost, signal_restored, error_changed, resolution_changed,
+	// fps_changed, initial or signal_loss_alert
+	Change string `json:"change"`
+}
+
+type SignalLossEvent struct {
+	Since       time.Time `json:"since"`
+	DurationSec float64   `json:"durationSec"`
+	Error       string    `json:"error,omitempty"`
+}
+
+var (
+	videoHistoryLock  = &sync.Mutex{}
+	videoHistory      []VideoStateChange
+	videoHistoryNext  = 0
+	videoStateKnown   = false
+	signalLostAt      time.Time
+	signalLossTimer   *time.Timer
+	signalLossAlerted = false
+)
+
+func addVideoStateChange(change VideoStateChange) {
+	if len(videoHistory) < videoStateHistorySize {
+		videoHistory = append(videoHistory, change)
+		return
+	}
+	videoHistory[videoHistoryNext] = change
+	videoHistoryNext = (videoHistoryNext + 1) % videoStateHistorySize
+}
+
+// videoStateChangeKind names the difference between two states, or returns
+// "" when they only differ by fps jitter
+func videoStateChangeKind(previous VideoInputState, current VideoInputState) string {
+	switch {
+	case previous.Ready && !current.Ready:
+		return "signal_lost"
+	case !previous.Ready && current.Ready:
+		return "signal_restored"
+	case previous.Error != current.Error:
+		return "error_changed"
+	case previous.Width != current.Width || previous.Height != current.Height:
+		return "resolution_changed"
+	case math.Abs(previous.FramePerSecond-current.FramePerSecond) >= videoFPSChangeThreshold:
+		return "fps_changed"
+	}
+	return ""
+}
+
+// recordVideoState is called with every state reported by jetkvm_native, it
+// keeps the history and arms the signal loss alert
+func recordVideoState(previous VideoInputState, current VideoInputState) {
+	videoHistoryLock.Lock()
+	defer videoHistoryLock.Unlock()
+
+	now := time.Now()
+	kind := "initial"
+	if videoStateKnown {
+		kind = videoStateChangeKind(previous, current)
+		if kind == "" {
+			return
+		}
+	}
+	videoStateKnown = true
+	addVideoStateChange(VideoStateChange{Time: now, State: current, Change: kind})
+
+	if current.Ready {
+		if signalLossTimer != nil {
+			signalLossTimer.Stop()
+			signalLossTimer = nil
+		}
+		if signalLossAlerted {
+			signalLossAlerted = false
+			event := SignalLossEvent{Since: signalLostAt, DurationSec: now.Sub(signalLostAt).Seconds()}
+			logger.Infof("video signal restored after %.0fs", event.DurationSec)
+			go broadcastJSONRPCEvent("videoSignalRestored", event)
+		}
+		return
+	}
+	if signalLossTimer != nil || signalLossAlerted {
+		// still lost, only the reason changed
+		return
+	}
+	signalLostAt = now
+	alert := config.SignalLossAlert
+	if !alert.Enabled {
+		return
+	}
+	signalLossTimer = time.AfterFunc(time.Duration(alert.ThresholdSec)*time.Second, raiseSignalLossAlert)
+}
+
+func raiseSignalLossAlert() {
+	videoHistoryLock.Lock()
+	if signalLossTimer == nil {
+		// the signal came back while the timer fired
+		videoHistoryLock.Unlock()
+		return
+	}
+	signalLossTimer = nil
+	signalLossAlerted = true
+	state := lastVideoState
+	event := SignalLossEvent{
+		Since:       signalLostAt,
+		DurationSec: time.Since(signalLostAt).Seconds(),
+		Error:       state.Error,
+	}
+	addVideoStateChange(VideoStateChange{Time: time.Now(), State: state, Change: "signal_loss_alert"})
+	videoHistoryLock.Unlock()
+
+	logger.Warnf("video signal lost for %.0fs: %s", event.DurationSec, event.Error)
+	broadcastJSONRPCEvent("videoSignalLost", event)
+}
+
+// rpcGetVideoStateHistory returns the transitions oldest first
+func rpcGetVideoStateHistory() ([]VideoStateChange, error) {
+	videoHistoryLock.Lock()
+	defer videoHistoryLock.Unlock()
+	history := make([]VideoStateChange, 0, len(videoHistory))
+	history = append(history, videoHistory[videoHistoryNext:]...)
+	return append(history, videoHistory[:videoHistoryNext]...), nil
+}
+
+func rpcGetSignalLossAlert() (SignalLossAlertConfig, error) {
+	return config.SignalLossAlert, nil
+}
+
+// rpcSetSignalLossAlert applies to the next signal loss, an alert already
+// pending keeps its threshold
+func rpcSetSignalLossAlert(params SignalLossAlertConfig) error {
+	if params.ThresholdSec < 1 {
+		return errors.New("threshold must be at least 1 second")
+	}
+	config.SignalLossAlert = params
+	if err := SaveConfig(); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
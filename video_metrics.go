@@ -0,0 +1,115 @@
+package kvm
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Video pipeline metrics. Frame rate and bitrate are the rate() of the
+// frame and byte counters.
+
+const (
+	// a frame arriving later than this many frame intervals counts as late
+	videoLateFrameFactor = 2
+	// longer gaps are the video being stopped rather than late frames
+	videoPausedInterval = 5 * time.Second
+)
+
+var (
+	videoFramesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jetkvm_video_frames_total",
+		Help: "Frames received from jetkvm_native",
+	}, []string{"type"})
+	videoBytesCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "jetkvm_video_bytes_total",
+		Help: "Encoded video bytes received from jetkvm_native",
+	})
+	videoFrameSizeHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "jetkvm_video_frame_size_bytes",
+		Help:    "Size of the encoded frames",
+		Buckets: prometheus.ExponentialBuckets(1024, 2, 12),
+	}, []string{"type"})
+	videoFrameIntervalHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "jetkvm_video_frame_interval_seconds",
+		Help:    "Time between frames received from jetkvm_native",
+		Buckets: []float64{0.005, 0.01, 0.02, 0.033, 0.05, 0.1, 0.2, 0.5, 1, 2, 5},
+	})
+	videoKeyframeIntervalHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "jetkvm_video_keyframe_interval_seconds",
+		Help:    "Time between keyframes",
+		Buckets: []float64{0.5, 1, 2, 4, 8, 15, 30, 60, 120},
+	})
+	videoLateFramesCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "jetkvm_video_late_frames_total",
+		Help: "Frames that arrived more than two frame intervals after the previous one",
+	})
+	videoDroppedSamplesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jetkvm_video_dropped_samples_total",
+		Help: "Samples dropped because a consumer could not keep up",
+	}, []string{"consumer"})
+	videoWriteErrorsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "jetkvm_video_write_errors_total",
+		Help: "Errors writing samples to a consumer",
+	}, []string{"consumer"})
+	videoSubscribersGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "jetkvm_video_subscribers",
+		Help: "Consumers receiving the video",
+	}, []string{"consumer"})
+
+	videoInputReadyGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "jetkvm_video_input_ready",
+		Help: "Whether the HDMI input has a signal",
+	})
+	videoInputWidthGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "jetkvm_video_input_width_pixels",
+		Help: "Width of the HDMI input",
+	})
+	videoInputHeightGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "jetkvm_video_input_height_pixels",
+		Help: "Height of the HDMI input",
+	})
+	videoInputFPSGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "jetkvm_video_input_fps",
+		Help: "Frame rate of the HDMI input as reported by the capture chip",
+	})
+)
+
+var lastKeyframeAt time.Time
+
+// observeVideoFrame records a frame received from jetkvm_native, called from
+// the video socket goroutine only
+func observeVideoFrame(size int, interval time.Duration, keyframe bool) {
+	frameType := "delta"
+	if keyframe {
+		frameType = "key"
+		now := time.Now()
+		if !lastKeyframeAt.IsZero() {
+			videoKeyframeIntervalHistogram.Observe(now.Sub(lastKeyframeAt).Seconds())
+		}
+		lastKeyframeAt = now
+	}
+	videoFramesCounter.WithLabelValues(frameType).Inc()
+	videoBytesCounter.Add(float64(size))
+	videoFrameSizeHistogram.WithLabelValues(frameType).Observe(float64(size))
+	videoFrameIntervalHistogram.Observe(interval.Seconds())
+
+	if fps := lastVideoState.FramePerSecond; fps > 0 {
+		expected := time.Duration(float64(time.Second) / fps)
+		if interval > videoLateFrameFactor*expected && interval < videoPausedInterval {
+			videoLateFramesCounter.Inc()
+		}
+	}
+}
+
+func observeVideoInputState(state VideoInputState) {
+	ready := 0.0
+	if state.Ready {
+		ready = 1
+	}
+	videoInputReadyGauge.Set(ready)
+	videoInputWidthGauge.Set(float64(state.Width))
+	videoInputHeightGauge.Set(float64(state.Height))
+	videoInputFPSGauge.Set(state.FramePerSecond)
+}
@@ -0,0 +1,249 @@
+package kvm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// touched ranges are tracked in chunks, at most this many per image
+	virtualMediaMaxChunks = 65536
+	virtualMediaMinChunk  = 1024 * 1024
+)
+
+type VirtualMediaRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// VirtualMediaActivity is the read activity of the mounted media. Only mounts
+// served over nbd are tracked: HTTP, WebRTC, non-raw storage images and
+// composite disks. Raw storage images are handed to the mass storage gadget
+// directly and their reads are served by the kernel, so the counters of such
+// mounts stay at zero.
+type VirtualMediaActivity struct {
+	// Tracked is false for raw storage images, see above
+	Tracked   bool       `json:"tracked"`
+	BytesRead int64      `json:"bytesRead"`
+	Reads     int64      `json:"reads"`
+	ReadRate  float64    `json:"readRate"` // bytes per second
+	MountedAt time.Time  `json:"mountedAt"`
+	LastRead  *time.Time `json:"lastRead,omitempty"`
+	// TouchedRanges are the parts of the image read by the host, rounded to
+	// the tracking chunk size
+	TouchedRanges []VirtualMediaRange `json:"touchedRanges"`
+}
+
+type VirtualMediaAutoEject struct {
+	// IdleMinutes ejects the media after this many minutes without reads, 0
+	// disables it. Raw storage images are never ejected for being idle, see
+	// VirtualMediaActivity.
+	IdleMinutes int `json:"idle_minutes"`
+	// OnHostEject cleans up the mount when the host ejects the media
+	OnHostEject bool `json:"on_host_eject"`
+}
+
+type virtualMediaActivityTracker struct {
+	mu        sync.Mutex
+	tracked   bool
+	size      int64
+	chunkSize int64
+	chunks    []bool
+	bytesRead int64
+	reads     int64
+	readRate  float64
+	mountedAt time.Time
+	lastRead  time.Time
+	cancel    context.CancelFunc
+}
+
+var virtualMediaActivity = &virtualMediaActivityTracker{}
+
+func (t *virtualMediaActivityTracker) reset(size int64, tracked bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tracked = tracked
+	t.size = size
+	t.chunkSize = max(virtualMediaMinChunk, (size+virtualMediaMaxChunks-1)/virtualMediaMaxChunks)
+	t.chunks = make([]bool, (size+t.chunkSize-1)/t.chunkSize)
+	t.bytesRead = 0
+	t.reads = 0
+	t.readRate = 0
+	t.mountedAt = time.Now()
+	t.lastRead = time.Time{}
+}
+
+func (t *virtualMediaActivityTracker) recordRead(off int64, n int) {
+	if n <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.chunkSize == 0 {
+		return
+	}
+	t.bytesRead += int64(n)
+	t.reads++
+	t.lastRead = time.Now()
+	for c := off / t.chunkSize; c <= (off+int64(n)-1)/t.chunkSize && c < int64(len(t.chunks)); c++ {
+		t.chunks[c] = true
+	}
+}
+
+func (t *virtualMediaActivityTracker) snapshot() VirtualMediaActivity {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	activity := VirtualMediaActivity{
+		Tracked:       t.tracked,
+		BytesRead:     t.bytesRead,
+		Reads:         t.reads,
+		ReadRate:      t.readRate,
+		MountedAt:     t.mountedAt,
+		TouchedRanges: []VirtualMediaRange{},
+	}
+	if !t.lastRead.IsZero() {
+		lastRead := t.lastRead
+		activity.LastRead = &lastRead
+	}
+	for c := 0; c < len(t.chunks); c++ {
+		if !t.chunks[c] {
+			continue
+		}
+		start := int64(c) * t.chunkSize
+		for c < len(t.chunks) && t.chunks[c] {
+			c++
+		}
+		activity.TouchedRanges = append(activity.TouchedRanges, VirtualMediaRange{
+			Start: start,
+			End:   min(int64(c)*t.chunkSize, t.size),
+		})
+	}
+	return activity
+}
+
+func (t *virtualMediaActivityTracker) isTracked() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tracked
+}
+
+// idleSince returns the last read, or the mount time if nothing was read yet
+func (t *virtualMediaActivityTracker) idleSince() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lastRead.IsZero() {
+		return t.mountedAt
+	}
+	return t.lastRead
+}
+
+// startVirtualMediaActivity resets the counters for a newly mounted image and
+// starts the monitor reporting activity and applying the auto-eject policy.
+func startVirtualMediaActivity(size int64, tracked bool) {
+	stopVirtualMediaActivity()
+	virtualMediaActivity.reset(size, tracked)
+	ctx, cancel := context.WithCancel(context.Background())
+	virtualMediaActivity.mu.Lock()
+	virtualMediaActivity.cancel = cancel
+	virtualMediaActivity.mu.Unlock()
+	go runVirtualMediaActivityMonitor(ctx)
+}
+
+func stopVirtualMediaActivity() {
+	virtualMediaActivity.mu.Lock()
+	defer virtualMediaActivity.mu.Unlock()
+	if virtualMediaActivity.cancel != nil {
+		virtualMediaActivity.cancel()
+		virtualMediaActivity.cancel = nil
+	}
+}
+
+// hostEjectedMedia reports whether the host removed the media, the mass
+// storage function closes the backing file on a SCSI eject.
+func hostEjectedMedia() bool {
+	data, err := os.ReadFile(path.Join(massStorageFunctionPath, "lun.0", "file"))
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(data)) == ""
+}
+
+func runVirtualMediaActivityMonitor(ctx context.Context) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	lastTick := time.Now()
+	var lastBytes int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			virtualMediaActivity.mu.Lock()
+			bytesRead := virtualMediaActivity.bytesRead
+			wasReading := virtualMediaActivity.readRate != 0
+			virtualMediaActivity.readRate = float64(bytesRead-lastBytes) / now.Sub(lastTick).Seconds()
+			reading := virtualMediaActivity.readRate != 0
+			virtualMediaActivity.mu.Unlock()
+			// report while the host is reading, and once more when it stops
+			if reading || wasReading {
+				broadcastJSONRPCEvent("virtualMediaActivity", virtualMediaActivity.snapshot())
+			}
+			lastBytes = bytesRead
+			lastTick = now
+
+			if reason := virtualMediaAutoEjectReason(); reason != "" {
+				logger.Infof("auto-ejecting virtual media: %s", reason)
+				if err := rpcUnmountImage(); err != nil {
+					logger.Warnf("failed to auto-eject virtual media: %v", err)
+				}
+				return
+			}
+		}
+	}
+}
+
+func virtualMediaAutoEjectReason() string {
+	policy := config.VirtualMediaAutoEject
+	if policy.OnHostEject && hostEjectedMedia() {
+		return "host ejected the media"
+	}
+	// reads of untracked mounts are invisible, they would always look idle
+	if policy.IdleMinutes > 0 && virtualMediaActivity.isTracked() {
+		idle := time.Since(virtualMediaActivity.idleSince())
+		if idle >= time.Duration(policy.IdleMinutes)*time.Minute {
+			return fmt.Sprintf("no reads for %d minutes", policy.IdleMinutes)
+		}
+	}
+	return ""
+}
+
+func rpcGetVirtualMediaActivity() (*VirtualMediaActivity, error) {
+	virtualMediaStateMutex.RLock()
+	defer virtualMediaStateMutex.RUnlock()
+	if currentVirtualMediaState == nil {
+		return nil, nil
+	}
+	activity := virtualMediaActivity.snapshot()
+	return &activity, nil
+}
+
+func rpcGetVirtualMediaAutoEject() (VirtualMediaAutoEject, error) {
+	return config.VirtualMediaAutoEject, nil
+}
+
+func rpcSetVirtualMediaAutoEject(params VirtualMediaAutoEject) error {
+	if params.IdleMinutes < 0 {
+		return fmt.Errorf("invalid idle minutes: %d", params.IdleMinutes)
+	}
+	config.VirtualMediaAutoEject = params
+	if err := SaveConfig(); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
@@ -8,7 +8,6 @@ import (
 	"net/http"
 	"path/filepath"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -27,6 +26,14 @@ type WebRTCSessionRequest struct {
 	OidcGoogle string   `json:"OidcGoogle,omitempty"`
 	IP         string   `json:"ip,omitempty"`
 	ICEServers []string `json:"iceServers,omitempty"`
+	// Trickle asks the device to answer before ICE gathering completes and
+	// send its candidates in separate messages, see signaling.go
+	Trickle bool `json:"trickle,omitempty"`
+	// SessionID resumes a session with an ICE restart offer instead of
+	// starting a new one, see ice_restart.go. Local sessions also need the
+	// ResumeToken returned when they started.
+	SessionID   string `json:"sessionId,omitempty"`
+	ResumeToken string `json:"resumeToken,omitempty"`
 }
 
 type SetPasswordRequest struct {
@@ -94,11 +101,24 @@ func setupRouter() *gin.Engine {
 	prometheus.MustRegister(versioncollector.NewCollector("jetkvm"))
 	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
+	// WHEP players authenticate with a bearer token instead of the cookie
+	whep := r.Group(whepPath)
+	whep.Use(whepAuthMiddleware())
+	{
+		whep.OPTIONS("", handleWHEPOptions)
+		whep.POST("", handleWHEPOffer)
+		whep.PATCH("/:id", handleWHEPPatch)
+		whep.DELETE("/:id", handleWHEPDelete)
+	}
+
 	// Protected routes (allows both password and noPassword modes)
 	protected := r.Group("/")
 	protected.Use(protectedMiddleware())
 	{
 		protected.POST("/webrtc/session", handleWebRTCSession)
+		protected.GET("/webrtc/signaling", handleWebRTCSignaling)
+		protected.GET("/sessions", handleListSessions)
+		protected.DELETE("/sessions/:id", handleTerminateSession)
 		protected.POST("/cloud/register", handleCloudRegister)
 		protected.GET("/cloud/state", handleCloudState)
 		protected.GET("/device", handleDevice)
@@ -108,6 +128,7 @@ func setupRouter() *gin.Engine {
 		protected.PUT("/auth/password-local", handleUpdatePassword)
 		protected.DELETE("/auth/local-password", handleDeletePassword)
 		protected.POST("/storage/upload", handleUploadHttp)
+		protected.GET("/recordings/:filename", handleRecordingDownload)
 	}
 
 	// Catch-all route for SPA
@@ -122,9 +143,6 @@ func setupRouter() *gin.Engine {
 	return r
 }
 
-// TODO: support multiple sessions?
-var currentSession *Session
-
 func handleWebRTCSession(c *gin.Context) {
 	var req WebRTCSessionRequest
 
@@ -133,7 +151,28 @@ func handleWebRTCSession(c *gin.Context) {
 		return
 	}
 
-	session, err := newSession(SessionConfig{})
+	if req.SessionID != "" {
+		session := resumableLocalSession(req)
+		if session == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no such session"})
+			return
+		}
+		sd, err := rpcRenegotiate(session, req.Sd)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"sd": sd, "sessionId": session.ID})
+		return
+	}
+
+	// without a password anyone on the network can connect, so only
+	// password-authenticated sessions are admins, see SessionConfig.Admin
+	session, err := newSession(SessionConfig{
+		Source:     "local",
+		RemoteAddr: c.ClientIP(),
+		Admin:      config.LocalAuthMode == "password",
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
 		return
@@ -141,19 +180,12 @@ func handleWebRTCSession(c *gin.Context) {
 
 	sd, err := session.ExchangeOffer(req.Sd)
 	if err != nil {
+		_ = session.peerConnection.Close()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
 		return
 	}
-	if currentSession != nil {
-		writeJSONRPCEvent("otherSessionConnected", nil, currentSession)
-		peerConn := currentSession.peerConnection
-		go func() {
-			time.Sleep(1 * time.Second)
-			_ = peerConn.Close()
-		}()
-	}
-	currentSession = session
-	c.JSON(http.StatusOK, gin.H{"sd": sd})
+	// earlier sessions are kept or replaced once connected, see sessionRegistry
+	c.JSON(http.StatusOK, gin.H{"sd": sd, "sessionId": session.ID, "resumeToken": session.resumeToken})
 }
 
 func handleLogin(c *gin.Context) {
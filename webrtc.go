@@ -6,7 +6,13 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v4"
 )
 
@@ -18,103 +24,252 @@ type Session struct {
 	HidChannel               *webrtc.DataChannel
 	DiskChannel              *webrtc.DataChannel
 	shouldUmountVirtualMedia bool
+	videoSubscriber          *videoSubscriber
+	bandwidth                bandwidthEstimator
+	// viewOnly sessions only pull the video, e.g. WHEP players
+	viewOnly bool
+	// admin sessions can force a takeover
+	admin bool
+
+	ID string
+	// resumeToken is only returned with the first answer, see
+	// resumableLocalSession
+	resumeToken    string
+	source         string
+	remoteIdentity string
+	remoteAddr     string
+	connectedAt    time.Time
+	// channelsLock guards channels, the data channels the browser opened
+	channelsLock sync.Mutex
+	channels     []*webrtc.DataChannel
+	// lastActivity is in unix nanoseconds, expiryWarned is only used by the
+	// session policy goroutine, see session_policy.go
+	lastActivity atomic.Int64
+	expiryWarned time.Time
+
+	// negotiationLock serializes offers and answers after the first one,
+	// see ice_restart.go
+	negotiationLock sync.Mutex
+	// signalingLock guards signaling and iceFailedTimer
+	signalingLock  sync.Mutex
+	signaling      *signalingPath
+	iceFailedTimer *time.Timer
 }
 
 type SessionConfig struct {
 	ICEServers []string
 	LocalIP    string
 	IsCloud    bool
+	ViewOnly   bool
+	// Source, Identity and RemoteAddr describe the client, see SessionIdentity
+	Source     string
+	Identity   string
+	RemoteAddr string
+	// Admin is set for sessions authenticated as the device owner, the cloud
+	// owner or a local user with the password. They bypass the controller's
+	// approval with forceTakeover.
+	Admin bool
 }
 
 func (s *Session) ExchangeOffer(offerStr string) (string, error) {
-	b, err := base64.StdEncoding.DecodeString(offerStr)
+	offer, err := decodeSessionDescription(offerStr)
 	if err != nil {
 		return "", err
 	}
-	offer := webrtc.SessionDescription{}
-	err = json.Unmarshal(b, &offer)
+
+	answer, err := s.answerOffer(*offer)
 	if err != nil {
 		return "", err
 	}
-	// Set the remote SessionDescription
-	if err = s.peerConnection.SetRemoteDescription(offer); err != nil {
+
+	return encodeSessionDescription(answer)
+}
+
+// ExchangeOfferTrickle answers the offer without waiting for ICE gathering,
+// the local candidates are passed to onCandidate as they are found, then nil
+// once gathering completes.
+func (s *Session) ExchangeOfferTrickle(offerStr string, onCandidate func(*webrtc.ICECandidateInit)) (string, error) {
+	offer, err := decodeSessionDescription(offerStr)
+	if err != nil {
 		return "", err
 	}
 
+	s.peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			onCandidate(nil)
+			return
+		}
+		init := candidate.ToJSON()
+		onCandidate(&init)
+	})
+	answer, _, err := s.setOffer(*offer)
+	if err != nil {
+		return "", err
+	}
+
+	return encodeSessionDescription(answer)
+}
+
+// AddICECandidate adds a candidate trickled by the remote peer
+func (s *Session) AddICECandidate(candidate webrtc.ICECandidateInit) error {
+	if err := s.peerConnection.AddICECandidate(candidate); err != nil {
+		return fmt.Errorf("failed to add ICE candidate: %w", err)
+	}
+	return nil
+}
+
+// answerOffer applies the remote offer and returns the local answer with all
+// ICE candidates included.
+func (s *Session) answerOffer(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	_, gatherComplete, err := s.setOffer(offer)
+	if err != nil {
+		return nil, err
+	}
+
+	// Block until ICE Gathering is complete, for the signaling paths that
+	// only exchange one message, see ExchangeOfferTrickle for the others
+	<-gatherComplete
+
+	return s.peerConnection.LocalDescription(), nil
+}
+
+// setOffer applies the remote offer and sets the local answer, which starts
+// ICE gathering. The returned channel is closed once gathering completes.
+func (s *Session) setOffer(offer webrtc.SessionDescription) (*webrtc.SessionDescription, <-chan struct{}, error) {
+	// Set the remote SessionDescription, an offer with new ICE credentials
+	// restarts the gathering
+	if err := s.peerConnection.SetRemoteDescription(offer); err != nil {
+		return nil, nil, err
+	}
+
 	// Create answer
 	answer, err := s.peerConnection.CreateAnswer(nil)
 	if err != nil {
-		return "", err
+		return nil, nil, err
 	}
 
-	// Create channel that is blocked until ICE Gathering is complete
+	// Create channel that is blocked until ICE Gathering is complete, before
+	// the gathering of an ICE restart starts
 	gatherComplete := webrtc.GatheringCompletePromise(s.peerConnection)
 
 	// Sets the LocalDescription, and starts our UDP listeners
 	if err = s.peerConnection.SetLocalDescription(answer); err != nil {
-		return "", err
+		return nil, nil, err
 	}
+	return &answer, gatherComplete, nil
+}
 
-	// Block until ICE Gathering is complete, disabling trickle ICE
-	// we do this because we only can exchange one signaling message
-	// in a production application you should exchange ICE Candidates via OnICECandidate
-	<-gatherComplete
+func decodeSessionDescription(sd string) (*webrtc.SessionDescription, error) {
+	b, err := base64.StdEncoding.DecodeString(sd)
+	if err != nil {
+		return nil, err
+	}
+	description := webrtc.SessionDescription{}
+	if err := json.Unmarshal(b, &description); err != nil {
+		return nil, err
+	}
+	return &description, nil
+}
 
-	localDescription, err := json.Marshal(s.peerConnection.LocalDescription())
+func encodeSessionDescription(description *webrtc.SessionDescription) (string, error) {
+	b, err := json.Marshal(description)
 	if err != nil {
 		return "", err
 	}
-
-	return base64.StdEncoding.EncodeToString(localDescription), nil
+	return base64.StdEncoding.EncodeToString(b), nil
 }
 
 func newSession(config SessionConfig) (*Session, error) {
 	webrtcSettingEngine := webrtc.SettingEngine{}
-	iceServer := webrtc.ICEServer{}
+	iceServers, err := applyWebRTCNetworkConfig(&webrtcSettingEngine)
+	if err != nil {
+		return nil, err
+	}
 
 	if config.IsCloud {
+		iceServer := webrtc.ICEServer{}
 		if config.ICEServers == nil {
-			fmt.Printf("ICE Servers not provided by cloud")
+			logger.Debugf("ICE Servers not provided by cloud")
 		} else {
 			iceServer.URLs = config.ICEServers
-			fmt.Printf("Using ICE Servers provided by cloud: %v\n", iceServer.URLs)
+			logger.Debugf("Using ICE Servers provided by cloud: %v", iceServer.URLs)
 		}
+		iceServers = []webrtc.ICEServer{iceServer}
 
 		if config.LocalIP == "" || net.ParseIP(config.LocalIP) == nil {
-			fmt.Printf("Local IP address %v not provided or invalid, won't set NAT1To1IPs\n", config.LocalIP)
+			logger.Debugf("Local IP address %v not provided or invalid, won't set NAT1To1IPs", config.LocalIP)
 		} else {
 			webrtcSettingEngine.SetNAT1To1IPs([]string{config.LocalIP}, webrtc.ICECandidateTypeSrflx)
-			fmt.Printf("Setting NAT1To1IPs to %s\n", config.LocalIP)
+			logger.Debugf("Setting NAT1To1IPs to %s", config.LocalIP)
 		}
 	}
 
-	api := webrtc.NewAPI(webrtc.WithSettingEngine(webrtcSettingEngine))
+	// transport-wide sequence numbers make the browser send TWCC feedback,
+	// which the adaptive quality controller uses along with REMB
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+
+	api := webrtc.NewAPI(
+		webrtc.WithSettingEngine(webrtcSettingEngine),
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(interceptorRegistry),
+	)
 	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{iceServer},
+		ICEServers: iceServers,
 	})
 	if err != nil {
 		return nil, err
 	}
-	session := &Session{peerConnection: peerConnection}
+	session := &Session{
+		peerConnection: peerConnection,
+		viewOnly:       config.ViewOnly,
+		admin:          config.Admin,
+		ID:             uuid.New().String(),
+		source:         config.Source,
+		remoteIdentity: config.Identity,
+		remoteAddr:     config.RemoteAddr,
+		resumeToken:    uuid.New().String(),
+	}
 
 	peerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
-		fmt.Printf("New DataChannel %s %d\n", d.Label(), d.ID())
+		logger.Debugf("New DataChannel %s %d", d.Label(), d.ID())
+		if session.viewOnly {
+			// view-only sessions only get the video, never the terminal, RPC
+			// or disk channels
+			logger.Warnf("session %s: closing data channel %s of a view-only session", session.ID, d.Label())
+			d.OnOpen(func() { _ = d.Close() })
+			return
+		}
+		session.trackDataChannel(d)
 		switch d.Label() {
 		case "rpc":
 			session.RPCChannel = d
 			d.OnMessage(func(msg webrtc.DataChannelMessage) {
 				go onRPCMessage(msg, session)
 			})
-			triggerOTAStateUpdate()
-			triggerVideoStateUpdate()
-			triggerUSBStateUpdate()
+			// events sent before the channel is open are lost
+			d.OnOpen(func() {
+				triggerOTAStateUpdate()
+				triggerVideoStateUpdate()
+				triggerUSBStateUpdate()
+				go writeJSONRPCEvent("controlChanged", sessions.controlState(session), session)
+			})
 		case "disk":
 			session.DiskChannel = d
 			d.OnMessage(onDiskMessage)
 		case "terminal":
 			handleTerminalChannel(d)
 		case "serial":
-			handleSerialChannel(d)
+			handleSerialChannel(d, session)
 		default:
 			if strings.HasPrefix(d.Label(), uploadIdPrefix) {
 				go handleUploadChannel(d)
@@ -124,11 +279,13 @@ func newSession(config SessionConfig) (*Session, error) {
 
 	session.VideoTrack, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "kvm")
 	if err != nil {
+		_ = peerConnection.Close()
 		return nil, err
 	}
 
 	rtpSender, err := peerConnection.AddTrack(session.VideoTrack)
 	if err != nil {
+		_ = peerConnection.Close()
 		return nil, err
 	}
 
@@ -136,56 +293,73 @@ func newSession(config SessionConfig) (*Session, error) {
 	// Before these packets are returned they are processed by interceptors. For things
 	// like NACK this needs to be called.
 	go func() {
-		rtcpBuf := make([]byte, 1500)
 		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
+			packets, _, rtcpErr := rtpSender.ReadRTCP()
+			if rtcpErr != nil {
 				return
 			}
+			for _, packet := range packets {
+				session.bandwidth.onRTCP(packet)
+				switch packet.(type) {
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					// the viewer lost the picture, a keyframe recovers it right away
+					go requestKeyframe()
+				}
+			}
 		}
 	}()
 	var isConnected bool
 
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		fmt.Printf("Connection State has changed %s \n", connectionState.String())
+		logger.Debugf("Connection State has changed %s", connectionState.String())
 		if connectionState == webrtc.ICEConnectionStateConnected {
+			if session.stopICEFailedTimer() {
+				logger.Infof("session %s: ICE recovered", session.ID)
+			}
 			if !isConnected {
 				isConnected = true
-				actionSessions++
+				session.videoSubscriber = broadcaster.subscribe("webrtc", session.VideoTrack.WriteSample)
+				session.connectedAt = time.Now()
+				count := sessions.add(session)
 				onActiveSessionsChanged()
-				if actionSessions == 1 {
+				if count == 1 {
 					onFirstSessionConnected()
 				}
 			}
 		}
 		//state changes on closing browser tab disconnected->failed, we need to manually close it
+		//once the grace period for an ICE restart is over
 		if connectionState == webrtc.ICEConnectionStateFailed {
-			_ = peerConnection.Close()
+			session.onICEFailed()
 		}
 		if connectionState == webrtc.ICEConnectionStateClosed {
-			if session == currentSession {
-				currentSession = nil
+			if session.videoSubscriber != nil {
+				broadcaster.unsubscribe(session.videoSubscriber)
+				session.videoSubscriber = nil
 			}
+			session.stopICEFailedTimer()
+			unregisterSignalingSession(session)
 			if session.shouldUmountVirtualMedia {
 				err := rpcUnmountImage()
 				logger.Debugf("unmount image failed on connection close %v", err)
 			}
 			if isConnected {
 				isConnected = false
-				actionSessions--
+				count := sessions.remove(session)
 				onActiveSessionsChanged()
-				if actionSessions == 0 {
+				if count == 0 {
 					onLastSessionDisconnected()
 				}
 			}
 		}
 	})
+	registerSignalingSession(session)
 	return session, nil
 }
 
-var actionSessions = 0
-
 func onActiveSessionsChanged() {
 	requestDisplayUpdate()
+	onRecordingSessionsChanged()
 }
 
 func onFirstSessionConnected() {
@@ -193,5 +367,9 @@ func onFirstSessionConnected() {
 }
 
 func onLastSessionDisconnected() {
+	// a manual recording or another output keeps the video running
+	if recorder.isRecording() || hasVideoConsumers() {
+		return
+	}
 	_ = writeCtrlAction("stop_video")
 }
@@ -0,0 +1,246 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ICEServerConfig is a STUN or TURN server for local sessions, TURN servers
+// need the credentials
+type ICEServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// WebRTCNetworkConfig controls how local sessions reach the browser, for
+// deployments behind strict firewalls. Cloud sessions use the ICE servers the
+// cloud provides but share the ports.
+type WebRTCNetworkConfig struct {
+	ICEServers []ICEServerConfig `json:"ice_servers"`
+	// PortMin and PortMax limit the UDP ports of the sessions, 0 for random
+	// ports
+	PortMin uint16 `json:"port_min"`
+	PortMax uint16 `json:"port_max"`
+	// UDPMuxPort runs all sessions over this one UDP port instead of the
+	// port range, 0 to disable
+	UDPMuxPort int `json:"udp_mux_port"`
+	// ICETCPPort offers ICE-TCP candidates on this port for networks that
+	// block UDP, 0 to disable
+	ICETCPPort int `json:"ice_tcp_port"`
+}
+
+// webrtcMux is a listener shared by all sessions, apply sets it on the
+// SettingEngine of a new session
+type webrtcMux struct {
+	port  int
+	apply func(engine *webrtc.SettingEngine)
+	close func() error
+}
+
+// the current muxes, replaced when their port changes. They are nil while
+// disabled.
+var (
+	webrtcMuxLock sync.Mutex
+	webrtcUDPMux  *webrtcMux
+	webrtcTCPMux  *webrtcMux
+)
+
+// openUDPMux listens on port for the sessions, nil when port is 0
+func openUDPMux(port int) (*webrtcMux, error) {
+	if port == 0 {
+		return nil, nil
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on UDP port %d: %w", port, err)
+	}
+	mux := webrtc.NewICEUDPMux(nil, conn)
+	logger.Infof("WebRTC UDP mux listening on port %d", port)
+	return &webrtcMux{
+		port:  port,
+		apply: func(engine *webrtc.SettingEngine) { engine.SetICEUDPMux(mux) },
+		close: mux.Close,
+	}, nil
+}
+
+// openTCPMux listens on port for ICE-TCP, nil when port is 0
+func openTCPMux(port int) (*webrtcMux, error) {
+	if port == 0 {
+		return nil, nil
+	}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on TCP port %d: %w", port, err)
+	}
+	mux := webrtc.NewICETCPMux(nil, listener, 8)
+	logger.Infof("WebRTC ICE-TCP listening on port %d", port)
+	return &webrtcMux{
+		port: port,
+		apply: func(engine *webrtc.SettingEngine) {
+			engine.SetICETCPMux(mux)
+			engine.SetNetworkTypes([]webrtc.NetworkType{
+				webrtc.NetworkTypeUDP4,
+				webrtc.NetworkTypeUDP6,
+				webrtc.NetworkTypeTCP4,
+				webrtc.NetworkTypeTCP6,
+			})
+		},
+		close: mux.Close,
+	}, nil
+}
+
+func (m *webrtcMux) portOrZero() int {
+	if m == nil {
+		return 0
+	}
+	return m.port
+}
+
+func closeWebRTCMux(m *webrtcMux) {
+	if m != nil {
+		_ = m.close()
+	}
+}
+
+// getWebRTCMuxes returns the muxes of network, opening them on first use
+func getWebRTCMuxes(network WebRTCNetworkConfig) (udp *webrtcMux, tcp *webrtcMux, err error) {
+	webrtcMuxLock.Lock()
+	defer webrtcMuxLock.Unlock()
+	if webrtcUDPMux.portOrZero() != network.UDPMuxPort {
+		closeWebRTCMux(webrtcUDPMux)
+		if webrtcUDPMux, err = openUDPMux(network.UDPMuxPort); err != nil {
+			return nil, nil, err
+		}
+	}
+	if webrtcTCPMux.portOrZero() != network.ICETCPPort {
+		closeWebRTCMux(webrtcTCPMux)
+		if webrtcTCPMux, err = openTCPMux(network.ICETCPPort); err != nil {
+			return nil, nil, err
+		}
+	}
+	return webrtcUDPMux, webrtcTCPMux, nil
+}
+
+// applyWebRTCNetworkConfig sets the ports of the sessions on engine and
+// returns the ICE servers of local sessions
+func applyWebRTCNetworkConfig(engine *webrtc.SettingEngine) ([]webrtc.ICEServer, error) {
+	network := config.WebRTCNetwork
+
+	if network.PortMin != 0 || network.PortMax != 0 {
+		if err := engine.SetEphemeralUDPPortRange(network.PortMin, network.PortMax); err != nil {
+			return nil, fmt.Errorf("failed to set UDP port range: %w", err)
+		}
+	}
+
+	udpMux, tcpMux, err := getWebRTCMuxes(network)
+	if err != nil {
+		return nil, err
+	}
+	if udpMux != nil {
+		udpMux.apply(engine)
+	}
+	if tcpMux != nil {
+		tcpMux.apply(engine)
+	}
+
+	servers := make([]webrtc.ICEServer, 0, len(network.ICEServers))
+	for _, server := range network.ICEServers {
+		servers = append(servers, webrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+	return servers, nil
+}
+
+func validateWebRTCNetworkConfig(network WebRTCNetworkConfig) error {
+	for _, server := range network.ICEServers {
+		if len(server.URLs) == 0 {
+			return errors.New("ICE server without URLs")
+		}
+		for _, url := range server.URLs {
+			switch {
+			case strings.HasPrefix(url, "stun:"), strings.HasPrefix(url, "stuns:"):
+			case strings.HasPrefix(url, "turn:"), strings.HasPrefix(url, "turns:"):
+				if server.Username == "" || server.Credential == "" {
+					return fmt.Errorf("TURN server %s needs a username and credential", url)
+				}
+			default:
+				return fmt.Errorf("ICE server URL %s must start with stun:, stuns:, turn: or turns:", url)
+			}
+		}
+	}
+	if (network.PortMin == 0) != (network.PortMax == 0) || network.PortMin > network.PortMax {
+		return errors.New("invalid UDP port range")
+	}
+	if network.UDPMuxPort < 0 || network.UDPMuxPort > 65535 {
+		return errors.New("invalid UDP mux port")
+	}
+	if network.ICETCPPort < 0 || network.ICETCPPort > 65535 {
+		return errors.New("invalid ICE-TCP port")
+	}
+	return nil
+}
+
+func rpcGetWebRTCNetworkConfig() (WebRTCNetworkConfig, error) {
+	return config.WebRTCNetwork, nil
+}
+
+// rpcSetWebRTCNetworkConfig applies to new sessions, changing a mux port
+// ends the sessions on the old one. The new muxes are opened before anything
+// changes, so a port in use leaves the old settings in place.
+func rpcSetWebRTCNetworkConfig(params WebRTCNetworkConfig) error {
+	if err := validateWebRTCNetworkConfig(params); err != nil {
+		return err
+	}
+	webrtcMuxLock.Lock()
+	defer webrtcMuxLock.Unlock()
+
+	udpMux, tcpMux := webrtcUDPMux, webrtcTCPMux
+	udpChanged := udpMux.portOrZero() != params.UDPMuxPort
+	tcpChanged := tcpMux.portOrZero() != params.ICETCPPort
+	var err error
+	if udpChanged {
+		if udpMux, err = openUDPMux(params.UDPMuxPort); err != nil {
+			return err
+		}
+	}
+	if tcpChanged {
+		if tcpMux, err = openTCPMux(params.ICETCPPort); err != nil {
+			if udpChanged {
+				closeWebRTCMux(udpMux)
+			}
+			return err
+		}
+	}
+
+	previous := config.WebRTCNetwork
+	config.WebRTCNetwork = params
+	if err := SaveConfig(); err != nil {
+		config.WebRTCNetwork = previous
+		if udpChanged {
+			closeWebRTCMux(udpMux)
+		}
+		if tcpChanged {
+			closeWebRTCMux(tcpMux)
+		}
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+
+	if udpChanged {
+		closeWebRTCMux(webrtcUDPMux)
+		webrtcUDPMux = udpMux
+	}
+	if tcpChanged {
+		closeWebRTCMux(webrtcTCPMux)
+		webrtcTCPMux = tcpMux
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package kvm
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+// WHEP (WebRTC-HTTP Egress Protocol, RFC 9725) lets standard players such as
+// OBS or GStreamer's whepsrc pull the video: the offer is POSTed as plain SDP,
+// the answer comes back with a Location header naming the resource that is
+// DELETEd to end the session. Candidates are gathered before answering, so
+// trickle ICE (PATCH) is not supported.
+
+const (
+	whepPath       = "/whep"
+	mimeTypeSDP    = "application/sdp"
+	whepMaxSDPSize = 64 * 1024
+)
+
+var whepSessions = make(map[string]*Session)
+var whepSessionsLock = &sync.Mutex{}
+
+// whepAuthMiddleware accepts the WHEP bearer token, players can't log in.
+// Without a token the regular local authentication applies.
+func whepAuthMiddleware() gin.HandlerFunc {
+	protected := protectedMiddleware()
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if ok && config.WHEPToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.WHEPToken)) == 1 {
+			c.Next()
+			return
+		}
+		protected(c)
+	}
+}
+
+func handleWHEPOptions(c *gin.Context) {
+	c.Header("Accept-Post", mimeTypeSDP)
+	c.Status(http.StatusNoContent)
+}
+
+func handleWHEPOffer(c *gin.Context) {
+	if !strings.HasPrefix(c.ContentType(), mimeTypeSDP) {
+		c.String(http.StatusUnsupportedMediaType, "expected %s", mimeTypeSDP)
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(c.Request.Body, whepMaxSDPSize))
+	if err != nil {
+		c.String(http.StatusBadRequest, "failed to read offer: %v", err)
+		return
+	}
+
+	if err := validateWHEPOffer(string(offer)); err != nil {
+		c.String(http.StatusBadRequest, "unsupported offer: %v", err)
+		return
+	}
+
+	session, err := newSession(SessionConfig{ViewOnly: true, Source: "whep", RemoteAddr: c.ClientIP()})
+	if err != nil {
+		c.String(http.StatusInternalServerError, "failed to create session: %v", err)
+		return
+	}
+	answer, err := session.answerOffer(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)})
+	if err != nil {
+		_ = session.peerConnection.Close()
+		c.String(http.StatusBadRequest, "failed to answer offer: %v", err)
+		return
+	}
+
+	id := session.ID
+	whepSessionsLock.Lock()
+	whepSessions[id] = session
+	whepSessionsLock.Unlock()
+	session.peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+			removeWHEPSession(id)
+		}
+	})
+	logger.Infof("WHEP session %s created for %s", id, c.ClientIP())
+
+	c.Header("Location", fmt.Sprintf("%s/%s", whepPath, id))
+	c.Data(http.StatusCreated, mimeTypeSDP, []byte(answer.SDP))
+}
+
+// validateWHEPOffer only accepts offers for the one video track the device
+// sends, recvonly and without audio, data channels or media from the player
+func validateWHEPOffer(offer string) error {
+	videos := 0
+	recvOnly := 0
+	for _, line := range strings.Split(offer, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			fields := strings.Fields(strings.TrimPrefix(line, "m="))
+			if len(fields) == 0 || fields[0] != "video" {
+				return fmt.Errorf("only video can be offered, got %q", line)
+			}
+			videos++
+		case line == "a=recvonly" && videos > 0:
+			recvOnly++
+		}
+	}
+	if videos != 1 {
+		return errors.New("the offer must have exactly one video section")
+	}
+	if recvOnly != 1 {
+		return errors.New("the video must be recvonly")
+	}
+	return nil
+}
+
+func handleWHEPDelete(c *gin.Context) {
+	session := removeWHEPSession(c.Param("id"))
+	if session == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	_ = session.peerConnection.Close()
+	c.Status(http.StatusOK)
+}
+
+func handleWHEPPatch(c *gin.Context) {
+	c.Status(http.StatusMethodNotAllowed)
+}
+
+func removeWHEPSession(id string) *Session {
+	whepSessionsLock.Lock()
+	defer whepSessionsLock.Unlock()
+	session, ok := whepSessions[id]
+	if !ok {
+		return nil
+	}
+	delete(whepSessions, id)
+	logger.Infof("WHEP session %s ended", id)
+	return session
+}
+
+func rpcGetWHEPToken() (string, error) {
+	return config.WHEPToken, nil
+}
+
+// rpcGenerateWHEPToken replaces the token used by WHEP players, existing
+// sessions stay connected
+func rpcGenerateWHEPToken() (string, error) {
+	config.WHEPToken = uuid.New().String()
+	if err := SaveConfig(); err != nil {
+		return "", fmt.Errorf("failed to save config: %w", err)
+	}
+	return config.WHEPToken, nil
+}
+
+func rpcClearWHEPToken() error {
+	config.WHEPToken = ""
+	if err := SaveConfig(); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package kvm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestWHEPSessionClosesDataChannels(t *testing.T) {
+	appCtx = context.Background()
+	ensureConfigLoaded()
+
+	session, err := newSession(SessionConfig{ViewOnly: true, Source: "whep"})
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	defer session.peerConnection.Close()
+
+	player, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("failed to create player: %v", err)
+	}
+	defer player.Close()
+
+	terminal, err := player.CreateDataChannel("terminal", nil)
+	if err != nil {
+		t.Fatalf("failed to create data channel: %v", err)
+	}
+	closed := make(chan struct{})
+	terminal.OnClose(func() { close(closed) })
+	terminal.OnMessage(func(msg webrtc.DataChannelMessage) {
+		t.Errorf("view-only session answered on the terminal: %q", msg.Data)
+	})
+
+	offer, err := player.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("failed to create offer: %v", err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(player)
+	if err := player.SetLocalDescription(offer); err != nil {
+		t.Fatalf("failed to set offer: %v", err)
+	}
+	<-gatherComplete
+
+	answer, err := session.answerOffer(*player.LocalDescription())
+	if err != nil {
+		t.Fatalf("failed to answer: %v", err)
+	}
+	if err := player.SetRemoteDescription(*answer); err != nil {
+		t.Fatalf("failed to set answer: %v", err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("terminal data channel of a WHEP session was not closed")
+	}
+}
+
+func TestValidateWHEPOffer(t *testing.T) {
+	video := "v=0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=recvonly\r\n"
+	tests := []struct {
+		name  string
+		offer string
+		valid bool
+	}{
+		{"recvonly video", video, true},
+		{"sendrecv video", "v=0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=sendrecv\r\n", false},
+		{"audio", video + "m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=recvonly\r\n", false},
+		{"data channel", video + "m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\n", false},
+		{"two videos", video + video[len("v=0\r\n"):], false},
+	}
+	for _, test := range tests {
+		err := validateWHEPOffer(test.offer)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}